@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Timestamp layout of the Common and Combined formats
+const clfTime = "02/Jan/2006:15:04:05 -0700"
+
+// One line of the access log
+type accessEntry struct {
+	Time      time.Time `json:"time"`
+	Remote    string    `json:"remote"`
+	User      string    `json:"user,omitempty"`
+	Method    string    `json:"method"`
+	URI       string    `json:"uri"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Duration  float64   `json:"duration_ms"`
+}
+
+// Logs every request served, in the configured format,
+// to the access log rather than the error log
+func accessLogMiddleware(hop http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := newResponseRecorder(w)
+		// filled in by authMiddleware further in
+		seen := new(string)
+		hop.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), logUserKey, seen)))
+
+		confVars.mu.RLock()
+		format := confVars.accessLogFormat
+		confVars.mu.RUnlock()
+
+		entry := newAccessEntry(r, rec, start, *seen)
+		writeAccessLine(entry.format(format))
+	})
+}
+
+// Gathers what the access log records about a request
+func newAccessEntry(r *http.Request, rec *responseRecorder, start time.Time, user string) *accessEntry {
+	remote := r.RemoteAddr
+	if ip := getIPfromCtx(r.Context()); ip != nil {
+		remote = ip.String()
+	} else if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		remote = host
+	}
+	return &accessEntry{
+		Time:      start,
+		Remote:    remote,
+		User:      user,
+		Method:    r.Method,
+		URI:       r.RequestURI,
+		Proto:     r.Proto,
+		Status:    rec.status,
+		Bytes:     rec.written,
+		Referer:   r.Referer(),
+		UserAgent: r.UserAgent(),
+		Duration:  float64(time.Since(start)) / float64(time.Millisecond),
+	}
+}
+
+// Hands the signed-in user to accessLogMiddleware,
+// when the request went through it. Only users whose
+// credentials authMiddleware verified are logged.
+func noteUser(r *http.Request, user string) {
+	if seen, ok := r.Context().Value(logUserKey).(*string); ok {
+		*seen = user
+	}
+}
+
+// Formats the entry as "common", "combined" or "json".
+// Anything else is treated as "combined".
+func (e *accessEntry) format(format string) []byte {
+	if format == "json" {
+		out, err := json.Marshal(e)
+		if err != nil {
+			log.Printf("Couldn't encode access log entry: %v\n", err.Error())
+			return nil
+		}
+		return append(out, '\n')
+	}
+
+	buf := bytes.NewBuffer(nil)
+	buf.WriteString(e.Remote)
+	buf.WriteString(" - ")
+	buf.WriteString(clfUser(e.User))
+	buf.WriteString(" [")
+	buf.WriteString(e.Time.Format(clfTime))
+	buf.WriteString("] ")
+	buf.WriteString(strconv.Quote(e.Method + " " + e.URI + " " + e.Proto))
+	buf.WriteString(" ")
+	buf.WriteString(strconv.Itoa(e.Status))
+	buf.WriteString(" ")
+	if e.Bytes > 0 {
+		buf.WriteString(strconv.FormatInt(e.Bytes, 10))
+	} else {
+		buf.WriteString("-")
+	}
+	if format != "common" {
+		buf.WriteString(" ")
+		buf.WriteString(strconv.Quote(clfField(e.Referer)))
+		buf.WriteString(" ")
+		buf.WriteString(strconv.Quote(clfField(e.UserAgent)))
+	}
+	buf.WriteString("\n")
+	return buf.Bytes()
+}
+
+// Empty fields are written as a dash
+func clfField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// Escapes the user field, which isn't quoted, so
+// names can't add fields or lines to the log
+func clfUser(s string) string {
+	if s == "" {
+		return "-"
+	}
+	quoted := strconv.Quote(s)
+	return strings.Replace(quoted[1:len(quoted)-1], " ", `\x20`, -1)
+}
+
+// Writes a line to the access log
+func writeAccessLine(line []byte) {
+	if len(line) == 0 {
+		return
+	}
+	accessLog.mu.RLock()
+	out := accessLog.out
+	accessLog.mu.RUnlock()
+
+	if _, err := out.Write(line); err != nil {
+		log.Printf("Couldn't write to access log: %v\n", err.Error())
+	}
+}
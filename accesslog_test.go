@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_accessEntry_format(t *testing.T) {
+	entry := &accessEntry{
+		Time:      time.Date(2019, 5, 4, 13, 55, 36, 0, time.UTC),
+		Remote:    "10.0.0.1",
+		Method:    "GET",
+		URI:       "/w/example",
+		Proto:     "HTTP/1.1",
+		Status:    200,
+		Bytes:     512,
+		Referer:   "http://example.com/",
+		UserAgent: "curl/7.64",
+	}
+
+	common := `10.0.0.1 - - [04/May/2019:13:55:36 +0000] "GET /w/example HTTP/1.1" 200 512` + "\n"
+	if got := string(entry.format("common")); got != common {
+		t.Errorf("format(common): got %q, want %q\n", got, common)
+	}
+
+	combined := strings.TrimSuffix(common, "\n") + ` "http://example.com/" "curl/7.64"` + "\n"
+	if got := string(entry.format("combined")); got != combined {
+		t.Errorf("format(combined): got %q, want %q\n", got, combined)
+	}
+
+	entry.User = "a b\nc\""
+	if got := string(entry.format("common")); !strings.HasPrefix(got, `10.0.0.1 - a\x20b\nc\" [`) {
+		t.Errorf("format(common): didn't escape the user: %q\n", got)
+	}
+
+	var decoded accessEntry
+	if err := json.Unmarshal(entry.format("json"), &decoded); err != nil {
+		t.Fatalf("format(json): %v\n", err)
+	}
+	if decoded.URI != entry.URI || decoded.Status != 200 || decoded.Bytes != 512 {
+		t.Errorf("format(json): got %+v\n", decoded)
+	}
+}
+
+func Test_accessLogMiddleware(t *testing.T) {
+	initConfigParams()
+	buf := bytes.NewBuffer(nil)
+	accessLog.mu.Lock()
+	oldOut := accessLog.out
+	accessLog.out = buf
+	accessLog.mu.Unlock()
+	defer func() {
+		accessLog.mu.Lock()
+		accessLog.out = oldOut
+		accessLog.mu.Unlock()
+	}()
+
+	confVars.mu.Lock()
+	confVars.accessLogFormat = "common"
+	confVars.mu.Unlock()
+
+	hop := ipMiddleware(accessLogMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("gone"))
+	})))
+	r := httptest.NewRequest("GET", "/css", nil)
+	r.RemoteAddr = "192.0.2.7:5555"
+	hop.ServeHTTP(httptest.NewRecorder(), r)
+
+	line := buf.String()
+	if !strings.HasPrefix(line, "192.0.2.7 - - [") || !strings.HasSuffix(line, `"GET /css HTTP/1.1" 404 4`+"\n") {
+		t.Errorf("accessLogMiddleware(): got %q\n", line)
+	}
+
+	// the wiki's own 404 page is logged as one
+	buf.Reset()
+	hop = ipMiddleware(accessLogMiddleware(http.HandlerFunc(error404)))
+	hop.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/w/nowhere", nil))
+	if line := buf.String(); !strings.Contains(line, `"GET /w/nowhere HTTP/1.1" 404 `) {
+		t.Errorf("accessLogMiddleware(): got %q for the 404 page\n", line)
+	}
+}
+
+func Test_accessLogMiddleware_user(t *testing.T) {
+	defer privatePageDir(t)()
+	buf := bytes.NewBuffer(nil)
+	accessLog.mu.Lock()
+	oldOut := accessLog.out
+	accessLog.out = buf
+	accessLog.mu.Unlock()
+	defer func() {
+		accessLog.mu.Lock()
+		accessLog.out = oldOut
+		accessLog.mu.Unlock()
+	}()
+
+	confVars.mu.Lock()
+	confVars.accessLogFormat = "common"
+	confVars.mu.Unlock()
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	cookie := &http.Cookie{Name: sessionCookie, Value: signSession("alice", time.Now().Add(time.Hour))}
+	tests := []struct {
+		name string
+		hop  http.Handler
+		want string
+	}{
+		{"signed in", accessLogMiddleware(authMiddleware(ok)), "192.0.2.7 - alice ["},
+		// the user comes from authMiddleware, not the cookie
+		{"not checked", accessLogMiddleware(ok), "192.0.2.7 - - ["},
+		// nor from basic auth credentials that were refused
+		{"wrong password", accessLogMiddleware(authMiddleware(ok)), "192.0.2.7 - - ["},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.Reset()
+			r := httptest.NewRequest("GET", "/w/open", nil)
+			r.RemoteAddr = "192.0.2.7:5555"
+			r.AddCookie(cookie)
+			if tt.name == "wrong password" {
+				r.SetBasicAuth("mallory x", "wrong")
+			}
+			ipMiddleware(tt.hop).ServeHTTP(httptest.NewRecorder(), r)
+			if line := buf.String(); !strings.HasPrefix(line, tt.want) {
+				t.Errorf("accessLogMiddleware(): got %q, want %q...\n", line, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// content-type constants for the other
+// representations of a page
+const markdownutf8 = "text/markdown; charset=utf-8"
+const jsonutf8 = "application/json; charset=utf-8"
+
+// Media types pageHandler can respond with,
+// in order of preference
+var pageOffers = []string{"text/html", "text/markdown", "application/json"}
+
+// JSON representation of a page
+type pageJSON struct {
+	Name    string    `json:"name"`
+	Title   string    `json:"title"`
+	Desc    string    `json:"description"`
+	Author  string    `json:"author"`
+	Modtime time.Time `json:"modtime"`
+	ETag    string    `json:"etag"`
+	Body    string    `json:"body"`
+}
+
+// Picks the best of the offered media types for an
+// Accept header. Ties go to the earlier offer, and
+// an empty header accepts the first offer. Returns
+// an empty string if nothing offered is acceptable.
+func negotiate(accept string, offers []string) string {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+
+	best := ""
+	bestq := 0.0
+	for _, offer := range offers {
+		q := 0.0
+		specificity := -1
+		for _, part := range strings.Split(accept, ",") {
+			params := strings.Split(part, ";")
+			mediatype := strings.ToLower(strings.TrimSpace(params[0]))
+
+			// an exact match beats type/*, which beats */*
+			spec := -1
+			switch {
+			case mediatype == offer:
+				spec = 2
+			case strings.HasSuffix(mediatype, "/*") && strings.HasPrefix(offer, strings.TrimSuffix(mediatype, "*")):
+				spec = 1
+			case mediatype == "*/*":
+				spec = 0
+			}
+			if spec < specificity || spec < 0 {
+				continue
+			}
+
+			thisq := 1.0
+			for _, param := range params[1:] {
+				kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+				if len(kv) == 2 && strings.TrimSpace(kv[0]) == "q" {
+					if parsed, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64); err == nil {
+						thisq = parsed
+					}
+				}
+			}
+			specificity = spec
+			q = thisq
+		}
+		if q > bestq {
+			best = offer
+			bestq = q
+		}
+	}
+	return best
+}
+
+// Serves a page's raw markdown
+func rawHandler(w http.ResponseWriter, r *http.Request) {
+	page, err := freshPage(mux.Vars(r)["pageReq"] + ".md")
+	if err != nil {
+		log.Printf("%v\n", err)
+		error404(w, r)
+		return
+	}
+	writeRaw(w, r, page)
+}
+
+// Serves a page's metadata and rendered body as JSON
+func apiPageHandler(w http.ResponseWriter, r *http.Request) {
+	page, err := freshPage(mux.Vars(r)["pageReq"] + ".md")
+	if err != nil {
+		log.Printf("%v\n", err)
+		w.Header().Set("Content-Type", jsonutf8)
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte("{\"error\":\"page not found\"}\n"))
+		return
+	}
+	writeJSON(w, r, page)
+}
+
+// Writes the raw markdown representation of a page
+func writeRaw(w http.ResponseWriter, r *http.Request, page *Page) {
+	if notModified(w, r, page.ETag+"-md", page.LastMod) {
+		return
+	}
+	w.Header().Set("Content-Type", markdownutf8)
+	if err := writeBody(w, r, page.Raw); err != nil {
+		log500(w, r, err)
+		return
+	}
+}
+
+// Writes the JSON representation of a page
+func writeJSON(w http.ResponseWriter, r *http.Request, page *Page) {
+	confVars.mu.RLock()
+	descSep := confVars.descSep
+	confVars.mu.RUnlock()
+
+	desc, author := plainMeta(page, descSep)
+	etag := page.ETag
+	out, err := json.Marshal(pageJSON{
+		Name:    strings.TrimSuffix(page.Shortname, ".md"),
+		Title:   page.Title,
+		Desc:    desc,
+		Author:  author,
+		Modtime: page.Modtime,
+		ETag:    etag,
+		Body:    string(page.Content),
+	})
+	if err != nil {
+		log500(w, r, err)
+		return
+	}
+
+	if notModified(w, r, etag+"-json", page.LastMod) {
+		return
+	}
+	w.Header().Set("Content-Type", jsonutf8)
+	if err := writeBody(w, r, append(out, '\n')); err != nil {
+		log500(w, r, err)
+		return
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+var negotiateCases = []struct {
+	name   string
+	accept string
+	want   string
+}{
+	{
+		name:   "empty",
+		accept: "",
+		want:   "text/html",
+	},
+	{
+		name:   "browser",
+		accept: "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+		want:   "text/html",
+	},
+	{
+		name:   "markdown",
+		accept: "text/markdown",
+		want:   "text/markdown",
+	},
+	{
+		name:   "json preferred",
+		accept: "text/html;q=0.5, application/json",
+		want:   "application/json",
+	},
+	{
+		name:   "wildcard",
+		accept: "*/*",
+		want:   "text/html",
+	},
+	{
+		name:   "refused",
+		accept: "text/html;q=0, text/*;q=0.5",
+		want:   "text/markdown",
+	},
+	{
+		name:   "nothing acceptable",
+		accept: "image/png",
+		want:   "",
+	},
+}
+
+func Test_negotiate(t *testing.T) {
+	for _, tt := range negotiateCases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := negotiate(tt.accept, pageOffers); got != tt.want {
+				t.Errorf("negotiate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+func Benchmark_negotiate(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		for _, c := range negotiateCases {
+			negotiate(c.accept, pageOffers)
+		}
+	}
+}
+
+// Make sure /raw returns the markdown byte-for-byte
+func Test_rawHandler(t *testing.T) {
+	initConfigParams()
+	log.SetOutput(hush)
+	genPageCache()
+	raw, _ := ioutil.ReadFile("pages/example.md")
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "localhost:8080/raw/example", nil)
+	r = mux.SetURLVars(r, map[string]string{"pageReq": "example"})
+	rawHandler(w, r)
+	body, _ := ioutil.ReadAll(w.Result().Body)
+	if w.Code != 200 || w.Header().Get("Content-Type") != markdownutf8 {
+		t.Errorf("rawHandler(): %v %v\n", w.Code, w.Header().Get("Content-Type"))
+	}
+	if !bytes.Equal(body, raw) {
+		t.Errorf("rawHandler(): Byte mismatch\n")
+	}
+}
+
+// Asks pageHandler for JSON and checks the
+// metadata comes back without the markup
+func Test_pageHandler_json(t *testing.T) {
+	initConfigParams()
+	log.SetOutput(hush)
+	genPageCache()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "localhost:8080/w/example", nil)
+	r.Header.Set("Accept", "application/json")
+	r = mux.SetURLVars(r, map[string]string{"pageReq": "example"})
+	pageHandler(w, r)
+
+	var got pageJSON
+	if err := json.NewDecoder(w.Result().Body).Decode(&got); err != nil {
+		t.Fatalf("pageHandler(): couldn't decode JSON: %v\n", err)
+	}
+	if got.Title != "Example Page" || got.Desc != "Example page for the wiki" || got.Author != "gbmor" {
+		t.Errorf("pageHandler(): got %v, %v, %v\n", got.Title, got.Desc, got.Author)
+	}
+	if got.Body == "" || got.ETag == "" {
+		t.Errorf("pageHandler(): missing body or etag\n")
+	}
+	if w.Header().Get("Vary") != "Accept" {
+		t.Errorf("pageHandler(): missing Vary header\n")
+	}
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Name of the cookie holding a signed-in session
+const sessionCookie = "tildewiki_session"
+
+// Used when SessionLifetime isn't set or can't be parsed
+const defaultSessionLifetime = 7 * 24 * time.Hour
+
+// Compared against when a user doesn't exist, so the
+// time taken doesn't reveal which users do
+const dummyHash = "$2a$10$gHLY0h.fA/xMs/b5OomNEenagd7.baN0Ko3UJzlPoehjdaNWIh9JS"
+
+// The form shown by /login
+var loginTmpl = template.Must(template.New("login").Parse(`<h1>Sign in</h1>
+{{if .Failed}}<p><strong>Wrong user name or password.</strong></p>
+{{end}}<form method="post" action="/login">
+  <input type="hidden" name="next" value="{{.Next}}">
+  <input type="hidden" name="csrf" value="{{.CSRF}}">
+  <p><label>User <input type="text" name="user" value="{{.User}}" autofocus></label></p>
+  <p><label>Password <input type="password" name="password"></label></p>
+  <p><input type="submit" value="Sign in"></p>
+</form>
+`))
+
+// The form shown by /logout. Signing out changes
+// state, so it's only done by posting this form.
+var logoutTmpl = template.Must(template.New("logout").Parse(`<h1>Sign out</h1>
+<form method="post" action="/logout">
+  <input type="hidden" name="next" value="{{.Next}}">
+  <input type="hidden" name="csrf" value="{{.CSRF}}">
+  <p><input type="submit" value="Sign out"></p>
+</form>
+`))
+
+// Data passed to the login form template
+type loginForm struct {
+	User   string
+	Next   string
+	CSRF   string
+	Failed bool
+}
+
+// Returns true if an htpasswd file is configured.
+// Without one, nobody can sign in and private pages
+// are hidden from everyone.
+func authEnabled() bool {
+	confVars.mu.RLock()
+	defer confVars.mu.RUnlock()
+	return confVars.authFile != ""
+}
+
+// Reads the user names and bcrypt hashes from an
+// htpasswd file. Lines using other hash schemes are
+// skipped with a warning.
+func parseHtpasswd(data []byte) map[string][]byte {
+	hashes := make(map[string][]byte)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 1 {
+			continue
+		}
+		user, hash := line[:i], line[i+1:]
+		if !strings.HasPrefix(hash, "$2a$") && !strings.HasPrefix(hash, "$2b$") && !strings.HasPrefix(hash, "$2y$") {
+			log.Printf("Skipping user %v in htpasswd file: only bcrypt hashes are supported\n", user)
+			continue
+		}
+		hashes[user] = []byte(hash)
+	}
+	return hashes
+}
+
+// Re-reads the htpasswd file when it has changed
+// or a different one has been configured
+func (u *usersBlk) refresh() {
+	confVars.mu.RLock()
+	file := confVars.authFile
+	confVars.mu.RUnlock()
+
+	stat, err := os.Stat(file)
+	if err != nil {
+		log.Printf("Couldn't stat htpasswd file: %v\n", err.Error())
+		return
+	}
+
+	u.mu.RLock()
+	current := u.file == file && u.modtime.Equal(stat.ModTime())
+	u.mu.RUnlock()
+	if current {
+		return
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Printf("Couldn't read htpasswd file: %v\n", err.Error())
+		return
+	}
+	hashes := parseHtpasswd(data)
+
+	u.mu.Lock()
+	u.file = file
+	u.modtime = stat.ModTime()
+	u.hashes = hashes
+	u.verified = make(map[string][sha256.Size]byte)
+	u.mu.Unlock()
+}
+
+// Returns true if the user exists
+func (u *usersBlk) exists(user string) bool {
+	u.refresh()
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	_, ok := u.hashes[user]
+	return ok
+}
+
+// Checks a password against the user's hash. Basic
+// auth sends the password with every request, so
+// passwords that matched are remembered by an HMAC
+// keyed with the session key to skip bcrypt next
+// time. A plain hash would be quick to brute-force
+// from a memory dump.
+func (u *usersBlk) check(user, password string) bool {
+	u.refresh()
+	var sum [sha256.Size]byte
+	mac := hmac.New(sha256.New, u.sessionKey())
+	mac.Write([]byte(user + "\x00" + password))
+	copy(sum[:], mac.Sum(nil))
+
+	u.mu.RLock()
+	hash, ok := u.hashes[user]
+	seen, verified := u.verified[user]
+	u.mu.RUnlock()
+
+	if verified && hmac.Equal(seen[:], sum[:]) {
+		return true
+	}
+	if !ok {
+		_ = bcrypt.CompareHashAndPassword([]byte(dummyHash), []byte(password))
+		return false
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+
+	u.mu.Lock()
+	u.verified[user] = sum
+	u.mu.Unlock()
+	return true
+}
+
+// Returns the key sessions are signed with. Without
+// SessionSecret, a random key is made at startup and
+// sessions don't survive a restart.
+func (u *usersBlk) sessionKey() []byte {
+	confVars.mu.RLock()
+	secret := confVars.sessionSecret
+	confVars.mu.RUnlock()
+	if secret != "" {
+		sum := sha256.Sum256([]byte(secret))
+		return sum[:]
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.key == nil {
+		u.key = make([]byte, 32)
+		if _, err := rand.Read(u.key); err != nil {
+			log.Fatalf("Couldn't generate a session key: %v\n", err.Error())
+		}
+	}
+	return u.key
+}
+
+// Signs the user name and expiry time
+func signSession(user string, expires time.Time) string {
+	payload := user + "|" + strconv.FormatInt(expires.Unix(), 10)
+	mac := hmac.New(sha256.New, users.sessionKey())
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Returns the user a session cookie was signed for,
+// or an empty string if the signature doesn't match,
+// the session has expired or the user is gone
+func parseSession(value string) string {
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return ""
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+	mac := hmac.New(sha256.New, users.sessionKey())
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return ""
+	}
+
+	fields := strings.SplitN(string(payload), "|", 2)
+	if len(fields) != 2 {
+		return ""
+	}
+	expires, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return ""
+	}
+	if !users.exists(fields[0]) {
+		return ""
+	}
+	return fields[0]
+}
+
+// How long a session lasts
+func sessionLifetime() time.Duration {
+	confVars.mu.RLock()
+	lifetime := confVars.sessionLifetime
+	confVars.mu.RUnlock()
+	if lifetime <= 0 {
+		return defaultSessionLifetime
+	}
+	return lifetime
+}
+
+// Attaches the signed-in user, if any, to the request's
+// context. Basic auth credentials are checked on every
+// request; wrong ones get a 401 rather than being
+// treated as anonymous.
+func authMiddleware(hop http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authEnabled() {
+			hop.ServeHTTP(w, r)
+			return
+		}
+
+		user := ""
+		if name, password, ok := r.BasicAuth(); ok {
+			if !users.check(name, password) {
+				w.Header().Set("WWW-Authenticate", `Basic realm="tildewiki", charset="UTF-8"`)
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			user = name
+		} else if cookie, err := r.Cookie(sessionCookie); err == nil {
+			user = parseSession(cookie.Value)
+		}
+
+		noteUser(r, user)
+		if user != "" {
+			// responses may differ between users
+			w.Header().Set("Cache-Control", "private, no-cache")
+		}
+		hop.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey, user)))
+	})
+}
+
+// Returns the signed-in user making a request, or
+// an empty string for anonymous visitors
+func requestUser(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	user, _ := r.Context().Value(userKey).(string)
+	return user
+}
+
+// Returns true if a page is marked private. For
+// pages that aren't cached yet, only the header of
+// the file is read: this is called while rendering
+// pages, and building another page from here would
+// loop on pages linking to each other.
+func isPrivate(name string) bool {
+	if page, err := pullFromCache(name); err == nil {
+		return page.Private
+	}
+	fields, err := readHeader(keyFile(name))
+	if err != nil {
+		return false
+	}
+	return fields.private()
+}
+
+// Drops the private pages from a list of page names
+func publicNames(names []string) []string {
+	out := make([]string, 0, len(names))
+	for _, name := range names {
+		if !isPrivate(name) {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// Drops the private pages from a list of page
+// names unless the request is signed in
+func visibleNames(r *http.Request, names []string) []string {
+	if requestUser(r) != "" {
+		return names
+	}
+	return publicNames(names)
+}
+
+// Hides private pages from anonymous visitors on every
+// route naming a page, as if they didn't exist.
+// Installed on the router, so the page name is known.
+func privateMiddleware(hop http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, ok := mux.Vars(r)["pageReq"]
+		if ok && requestUser(r) == "" && isPrivate(name+".md") {
+			error404(w, r)
+			return
+		}
+		hop.ServeHTTP(w, r)
+	})
+}
+
+// Sends anonymous visitors to the sign-in form when
+// an htpasswd file is configured. Returns false if
+// the request shouldn't go any further.
+func requireSignIn(w http.ResponseWriter, r *http.Request) bool {
+	if !authEnabled() || requestUser(r) != "" {
+		return true
+	}
+	http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.Path), http.StatusSeeOther)
+	return false
+}
+
+// Only redirects to paths on this site after
+// signing in or out
+func localRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+// GET shows the sign-in form, POST checks the
+// credentials and sets the session cookie
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	if !authEnabled() {
+		error404(w, r)
+		return
+	}
+
+	form := loginForm{Next: localRedirect(r.URL.Query().Get("next"))}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !checkCSRF(r) {
+			csrfRejected(w)
+			return
+		}
+		form.User = r.PostFormValue("user")
+		form.Next = localRedirect(r.PostFormValue("next"))
+		if users.check(form.User, r.PostFormValue("password")) {
+			lifetime := sessionLifetime()
+			expires := time.Now().Add(lifetime)
+			http.SetCookie(w, &http.Cookie{
+				Name:     sessionCookie,
+				Value:    signSession(form.User, expires),
+				Path:     "/",
+				Expires:  expires,
+				MaxAge:   int(lifetime.Seconds()),
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteLaxMode,
+			})
+			log.Printf("**NOTICE** %v signed in from %v\n", form.User, getIPfromCtx(r.Context()))
+			http.Redirect(w, r, form.Next, http.StatusSeeOther)
+			return
+		}
+		log.Printf("**NOTICE** Failed sign-in for %v from %v\n", form.User, getIPfromCtx(r.Context()))
+		form.Failed = true
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	confVars.mu.RLock()
+	title := "Sign in " + confVars.titleSep + " " + confVars.wikiName
+	confVars.mu.RUnlock()
+
+	form.CSRF = csrfToken(w, r)
+	buf := bytes.NewBuffer(nil)
+	if err := loginTmpl.Execute(buf, form); err != nil {
+		log500(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", htmlutf8)
+	w.Header().Set("Cache-Control", "no-store")
+	if form.Failed {
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+	if _, err := w.Write(applyLayout(newLayoutData(title, buf.Bytes()))); err != nil {
+		log.Printf("Failed to write to HTTP stream: %v\n", err.Error())
+	}
+}
+
+// Shows the sign-out form on GET, and clears the
+// session cookie when it's posted
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if !authEnabled() {
+		error404(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		showLogoutForm(w, r)
+		return
+	case http.MethodPost:
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !checkCSRF(r) {
+		csrfRejected(w)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, localRedirect(r.PostFormValue("next")), http.StatusSeeOther)
+}
+
+// Writes the sign-out form
+func showLogoutForm(w http.ResponseWriter, r *http.Request) {
+	confVars.mu.RLock()
+	title := "Sign out " + confVars.titleSep + " " + confVars.wikiName
+	confVars.mu.RUnlock()
+
+	form := loginForm{
+		Next: localRedirect(r.URL.Query().Get("next")),
+		CSRF: csrfToken(w, r),
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := logoutTmpl.Execute(buf, form); err != nil {
+		log500(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", htmlutf8)
+	w.Header().Set("Cache-Control", "no-store")
+	if _, err := w.Write(applyLayout(newLayoutData(title, buf.Bytes()))); err != nil {
+		log.Printf("Failed to write to HTTP stream: %v\n", err.Error())
+	}
+}
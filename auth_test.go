@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Builds a page directory with a private page and an
+// htpasswd file, then points the config at them. The
+// returned func restores the config and cleans up.
+func privatePageDir(t *testing.T) func() {
+	initConfigParams()
+	log.SetOutput(hush)
+
+	dir, err := ioutil.TempDir("", "tildewiki-auth")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	files := map[string]string{
+		"pages/open.md":   "<!--\ntitle: Open Page\n-->\n# Open\n",
+		"pages/secret.md": "<!--\ntitle: Secret Page\naccess: Private\n-->\n# Secret\n\nSee [[open]].\n",
+		"htpasswd":        "# users\nalice:" + string(hash) + "\nbob:{SHA}nope\n",
+	}
+	os.Mkdir(dir+"/pages", 0755)
+	for name, body := range files {
+		if err := ioutil.WriteFile(dir+"/"+name, []byte(body), 0644); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+	}
+
+	confVars.mu.Lock()
+	oldDir := confVars.pageDir
+	confVars.pageDir = dir + "/pages"
+	confVars.authFile = dir + "/htpasswd"
+	confVars.mu.Unlock()
+	genPageCache()
+
+	return func() {
+		confVars.mu.Lock()
+		confVars.pageDir = oldDir
+		confVars.authFile = ""
+		confVars.mu.Unlock()
+		os.RemoveAll(dir)
+		evictPages("open.md")
+		evictPages("secret.md")
+	}
+}
+
+func Test_parseHtpasswd(t *testing.T) {
+	hashes := parseHtpasswd([]byte("# comment\n\nalice:$2y$05$abc\nbob:$apr1$xyz\nbroken\ncarol:$2b$10$def\n"))
+	if len(hashes) != 2 || string(hashes["alice"]) != "$2y$05$abc" || string(hashes["carol"]) != "$2b$10$def" {
+		t.Errorf("parseHtpasswd(): got %v\n", hashes)
+	}
+}
+
+func Test_usersBlk_check(t *testing.T) {
+	defer privatePageDir(t)()
+
+	tests := []struct {
+		user     string
+		password string
+		want     bool
+	}{
+		{"alice", "hunter2", true},
+		{"alice", "hunter2", true},
+		{"alice", "hunter3", false},
+		{"bob", "nope", false},
+		{"mallory", "hunter2", false},
+	}
+	for _, tt := range tests {
+		if got := users.check(tt.user, tt.password); got != tt.want {
+			t.Errorf("users.check(%v, %v): got %v, want %v\n", tt.user, tt.password, got, tt.want)
+		}
+	}
+}
+
+func Test_session(t *testing.T) {
+	defer privatePageDir(t)()
+
+	value := signSession("alice", time.Now().Add(time.Hour))
+	if got := parseSession(value); got != "alice" {
+		t.Errorf("parseSession(): got %q, want alice\n", got)
+	}
+
+	tampered := strings.Replace(value, value[:4], "Ym9i", 1)
+	for name, v := range map[string]string{
+		"expired":  signSession("alice", time.Now().Add(-time.Minute)),
+		"unknown":  signSession("mallory", time.Now().Add(time.Hour)),
+		"tampered": tampered,
+		"garbage":  "not.a-session",
+	} {
+		if got := parseSession(v); got != "" {
+			t.Errorf("parseSession(%v): got %q, want nothing\n", name, got)
+		}
+	}
+}
+
+func Test_localRedirect(t *testing.T) {
+	for next, want := range map[string]string{
+		"/w/example":       "/w/example",
+		"":                 "/",
+		"//evil.example":   "/",
+		"/\\evil.example":  "/",
+		"http://evil.test": "/",
+	} {
+		if got := localRedirect(next); got != want {
+			t.Errorf("localRedirect(%q): got %q, want %q\n", next, got, want)
+		}
+	}
+}
+
+// Private pages are hidden from anonymous visitors
+// on page routes and listings, but not from users
+// who signed in with a password or a cookie
+func Test_privatePages(t *testing.T) {
+	defer privatePageDir(t)()
+
+	serv := mux.NewRouter()
+	serv.Path(confVars.viewPath + "{pageReq:" + pageNamePattern + "}").HandlerFunc(pageHandler)
+	serv.Path("/login").HandlerFunc(loginHandler)
+	serv.Path("/logout").HandlerFunc(logoutHandler)
+	serv.Use(privateMiddleware)
+	hop := ipMiddleware(authMiddleware(serv))
+
+	get := func(path string, prep func(r *http.Request)) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil)
+		if prep != nil {
+			prep(r)
+		}
+		hop.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := get(confVars.viewPath+"secret", nil); bytes.Contains(w.Body.Bytes(), []byte("Secret Page")) {
+		t.Errorf("anonymous visitor saw the private page\n")
+	}
+	if w := get(confVars.viewPath+"secret", func(r *http.Request) { r.SetBasicAuth("alice", "hunter2") }); !bytes.Contains(w.Body.Bytes(), []byte("Secret Page")) {
+		t.Errorf("basic auth user couldn't see the private page: %v\n", w.Code)
+	}
+	if w := get(confVars.viewPath+"open", func(r *http.Request) { r.SetBasicAuth("alice", "wrong") }); w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("wrong basic auth password got %v\n", w.Code)
+	}
+
+	// sign in with the form, then use the cookie
+	nonce, token := formToken(t, get("/login", nil))
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/login", strings.NewReader("user=alice&password=hunter2&next=/w/secret&csrf="+token))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(nonce)
+	hop.ServeHTTP(w, r)
+	cookies := w.Result().Cookies()
+	if w.Code != http.StatusSeeOther || len(cookies) != 1 || w.Header().Get("Location") != "/w/secret" {
+		t.Fatalf("loginHandler(): got %v, %v\n", w.Code, w.Header())
+	}
+	if w := get(confVars.viewPath+"secret", func(r *http.Request) { r.AddCookie(cookies[0]) }); !bytes.Contains(w.Body.Bytes(), []byte("Secret Page")) {
+		t.Errorf("signed-in user couldn't see the private page\n")
+	}
+
+	// signing out takes a posted form, so another
+	// site can't sign people out with a link
+	signedIn := func(r *http.Request) { r.AddCookie(cookies[0]) }
+	cleared := func(w *httptest.ResponseRecorder) bool {
+		for _, cookie := range w.Result().Cookies() {
+			if cookie.Name == sessionCookie && cookie.MaxAge < 0 {
+				return true
+			}
+		}
+		return false
+	}
+	form := get("/logout?next=/w/open", signedIn)
+	if cleared(form) {
+		t.Errorf("logoutHandler(): GET signed out\n")
+	}
+	m := csrfInput.FindSubmatch(form.Body.Bytes())
+	if m == nil {
+		t.Fatalf("logoutHandler(): no form token in:\n%s\n", form.Body.String())
+	}
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/logout", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		signedIn(r)
+		hop.ServeHTTP(w, r)
+		return w
+	}
+	if w := post("next=/w/open"); w.Code != http.StatusForbidden || cleared(w) {
+		t.Errorf("logoutHandler(): POST without a token got %v\n", w.Code)
+	}
+	if w := post("next=/w/open&csrf=" + string(m[1])); w.Code != http.StatusSeeOther || !cleared(w) || w.Header().Get("Location") != "/w/open" {
+		t.Errorf("logoutHandler(): got %v, %v\n", w.Code, w.Header())
+	}
+
+	public := bytes.NewBuffer(nil)
+	tallyPages(public, false)
+	members := bytes.NewBuffer(nil)
+	tallyPages(members, true)
+	if bytes.Contains(public.Bytes(), []byte("Secret Page")) || !bytes.Contains(members.Bytes(), []byte("Secret Page")) {
+		t.Errorf("tallyPages(): private page listed wrongly:\n%s\n---\n%s\n", public, members)
+	}
+
+	// the public page's backlinks don't give the private one away
+	open, err := freshPage("open.md")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if bytes.Contains(open.Body, []byte("Secret Page")) {
+		t.Errorf("backlinks section lists the private page\n")
+	}
+	for _, page := range recentPages(0) {
+		if page.Private {
+			t.Errorf("recentPages(): listed the private page\n")
+		}
+	}
+}
+
+// Without an AuthFile, the sign-in routes do nothing
+func Test_authDisabled(t *testing.T) {
+	initConfigParams()
+	log.SetOutput(hush)
+	confVars.mu.Lock()
+	confVars.authFile = ""
+	confVars.mu.Unlock()
+
+	for _, tt := range []struct {
+		method, path string
+		hop          http.HandlerFunc
+	}{
+		{"GET", "/login", loginHandler},
+		{"GET", "/logout", logoutHandler},
+		{"POST", "/logout", logoutHandler},
+	} {
+		w := httptest.NewRecorder()
+		tt.hop(w, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != http.StatusNotFound || len(w.Result().Cookies()) != 0 {
+			t.Errorf("%v %v: got %v with cookies %v\n", tt.method, tt.path, w.Code, w.Result().Cookies())
+		}
+	}
+}
+
+// Links to private pages look the same as links to
+// pages that don't exist
+func Test_wikiLinks_private(t *testing.T) {
+	defer privatePageDir(t)()
+
+	out := string(wikiLinks([]byte("[[open]] [[secret]] [[nowhere]]")))
+	for _, want := range []string{
+		`href="/w/open" class="wikilink">`,
+		`href="/w/secret" class="wikilink new">`,
+		`href="/w/nowhere" class="wikilink new">`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("wikiLinks(): missing %q in %s\n", want, out)
+		}
+	}
+}
+
+// Pages linking to each other, or to themselves,
+// mustn't build each other while checking privacy
+func Test_wikiLinks_cycle(t *testing.T) {
+	defer privatePageDir(t)()
+
+	confVars.mu.RLock()
+	pageDir := confVars.pageDir
+	confVars.mu.RUnlock()
+	files := map[string]string{
+		"ping.md": "<!--\ntitle: Ping\n-->\n# Ping\n\nSee [[pong]] and [[ping]].\n",
+		"pong.md": "<!--\ntitle: Pong\n-->\n# Pong\n\nSee [[ping]] and [[secret]].\n",
+	}
+	for name, body := range files {
+		if err := ioutil.WriteFile(pageDir+"/"+name, []byte(body), 0644); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+	}
+	defer evictPages("ping.md")
+	defer evictPages("pong.md")
+
+	done := make(chan struct{})
+	go func() {
+		genPageCache()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("genPageCache(): hung on pages linking to each other\n")
+	}
+
+	page, err := freshPage("pong.md")
+	if err != nil {
+		t.Fatalf("freshPage(): %v\n", err)
+	}
+	for _, want := range []string{
+		`href="/w/ping" class="wikilink">`,
+		`href="/w/secret" class="wikilink new">`,
+	} {
+		if !strings.Contains(string(page.Body), want) {
+			t.Errorf("freshPage(): missing %q\n", want)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// A rendered page's place in the LRU list
+type lruEntry struct {
+	name string
+	size int64
+}
+
+// Counters and sizes served at /api/cache
+type cacheStats struct {
+	Mode      string `json:"mode"`
+	Pages     int    `json:"pages"`
+	Rendered  int    `json:"rendered"`
+	Bytes     int64  `json:"bytes"`
+	MaxPages  int    `json:"max_pages"`
+	MaxBytes  int64  `json:"max_bytes"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+}
+
+// Returns the cache limits from the config. Either
+// being set switches to the lazily loaded cache.
+func cacheLimits() (int, int64) {
+	confVars.mu.RLock()
+	defer confVars.mu.RUnlock()
+	return confVars.cacheMaxPages, confVars.cacheMaxBytes
+}
+
+// Returns true if pages are only rendered on
+// their first request
+func lazyCache() bool {
+	maxPages, maxBytes := cacheLimits()
+	return maxPages > 0 || maxBytes > 0
+}
+
+// Memory taken up by a page's contents
+func (page *Page) size() int64 {
+	return int64(len(page.Raw) + len(page.Body) + len(page.Content) + len(page.Gemtext))
+}
+
+// Returns a copy of the page holding only what the
+// index, tags, backlinks and feeds need. The page
+// is rendered again on its next request.
+func (page *Page) stub() *Page {
+	stub := newPage(page.Longname, page.Shortname, page.Title, page.Author, page.Desc, page.Modtime, nil, nil, true)
+	stub.ETag = page.ETag
+	stub.LastMod = page.LastMod
+	stub.Tags = page.Tags
+	stub.Private = page.Private
+	stub.Draft = page.Draft
+	stub.Backlinks = page.Backlinks
+	stub.Revision = page.Revision
+	stub.RevAuthor = page.RevAuthor
+	stub.RevTime = page.RevTime
+	return stub
+}
+
+// Caches the page's metadata, words and links
+// without rendering it. Used instead of cache()
+// when the cache is lazily loaded.
+func (page *Page) cacheStub() error {
+	loaded, err := loadPage(page.Longname)
+	if err != nil {
+		return err
+	}
+	recordPage(loaded)
+	pageCache.store(loaded.stub())
+	return nil
+}
+
+// Caches a page, only rendering it right away
+// if the cache isn't lazily loaded
+func (page *Page) load() error {
+	if lazyCache() {
+		return page.cacheStub()
+	}
+	return page.cache()
+}
+
+// Puts a page into the pool. Rendered pages go to
+// the front of the LRU list, then the least recently
+// used are turned back into stubs until the cache
+// is within its limits again.
+func (pc *pagesCache) store(page *Page) {
+	maxPages, maxBytes := cacheLimits()
+
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	pc.pool[page.Shortname] = page
+	pc.forgetLocked(page.Shortname)
+	if page.Body == nil {
+		return
+	}
+
+	entry := &lruEntry{name: page.Shortname, size: page.size()}
+	pc.elems[entry.name] = pc.lru.PushFront(entry)
+	pc.used += entry.size
+
+	// the page just stored is never evicted,
+	// even if it's larger than the budget
+	for pc.lru.Len() > 1 && ((maxPages > 0 && pc.lru.Len() > maxPages) || (maxBytes > 0 && pc.used > maxBytes)) {
+		oldest := pc.lru.Back().Value.(*lruEntry)
+		pc.forgetLocked(oldest.name)
+		if old, ok := pc.pool[oldest.name]; ok {
+			pc.pool[oldest.name] = old.stub()
+		}
+		pc.evictions++
+	}
+}
+
+// Drops a page from the LRU list. Called with pc.mu held.
+func (pc *pagesCache) forgetLocked(name string) {
+	if el, ok := pc.elems[name]; ok {
+		pc.used -= el.Value.(*lruEntry).size
+		pc.lru.Remove(el)
+		delete(pc.elems, name)
+	}
+}
+
+// Records a page served without re-rendering it,
+// both here and in the metrics
+func (pc *pagesCache) hit(name string) {
+	metrics.cacheCheck("page", "hit")
+	pc.mu.Lock()
+	pc.hits++
+	if el, ok := pc.elems[name]; ok {
+		pc.lru.MoveToFront(el)
+	}
+	pc.mu.Unlock()
+}
+
+// Records a page that had to be rendered to
+// serve it, both here and in the metrics
+func (pc *pagesCache) miss() {
+	metrics.cacheCheck("page", "recache")
+	pc.mu.Lock()
+	pc.misses++
+	pc.mu.Unlock()
+}
+
+// Returns the cache's counters and sizes
+func (pc *pagesCache) stats() cacheStats {
+	maxPages, maxBytes := cacheLimits()
+	mode := "full"
+	if maxPages > 0 || maxBytes > 0 {
+		mode = "lru"
+	}
+
+	pc.mu.RLock()
+	defer pc.mu.RUnlock()
+	return cacheStats{
+		Mode:      mode,
+		Pages:     len(pc.pool),
+		Rendered:  pc.lru.Len(),
+		Bytes:     pc.used,
+		MaxPages:  maxPages,
+		MaxBytes:  maxBytes,
+		Hits:      pc.hits,
+		Misses:    pc.misses,
+		Evictions: pc.evictions,
+	}
+}
+
+// Serves the page cache's counters as JSON
+func cacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	out, err := json.Marshal(pageCache.stats())
+	if err != nil {
+		log500(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", jsonutf8)
+	w.Header().Set("Cache-Control", "no-store")
+	if _, err := w.Write(append(out, '\n')); err != nil {
+		log500(w, r, err)
+		return
+	}
+}
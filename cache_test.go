@@ -0,0 +1,90 @@
+package main
+
+import (
+	"log"
+	"testing"
+)
+
+// Sets the cache limits, returning a func
+// that restores the old ones
+func setCacheLimits(maxPages int, maxBytes int64) func() {
+	confVars.mu.Lock()
+	oldPages, oldBytes := confVars.cacheMaxPages, confVars.cacheMaxBytes
+	confVars.cacheMaxPages, confVars.cacheMaxBytes = maxPages, maxBytes
+	confVars.mu.Unlock()
+	return func() {
+		confVars.mu.Lock()
+		confVars.cacheMaxPages, confVars.cacheMaxBytes = oldPages, oldBytes
+		confVars.mu.Unlock()
+		genPageCache()
+	}
+}
+
+// Make sure the least recently used page is turned
+// into a stub, and rendered again when requested
+func Test_pagesCache_store(t *testing.T) {
+	initConfigParams()
+	log.SetOutput(hush)
+	restore := setCacheLimits(1, 0)
+	defer restore()
+
+	// lazily loaded, so nothing is rendered yet
+	genPageCache()
+	if page, err := pullFromCache("example.md"); err != nil || page.Body != nil || page.Title == "" {
+		t.Fatalf("genPageCache(): expected a stub with metadata for example.md, got %+v, %v\n", page, err)
+	}
+
+	before := pageCache.stats()
+	page, err := freshPage("example.md")
+	if err != nil || page.Body == nil {
+		t.Fatalf("freshPage(): example.md wasn't rendered: %v\n", err)
+	}
+	if _, err := freshPage("example.md"); err != nil {
+		t.Fatalf("freshPage(): %v\n", err)
+	}
+	if _, err := freshPage("test2.md"); err != nil {
+		t.Fatalf("freshPage(): %v\n", err)
+	}
+
+	if page, _ := pullFromCache("example.md"); page.Body != nil || !page.needsRecache() {
+		t.Errorf("store(): example.md wasn't evicted\n")
+	}
+	if page, _ := pullFromCache("test2.md"); page.Body == nil {
+		t.Errorf("store(): test2.md was evicted\n")
+	}
+
+	after := pageCache.stats()
+	if after.Mode != "lru" || after.Rendered != 1 {
+		t.Errorf("stats(): got mode %v with %v rendered pages\n", after.Mode, after.Rendered)
+	}
+	if got := after.Misses - before.Misses; got != 2 {
+		t.Errorf("stats(): got %v misses, want 2\n", got)
+	}
+	if got := after.Hits - before.Hits; got != 1 {
+		t.Errorf("stats(): got %v hits, want 1\n", got)
+	}
+	if got := after.Evictions - before.Evictions; got != 1 {
+		t.Errorf("stats(): got %v evictions, want 1\n", got)
+	}
+}
+
+// Make sure the byte budget is respected
+func Test_pagesCache_store_bytes(t *testing.T) {
+	initConfigParams()
+	log.SetOutput(hush)
+	restore := setCacheLimits(0, 1)
+	defer restore()
+
+	genPageCache()
+	for _, name := range []string{"example.md", "test1.md", "test2.md"} {
+		if _, err := freshPage(name); err != nil {
+			t.Fatalf("freshPage(): %v\n", err)
+		}
+	}
+
+	// the page just rendered is kept, even
+	// though it's over the budget on its own
+	if stats := pageCache.stats(); stats.Rendered != 1 {
+		t.Errorf("store(): %v pages rendered, want 1\n", stats.Rendered)
+	}
+}
@@ -3,7 +3,10 @@ package main
 import (
 	"log"
 	"regexp"
+	"strings"
+	"sync"
 
+	"github.com/alecthomas/chroma/styles"
 	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/viper"
 )
@@ -15,8 +18,15 @@ const cssutf8 = "text/css; charset=utf-8"
 // Config object initialization
 var confVars = &confParams{}
 
+// Serializes reloads of the config, whether from a
+// change to the file or a SIGHUP
+var reloadMu sync.Mutex
+
 // (Re-)Populates config object
 func setConfVars() {
+	confVars.mu.Lock()
+	defer confVars.mu.Unlock()
+
 	confVars.port = ":" + viper.GetString("Port")
 	confVars.pageDir = viper.GetString("PageDir")
 	confVars.assetsDir = viper.GetString("AssetsDir")
@@ -29,15 +39,80 @@ func setConfVars() {
 	confVars.titleSep = viper.GetString("TitleSeparator")
 	confVars.iconPath = viper.GetString("Icon")
 	confVars.indexFile = viper.GetString("Index")
+	confVars.layoutFile = viper.GetString("Layout")
 	confVars.reverseTally = viper.GetBool("ReverseTally")
+	confVars.groupIndex = viper.GetBool("GroupIndex")
+	confVars.tableOfContents = viper.GetBool("TableOfContents")
+	confVars.syntaxHighlight = viper.GetBool("SyntaxHighlight")
+	confVars.highlightStyle = viper.GetString("HighlightStyle")
+	confVars.userPages = viper.GetBool("UserPages")
+	confVars.userDir = viper.GetString("UserDir")
+	confVars.userWikiDir = viper.GetString("UserWikiDir")
+	confVars.cacheMaxPages = viper.GetInt("CacheMaxPages")
+	confVars.cacheMaxBytes = int64(viper.GetSizeInBytes("CacheMaxBytes"))
+	confVars.cacheControl = viper.GetString("CacheControl")
+	confVars.allowEdit = viper.GetBool("AllowEdit")
+	confVars.gitHistory = viper.GetBool("GitHistory")
+	confVars.baseURL = strings.TrimSuffix(viper.GetString("BaseURL"), "/")
+	confVars.feedItems = viper.GetInt("FeedItems")
+	confVars.gopherPort = viper.GetString("GopherPort")
+	if confVars.gopherPort != "" {
+		confVars.gopherPort = ":" + confVars.gopherPort
+	}
+	confVars.gopherHost = viper.GetString("GopherHost")
+	confVars.geminiPort = viper.GetString("GeminiPort")
+	if confVars.geminiPort != "" {
+		confVars.geminiPort = ":" + confVars.geminiPort
+	}
+	confVars.geminiCert = viper.GetString("GeminiCert")
+	confVars.geminiKey = viper.GetString("GeminiKey")
+	confVars.tlsCert = viper.GetString("TLSCert")
+	confVars.tlsKey = viper.GetString("TLSKey")
+	confVars.metricsPort = viper.GetString("MetricsPort")
+	if confVars.metricsPort != "" {
+		confVars.metricsPort = ":" + confVars.metricsPort
+	}
+	confVars.tlsRedirectPort = viper.GetString("TLSRedirectPort")
+	if confVars.tlsRedirectPort != "" {
+		confVars.tlsRedirectPort = ":" + confVars.tlsRedirectPort
+	}
+	confVars.authFile = viper.GetString("AuthFile")
+	confVars.sessionSecret = viper.GetString("SessionSecret")
+	confVars.sessionLifetime = viper.GetDuration("SessionLifetime")
 	confVars.validPath = regexp.MustCompile(viper.GetString("ValidPath"))
 	confVars.quietLogging = viper.GetBool("QuietLogging")
 	confVars.fileLogging = viper.GetBool("FileLogging")
 	confVars.logFile = viper.GetString("LogFile")
+	confVars.accessLogFile = viper.GetString("AccessLog")
+	confVars.accessLogFormat = strings.ToLower(viper.GetString("AccessLogFormat"))
+	confVars.logRotateSize = int64(viper.GetSizeInBytes("LogRotateSize"))
+	confVars.logRotateAge = viper.GetDuration("LogRotateAge")
+	confVars.logRotateKeep = viper.GetInt("LogRotateKeep")
+
+	if confVars.allowEdit && confVars.authFile == "" {
+		log.Printf("**NOTICE** AllowEdit needs AuthFile, so only signed-in users can edit. Editing is off.\n")
+	}
+	if !knownHighlightStyle(confVars.highlightStyle) {
+		log.Printf("**NOTICE** Unknown highlight style %v, using %v\n", confVars.highlightStyle, styles.Fallback.Name)
+	}
 }
 
 // Sets the basic parameters for the default viper (config library) instance
+// and watches the config file for changes
 func initConfigParams() {
+	readConfig()
+
+	conf := viper.GetViper()
+	conf.WatchConfig()
+	conf.OnConfigChange(func(e fsnotify.Event) {
+		log.Println("**NOTICE** Config file change detected: ", e.Name)
+		reloadConf()
+	})
+}
+
+// Reads the config file once, without watching it.
+// Used on its own by subcommands such as export.
+func readConfig() {
 	conf := viper.GetViper()
 
 	conf.SetConfigType("yaml")
@@ -55,12 +130,28 @@ func initConfigParams() {
 	}
 
 	setConfVars()
+	loadLayout()
+}
 
-	conf.WatchConfig()
-	conf.OnConfigChange(func(e fsnotify.Event) {
-		log.Println("**NOTICE** Config file change detected: ", e.Name)
-		setConfVars()
-		triggerRecache()
-	})
+// Applies a changed config file. A running file
+// watcher is moved along with PageDir and AssetsDir.
+func reloadConf() {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	confVars.mu.RLock()
+	pageDir, assetsDir := confVars.pageDir, confVars.assetsDir
+	confVars.mu.RUnlock()
 
+	setConfVars()
+	initHistory()
+	reloadLayout()
+
+	confVars.mu.RLock()
+	moved := pageDir != confVars.pageDir || assetsDir != confVars.assetsDir
+	confVars.mu.RUnlock()
+	if moved && watchingFiles() {
+		stopWatchingFiles()
+		watchFiles()
+	}
 }
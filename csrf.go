@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+// Name of the cookie tying forms to a browser
+// that isn't signed in
+const csrfCookie = "tildewiki_csrf"
+
+// Name of the hidden form field holding the token
+const csrfField = "csrf"
+
+// Returns what a request's forms are tied to: the
+// basic auth user, the session cookie, or a random
+// cookie for anonymous visitors. With w set, the
+// random cookie is made if the browser has none.
+func csrfSeed(w http.ResponseWriter, r *http.Request) string {
+	if user := requestUser(r); user != "" {
+		if name, _, ok := r.BasicAuth(); ok && name == user {
+			return "basic|" + user
+		}
+		if cookie, err := r.Cookie(sessionCookie); err == nil {
+			return "session|" + cookie.Value
+		}
+	}
+	if cookie, err := r.Cookie(csrfCookie); err == nil && cookie.Value != "" {
+		return "nonce|" + cookie.Value
+	}
+	if w == nil {
+		return ""
+	}
+
+	nonce := make([]byte, 18)
+	if _, err := rand.Read(nonce); err != nil {
+		log.Printf("Couldn't generate a form token: %v\n", err.Error())
+		return ""
+	}
+	value := base64.RawURLEncoding.EncodeToString(nonce)
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    value,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return "nonce|" + value
+}
+
+// Returns the token to put in a form. Call before
+// writing the response, as it may set a cookie.
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	seed := csrfSeed(w, r)
+	if seed == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, users.sessionKey())
+	mac.Write([]byte("csrf|" + seed))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Returns true if a form submission came from one
+// of this wiki's own forms: it must carry a token
+// for the same browser, and its Origin or Referer
+// must be this wiki when sent
+func checkCSRF(r *http.Request) bool {
+	if !sameOrigin(r) {
+		log.Printf("**NOTICE** Rejected cross-site %v %v from %v\n", r.Method, r.URL.Path, getIPfromCtx(r.Context()))
+		return false
+	}
+	want := csrfToken(nil, r)
+	got := r.PostFormValue(csrfField)
+	if want == "" || !hmac.Equal([]byte(got), []byte(want)) {
+		log.Printf("**NOTICE** Rejected %v %v with a bad form token from %v\n", r.Method, r.URL.Path, getIPfromCtx(r.Context()))
+		return false
+	}
+	return true
+}
+
+// Checks the Origin header, or the Referer without
+// one, against the host the request was sent to
+// and BaseURL. Requests with neither are allowed,
+// as some browsers and proxies strip both.
+func sameOrigin(r *http.Request) bool {
+	source := r.Header.Get("Origin")
+	if source == "" {
+		source = r.Header.Get("Referer")
+	}
+	if source == "" {
+		return true
+	}
+	u, err := url.Parse(source)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if u.Host == r.Host {
+		return true
+	}
+
+	confVars.mu.RLock()
+	baseURL := confVars.baseURL
+	confVars.mu.RUnlock()
+	if base, err := url.Parse(baseURL); err == nil && base.Host != "" && base.Host == u.Host {
+		return true
+	}
+	return false
+}
+
+// Responds to a form submission that failed checkCSRF
+func csrfRejected(w http.ResponseWriter) {
+	http.Error(w, "Form expired or sent from another site. Go back, reload the page and try again.", http.StatusForbidden)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+var csrfInput = regexp.MustCompile(`name="csrf" value="([^"]+)"`)
+
+// Pulls the form token and the cookie it's tied to
+// from a response showing a form
+func formToken(t *testing.T, w *httptest.ResponseRecorder) (*http.Cookie, string) {
+	m := csrfInput.FindSubmatch(w.Body.Bytes())
+	if m == nil {
+		t.Fatalf("no form token in:\n%s\n", w.Body.String())
+	}
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == csrfCookie {
+			return cookie, string(m[1])
+		}
+	}
+	t.Fatalf("no form token cookie\n")
+	return nil, ""
+}
+
+func Test_checkCSRF(t *testing.T) {
+	initConfigParams()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "http://wiki.test/login", nil)
+	token := csrfToken(w, r)
+	cookie := w.Result().Cookies()[0]
+
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+		token  string
+		origin string
+		want   bool
+	}{
+		{"good", cookie, token, "", true},
+		{"same origin", cookie, token, "http://wiki.test", true},
+		{"other origin", cookie, token, "https://evil.example", false},
+		{"null origin", cookie, token, "null", false},
+		{"no token", cookie, "", "", false},
+		{"no cookie", nil, token, "", false},
+		{"other browser", &http.Cookie{Name: csrfCookie, Value: "someone-else"}, token, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "http://wiki.test/login", nil)
+			r.PostForm = map[string][]string{csrfField: {tt.token}}
+			if tt.cookie != nil {
+				r.AddCookie(tt.cookie)
+			}
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if got := checkCSRF(r); got != tt.want {
+				t.Errorf("checkCSRF() = %v, want %v\n", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Returns true if the name refers to a
+// subdirectory of the page directory
+func isPageDir(name string) bool {
+	confVars.mu.RLock()
+	pageDir := confVars.pageDir
+	confVars.mu.RUnlock()
+
+	stat, err := os.Stat(pageDir + "/" + name)
+	return err == nil && stat.IsDir()
+}
+
+// Lists the pages and subdirectories inside a
+// directory of the page directory, returning
+// their names relative to the page directory.
+// Subdirectories are only listed if they hold
+// at least one page. Private pages are only
+// listed for members, and drafts aren't listed.
+func dirContents(dir string, members bool) ([]string, []string, error) {
+	confVars.mu.RLock()
+	pageDir := confVars.pageDir
+	reversed := confVars.reverseTally
+	confVars.mu.RUnlock()
+
+	names, err := walkPages(pageDir + "/" + dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pages := make([]string, 0)
+	subdirs := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if (!members && isPrivate(dir+"/"+name)) || isDraft(dir+"/"+name) {
+			continue
+		}
+		if i := strings.IndexByte(name, '/'); i >= 0 {
+			sub := name[:i]
+			if !seen[sub] {
+				seen[sub] = true
+				subdirs = append(subdirs, dir+"/"+sub)
+			}
+			continue
+		}
+		pages = append(pages, dir+"/"+name)
+	}
+
+	if reversed {
+		for i, j := 0, len(pages)-1; i < j; i, j = i+1, j-1 {
+			pages[i], pages[j] = pages[j], pages[i]
+		}
+	}
+	return pages, subdirs, nil
+}
+
+// Generates the markdown listing for a directory,
+// with a trail of links back up to the index
+func dirListing(dir string, members bool) ([]byte, error) {
+	pages, subdirs, err := dirContents(dir, members)
+	if err != nil {
+		return nil, err
+	}
+
+	confVars.mu.RLock()
+	viewPath := confVars.viewPath
+	confVars.mu.RUnlock()
+
+	buf := bytes.NewBuffer(nil)
+
+	// link each parent directory, ending
+	// with the one being listed
+	parts := strings.Split(dir, "/")
+	crumbs := []string{"[Home](/)"}
+	for i := range parts[:len(parts)-1] {
+		crumbs = append(crumbs, "["+parts[i]+"]("+viewPath+strings.Join(parts[:i+1], "/")+")")
+	}
+	buf.WriteString(strings.Join(crumbs, " / ") + "\n\n")
+	buf.WriteString("# " + parts[len(parts)-1] + "\n\n")
+
+	if len(subdirs) > 0 {
+		for _, sub := range subdirs {
+			buf.WriteString("* [" + sub[len(dir)+1:] + "/](" + viewPath + sub + ")\n")
+		}
+		buf.WriteString("\n")
+	}
+	if len(pages) == 0 && len(subdirs) == 0 {
+		buf.WriteString("*No pages in this directory.*\n")
+	}
+	for _, name := range pages {
+		if page := loadIndexPage(name); page != nil {
+			buf.WriteString(indexLink(page, viewPath))
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Serves the listing for a directory of pages.
+// Called by pageHandler() when a request names
+// a directory rather than a page.
+func dirHandler(w http.ResponseWriter, r *http.Request, dir string) {
+	listing, err := dirListing(dir, requestUser(r) != "")
+	if err != nil {
+		log500(w, r, err)
+		return
+	}
+
+	confVars.mu.RLock()
+	title := dir + "/ " + confVars.titleSep + " " + confVars.wikiName
+	confVars.mu.RUnlock()
+
+	w.Header().Set("Content-Type", htmlutf8)
+	if _, err := w.Write(render(listing, title)); err != nil {
+		log500(w, r, err)
+		return
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// Builds a page directory with nested pages and
+// points the config at it. The returned func
+// restores the config and removes the directory.
+func nestedPageDir(t *testing.T) func() {
+	initConfigParams()
+	log.SetOutput(hush)
+
+	dir, err := ioutil.TempDir("", "tildewiki-pages")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	files := map[string]string{
+		"top.md":               "<!--\ntitle: Top\n-->\n# Top\n",
+		"howto/ssh.md":         "<!--\ntitle: SSH\n-->\n# SSH\n",
+		"howto/tmux.md":        "<!--\ntitle: tmux\n-->\n# tmux\n",
+		"howto/deep/nested.md": "<!--\ntitle: Nested\n-->\n# Nested\n",
+		".git/HEAD":            "ref: refs/heads/master\n",
+		"howto/.hidden.md":     "hidden\n",
+	}
+	for name, body := range files {
+		if err := os.MkdirAll(dir+"/"+pageDirOf(name), 0755); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		if err := ioutil.WriteFile(dir+"/"+name, []byte(body), 0644); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+	}
+
+	confVars.mu.Lock()
+	oldDir := confVars.pageDir
+	confVars.pageDir = dir
+	confVars.mu.Unlock()
+
+	return func() {
+		confVars.mu.Lock()
+		confVars.pageDir = oldDir
+		confVars.mu.Unlock()
+		pageCache.mu.Lock()
+		for name := range files {
+			delete(pageCache.pool, name)
+		}
+		pageCache.mu.Unlock()
+		os.RemoveAll(dir)
+	}
+}
+
+// Make sure nested pages are found and
+// hidden files and directories skipped
+func Test_walkPages(t *testing.T) {
+	cleanup := nestedPageDir(t)
+	defer cleanup()
+
+	confVars.mu.RLock()
+	pageDir := confVars.pageDir
+	confVars.mu.RUnlock()
+
+	got, err := walkPages(pageDir)
+	if err != nil {
+		t.Fatalf("walkPages(): %v\n", err)
+	}
+	want := []string{"howto/deep/nested.md", "howto/ssh.md", "howto/tmux.md", "top.md"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("walkPages(): got %v, want %v\n", got, want)
+	}
+}
+
+// An unreadable subdirectory shouldn't hide
+// the rest of the wiki
+func Test_walkPages_unreadable(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("permissions aren't enforced for root")
+	}
+	cleanup := nestedPageDir(t)
+	defer cleanup()
+
+	confVars.mu.RLock()
+	pageDir := confVars.pageDir
+	confVars.mu.RUnlock()
+
+	if err := os.Chmod(pageDir+"/howto/deep", 0); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer os.Chmod(pageDir+"/howto/deep", 0755)
+
+	got, err := walkPages(pageDir)
+	if err != nil {
+		t.Fatalf("walkPages(): %v\n", err)
+	}
+	want := []string{"howto/ssh.md", "howto/tmux.md", "top.md"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("walkPages(): got %v, want %v\n", got, want)
+	}
+}
+
+func Test_pageName(t *testing.T) {
+	cases := []struct {
+		pageDir  string
+		longname string
+		want     string
+	}{
+		{"pages", "pages/example.md", "example.md"},
+		{"pages", "pages/howto/ssh.md", "howto/ssh.md"},
+		{"./pages", "pages/howto/ssh.md", "howto/ssh.md"},
+		{"pages", "elsewhere/other.md", "other.md"},
+	}
+	for _, tt := range cases {
+		if got := pageName(tt.pageDir, tt.longname); got != tt.want {
+			t.Errorf("pageName(%q, %q): got %q, want %q\n", tt.pageDir, tt.longname, got, tt.want)
+		}
+	}
+}
+
+// Make sure a directory listing links its
+// pages, subdirectories and parents
+func Test_dirListing(t *testing.T) {
+	cleanup := nestedPageDir(t)
+	defer cleanup()
+
+	if !isPageDir("howto") || isPageDir("top") {
+		t.Errorf("isPageDir(): wrong answer for howto or top\n")
+	}
+
+	listing, err := dirListing("howto", false)
+	if err != nil {
+		t.Fatalf("dirListing(): %v\n", err)
+	}
+	for _, want := range []string{"[Home](/)", "# howto", "[deep/](/w/howto/deep)", "[SSH](/w/howto/ssh)", "[tmux](/w/howto/tmux)"} {
+		if !bytes.Contains(listing, []byte(want)) {
+			t.Errorf("dirListing(): missing %q in:\n%s\n", want, listing)
+		}
+	}
+	if bytes.Contains(listing, []byte("Nested")) || bytes.Contains(listing, []byte("hidden")) {
+		t.Errorf("dirListing(): listed pages outside the directory:\n%s\n", listing)
+	}
+
+	listing, err = dirListing("howto/deep", false)
+	if err != nil {
+		t.Fatalf("dirListing(): %v\n", err)
+	}
+	if !bytes.Contains(listing, []byte("[howto](/w/howto)")) || !bytes.Contains(listing, []byte("[Nested](/w/howto/deep/nested)")) {
+		t.Errorf("dirListing(): nested listing is wrong:\n%s\n", listing)
+	}
+}
+
+// Make sure the grouped index puts top-level
+// pages first, then a section per directory
+func Test_writeGroupedLinks(t *testing.T) {
+	cleanup := nestedPageDir(t)
+	defer cleanup()
+
+	files, err := indexFiles()
+	if err != nil {
+		t.Fatalf("indexFiles(): %v\n", err)
+	}
+	buf := bytes.NewBuffer(nil)
+	writeGroupedLinks(files, buf)
+	out := buf.String()
+
+	top := bytes.Index(buf.Bytes(), []byte("[Top]"))
+	howto := bytes.Index(buf.Bytes(), []byte("### [howto](/w/howto)"))
+	deep := bytes.Index(buf.Bytes(), []byte("### [howto/deep](/w/howto/deep)"))
+	if top < 0 || howto < 0 || deep < 0 || !(top < howto && howto < deep) {
+		t.Errorf("writeGroupedLinks(): unexpected grouping:\n%v\n", out)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/gorilla/mux"
+)
+
+// Upper limit on the size of a submitted page
+const maxEditBytes = 1 << 20
+
+// Skeleton used to pre-fill the form when
+// creating a page that doesn't exist yet
+const newPageSkel = "<!--\ntitle: \ndescription: \nauthor: \n-->\n\n"
+
+// The form shown by /edit/{pageReq}
+var editTmpl = template.Must(template.New("edit").Parse(`<h1>Editing {{.Name}}</h1>
+<form method="post" action="/edit/{{.Name}}">
+  <input type="hidden" name="csrf" value="{{.CSRF}}">
+  <textarea name="body" rows="30" style="width: 100%;">{{.Raw}}</textarea>
+  <p><input type="submit" value="Save"> <a href="{{.ViewPath}}{{.Name}}">Cancel</a></p>
+</form>
+`))
+
+// Data passed to the edit form template
+type editForm struct {
+	Name     string
+	Raw      string
+	ViewPath string
+	CSRF     string
+}
+
+// Returns true if pages can be edited from the
+// browser. Pages may contain HTML, so editing is
+// never open to anonymous visitors.
+func editEnabled() bool {
+	confVars.mu.RLock()
+	defer confVars.mu.RUnlock()
+	return confVars.allowEdit && confVars.authFile != ""
+}
+
+// Handler for the browser-based page editor.
+// GET displays the raw markdown in a form,
+// POST writes it back to the page directory.
+func editHandler(w http.ResponseWriter, r *http.Request) {
+	if !editEnabled() {
+		error404(w, r)
+		return
+	}
+	if !requireSignIn(w, r) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	name := vars["pageReq"]
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		showEditForm(w, r, name)
+	case http.MethodPost:
+		saveEdit(w, r, name)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// Writes the edit form for the requested page.
+// Pages that aren't in the cache get the
+// header skeleton instead of their contents.
+func showEditForm(w http.ResponseWriter, r *http.Request, name string) {
+	raw := newPageSkel
+	if page, err := freshPage(name + ".md"); err == nil && page.Raw != nil {
+		raw = string(page.Raw)
+	}
+
+	token := csrfToken(w, r)
+	confVars.mu.RLock()
+	form := editForm{
+		Name:     name,
+		Raw:      raw,
+		ViewPath: confVars.viewPath,
+		CSRF:     token,
+	}
+	title := "Editing " + name + " " + confVars.titleSep + " " + confVars.wikiName
+	confVars.mu.RUnlock()
+
+	buf := bytes.NewBuffer(nil)
+	if err := editTmpl.Execute(buf, form); err != nil {
+		log500(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", htmlutf8)
+	w.Header().Set("Cache-Control", "no-store")
+	if _, err := w.Write(applyLayout(newLayoutData(title, buf.Bytes()))); err != nil {
+		log500(w, r, err)
+		return
+	}
+}
+
+// Writes the submitted form back to disk, then
+// marks the page for re-caching and redirects
+// to the page itself.
+func saveEdit(w http.ResponseWriter, r *http.Request, name string) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxEditBytes)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !checkCSRF(r) {
+		csrfRejected(w)
+		return
+	}
+
+	// browsers submit textareas with CRLF line endings
+	body := bytes.Replace([]byte(r.PostFormValue("body")), []byte("\r\n"), []byte("\n"), -1)
+
+	confVars.mu.RLock()
+	pageDir := confVars.pageDir
+	viewPath := confVars.viewPath
+	confVars.mu.RUnlock()
+
+	filename := name + ".md"
+	longname := pageDir + "/" + filename
+	if err := savePage(longname, body, editAuthor(r), "Edit "+filename); err != nil {
+		log500(w, r, err)
+		return
+	}
+
+	invalidatePage(longname, filename)
+
+	log.Printf("**NOTICE** Page %v saved by %v\n", filename, getIPfromCtx(r.Context()))
+	http.Redirect(w, r, viewPath+name, http.StatusSeeOther)
+}
+
+// Atomically writes a page to disk by writing to
+// a temporary file in the same directory, then
+// renaming it over the original.
+func writePage(longname string, body []byte) error {
+	dir, _ := filepath.Split(longname)
+	if dir == "" {
+		dir = "."
+	}
+
+	// new pages may be in a directory that
+	// doesn't exist yet
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".tildewiki-edit-")
+	if err != nil {
+		return err
+	}
+	tmpname := tmp.Name()
+
+	// clean up the temporary file if anything
+	// goes wrong before the rename
+	fail := func(err error) error {
+		_ = tmp.Close()
+		_ = os.Remove(tmpname)
+		return err
+	}
+
+	if _, err := tmp.Write(body); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmpname)
+		return err
+	}
+
+	if err := os.Rename(tmpname, longname); err != nil {
+		_ = os.Remove(tmpname)
+		return err
+	}
+	return nil
+}
+
+// Flags a page in the cache so the next view
+// re-renders it. Pages that aren't cached yet
+// are added as bare pages, and every other page
+// is re-rendered so wiki links to the new page
+// are no longer marked as missing.
+func invalidatePage(longname, filename string) {
+	if page, err := pullFromCache(filename); err == nil {
+		page.setRecache()
+		return
+	}
+	triggerRecache()
+	pageCache.mu.Lock()
+	if _, ok := pageCache.pool[filename]; !ok {
+		page := newBarePage(longname, filename)
+		page.setRecache()
+		pageCache.pool[filename] = page
+	}
+	pageCache.mu.Unlock()
+}
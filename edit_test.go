@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Make sure the page is written to disk and
+// no temporary files are left behind
+func Test_writePage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tildewiki-test")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	body := []byte("# written\n\nby the test\n")
+	if err := writePage(dir+"/written.md", body); err != nil {
+		t.Errorf("writePage(): %v\n", err)
+	}
+
+	got, err := ioutil.ReadFile(dir + "/written.md")
+	if err != nil || !bytes.Equal(got, body) {
+		t.Errorf("writePage(): byte mismatch: %v\n", err)
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("writePage(): expected 1 file in dir, got %v\n", len(files))
+	}
+}
+
+// Saves a new page through the handler and checks
+// that it's been written and flagged for re-caching
+func Test_editHandler(t *testing.T) {
+	initConfigParams()
+	log.SetOutput(hush)
+
+	dir, err := ioutil.TempDir("", "tildewiki-test")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v\n", err)
+	}
+	defer os.RemoveAll(dir)
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if err := ioutil.WriteFile(dir+"/.htpasswd", []byte("alice:"+string(hash)+"\n"), 0644); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	confVars.mu.Lock()
+	confVars.allowEdit = true
+	oldPageDir := confVars.pageDir
+	confVars.pageDir = dir
+	confVars.mu.Unlock()
+	defer func() {
+		confVars.mu.Lock()
+		confVars.allowEdit = false
+		confVars.authFile = ""
+		confVars.pageDir = oldPageDir
+		confVars.mu.Unlock()
+		pageCache.mu.Lock()
+		delete(pageCache.pool, "edited.md")
+		pageCache.mu.Unlock()
+	}()
+
+	handler := authMiddleware(http.HandlerFunc(editHandler))
+	edit := func(method string, body io.Reader) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, "localhost:8080/edit/edited", body)
+		if body != nil {
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		r.SetBasicAuth("alice", "hunter2")
+		r = mux.SetURLVars(r, map[string]string{"pageReq": "edited"})
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("no AuthFile", func(t *testing.T) {
+		if w := edit("GET", nil); bytes.Contains(w.Body.Bytes(), []byte("<textarea")) {
+			t.Errorf("editHandler(): editing open without AuthFile\n")
+		}
+	})
+
+	confVars.mu.Lock()
+	confVars.authFile = dir + "/.htpasswd"
+	confVars.mu.Unlock()
+
+	var token string
+	t.Run("GET new page", func(t *testing.T) {
+		w := edit("GET", nil)
+		if w.Code != 200 || !bytes.Contains(w.Body.Bytes(), []byte("<textarea")) {
+			t.Errorf("editHandler(): GET returned %v\n", w.Code)
+		}
+		m := csrfInput.FindSubmatch(w.Body.Bytes())
+		if m == nil {
+			t.Fatalf("editHandler(): no form token in:\n%s\n", w.Body.String())
+		}
+		token = string(m[1])
+	})
+
+	t.Run("POST from another site", func(t *testing.T) {
+		form := url.Values{"body": {"# defaced\n"}}
+		w := edit("POST", strings.NewReader(form.Encode()))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("editHandler(): POST without a token returned %v\n", w.Code)
+		}
+		if _, err := os.Stat(dir + "/edited.md"); err == nil {
+			t.Errorf("editHandler(): page written without a token\n")
+		}
+	})
+
+	t.Run("POST new page", func(t *testing.T) {
+		form := url.Values{"body": {"# edited\r\n\r\nfrom the browser\r\n"}, "csrf": {token}}
+		w := edit("POST", strings.NewReader(form.Encode()))
+		if w.Code != 303 {
+			t.Errorf("editHandler(): POST returned %v\n", w.Code)
+		}
+
+		got, err := ioutil.ReadFile(dir + "/edited.md")
+		if err != nil || !bytes.Equal(got, []byte("# edited\n\nfrom the browser\n")) {
+			t.Errorf("editHandler(): page not written correctly: %v\n", err)
+		}
+
+		page, err := pullFromCache("edited.md")
+		if err != nil || !page.checkCache() {
+			t.Errorf("editHandler(): page not flagged for re-caching\n")
+		}
+	})
+}
+
+// Saving a new page flags every cached page while
+// requests may be checking them; run with -race
+func Test_invalidatePage(t *testing.T) {
+	initConfigParams()
+	log.SetOutput(hush)
+	genPageCache()
+	page, err := pullFromCache("example.md")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		invalidatePage("pages/brand-new.md", "brand-new.md")
+		close(done)
+	}()
+	page.checkCache()
+	<-done
+	defer evictPages("brand-new.md")
+
+	if !page.needsRecache() {
+		t.Errorf("invalidatePage(): cached pages weren't flagged\n")
+	}
+	if added, err := pullFromCache("brand-new.md"); err != nil || !added.needsRecache() {
+		t.Errorf("invalidatePage(): new page wasn't added flagged: %v\n", err)
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Lists the pages the last export wrote, so the
+// next one knows what it may remove
+const exportManifest = ".tildewiki-export.json"
+
+// Root-relative links in the rendered HTML. These
+// are the ones that need the server to work.
+// Protocol-relative links, starting with //, point
+// at other hosts and are left alone.
+var exportLinkPattern = regexp.MustCompile(`(href|src)="(/[^/"][^"]*|/)"`)
+
+// Tally of an export run
+type exportStats struct {
+	written   int
+	unchanged int
+	removed   int
+}
+
+// Writes the wiki out as static files
+type exporter struct {
+	dir      string
+	viewPath string
+	baseURL  string
+	// page names without .md, for telling page
+	// links apart from directory listings
+	pages map[string]bool
+	// routes served from files written alongside
+	// the pages, such as /css and /icon
+	assets map[string]string
+	stats  exportStats
+}
+
+// Runs `tildewiki export [-full] <dir>`. Returns
+// the exit status.
+func exportCmd(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	full := flags.Bool("full", false, "rewrite every page, rather than only the changed ones")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: tildewiki export [-full] <dir>\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	readConfig()
+	genPageCache()
+
+	stats, err := exportSite(flags.Arg(0), *full)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Export failed: %v\n", err.Error())
+		return 1
+	}
+	fmt.Printf("Exported to %v: %v written, %v unchanged, %v removed\n", flags.Arg(0), stats.written, stats.unchanged, stats.removed)
+	return 0
+}
+
+// Writes the index, every public page, the
+// stylesheets and the icon to dir. Pages whose
+// exported HTML is the same as last time are
+// skipped unless full is set, and pages that were
+// exported last time but not this time are removed.
+func exportSite(dir string, full bool) (exportStats, error) {
+	confVars.mu.RLock()
+	ex := &exporter{
+		dir:      dir,
+		viewPath: confVars.viewPath,
+		baseURL:  confVars.baseURL,
+		pages:    make(map[string]bool),
+		assets:   make(map[string]string),
+	}
+	cssPath := confVars.cssPath
+	iconPath := confVars.assetsDir + "/" + confVars.iconPath
+	title := confVars.wikiName + " " + confVars.titleSep + " " + confVars.wikiDesc
+	confVars.mu.RUnlock()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return ex.stats, err
+	}
+	previous := ex.readManifest()
+
+	// assets first, so links to them are rewritten
+	if cssLocal([]byte(cssPath)) {
+		if err := ex.copyAsset("/css", cssPath, "wiki.css"); err != nil {
+			return ex.stats, err
+		}
+	}
+	if err := ex.copyAsset("/icon", iconPath, filepath.Base(iconPath)); err != nil {
+		return ex.stats, err
+	}
+	if highlightEnabled() {
+		css, err := highlightCSS()
+		if err != nil {
+			return ex.stats, err
+		}
+		if err := ex.writeFile("highlight.css", css, time.Time{}); err != nil {
+			return ex.stats, err
+		}
+		ex.assets[highlightCSSPath] = "highlight.css"
+	}
+
+	// the same pages as the sitemap, leaving out
+	// private pages and drafts. users' pages live
+	// outside the view path and are left to the server
+	pages := make([]*Page, 0)
+	for _, page := range listedPages() {
+		if isUserPage(page.Shortname) {
+			continue
+		}
+		if ex.pageFile(page.Shortname) == "index.html" {
+			log.Printf("Not exporting %v: it would replace the index\n", page.Shortname)
+			continue
+		}
+		pages = append(pages, page)
+		ex.pages[strings.TrimSuffix(page.Shortname, ".md")] = true
+	}
+
+	// the index only links the pages being exported
+	index := render(genFilteredIndex(false, func(name string) bool {
+		return ex.pages[strings.TrimSuffix(name, ".md")]
+	}), title)
+	if err := ex.writeFile("index.html", ex.rewrite("index.html", index), time.Time{}); err != nil {
+		return ex.stats, err
+	}
+
+	// exported pages depend on more than their own
+	// file, such as their backlinks and the layout,
+	// so they're compared by what would be written
+	exported := make(map[string]string)
+	for _, page := range pages {
+		name := ex.pageFile(page.Shortname)
+
+		// the lazily loaded cache may not
+		// have rendered the page yet
+		rendered, err := freshPage(page.Shortname)
+		if err != nil || rendered.Body == nil {
+			return ex.stats, fmt.Errorf("couldn't render %v", page.Shortname)
+		}
+		body := ex.rewrite(name, rendered.Body)
+		exported[name] = contentETag(body)
+
+		if !full && previous[name] == exported[name] {
+			if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name))); err == nil {
+				ex.stats.unchanged++
+				continue
+			}
+		}
+		if err := ex.writeFile(name, body, rendered.Modtime); err != nil {
+			return ex.stats, err
+		}
+		ex.stats.written++
+	}
+
+	if err := ex.prune(previous, exported); err != nil {
+		return ex.stats, err
+	}
+	return ex.stats, ex.writeManifest(exported)
+}
+
+// The exported file for a page, under the view path
+func (ex *exporter) pageFile(shortname string) string {
+	return path.Join(strings.Trim(ex.viewPath, "/"), strings.TrimSuffix(shortname, ".md")+".html")
+}
+
+// Copies a file from the wiki's assets, to be
+// linked in place of the given route. Missing
+// files are skipped, as the server would 404.
+func (ex *exporter) copyAsset(route, src, name string) error {
+	data, err := ioutil.ReadFile(src)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := ex.writeFile(name, data, time.Time{}); err != nil {
+		return err
+	}
+	ex.assets[route] = name
+	return nil
+}
+
+// Writes a file under the export directory. Pages
+// are given their page's modification time.
+func (ex *exporter) writeFile(name string, data []byte, modtime time.Time) error {
+	longname := filepath.Join(ex.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(longname), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(longname, data, 0644); err != nil {
+		return err
+	}
+	if modtime.IsZero() {
+		return nil
+	}
+	return os.Chtimes(longname, modtime, modtime)
+}
+
+// Rewrites the root-relative links in a document
+// to point at the exported files, relative to the
+// document so the export can be browsed from
+// anywhere. Links to things only the server
+// provides, such as search and history, are made
+// absolute with BaseURL when it's set.
+func (ex *exporter) rewrite(from string, doc []byte) []byte {
+	return exportLinkPattern.ReplaceAllFunc(doc, func(match []byte) []byte {
+		parts := exportLinkPattern.FindSubmatch(match)
+		attr, target := string(parts[1]), html.UnescapeString(string(parts[2]))
+		return []byte(attr + `="` + html.EscapeString(ex.link(from, target)) + `"`)
+	})
+}
+
+// Maps a root-relative link to its exported file
+func (ex *exporter) link(from, target string) string {
+	fragment := ""
+	if i := strings.Index(target, "#"); i >= 0 {
+		target, fragment = target[:i], target[i:]
+	}
+
+	var file string
+	switch {
+	case target == "/":
+		file = "index.html"
+	case ex.assets[target] != "":
+		file = ex.assets[target]
+	case strings.HasPrefix(target, ex.viewPath) && ex.pages[strings.TrimPrefix(target, ex.viewPath)]:
+		file = ex.pageFile(strings.TrimPrefix(target, ex.viewPath))
+	default:
+		return ex.baseURL + target + fragment
+	}
+
+	rel, err := filepath.Rel(filepath.FromSlash(path.Dir(from)), filepath.FromSlash(file))
+	if err != nil {
+		return ex.baseURL + target + fragment
+	}
+	return filepath.ToSlash(rel) + fragment
+}
+
+// Reads the pages written by the last export and
+// the hashes of their contents. Only files listed
+// here are ever removed.
+func (ex *exporter) readManifest() map[string]string {
+	files := make(map[string]string)
+	data, err := ioutil.ReadFile(filepath.Join(ex.dir, exportManifest))
+	if err != nil {
+		return files
+	}
+	if err := json.Unmarshal(data, &files); err != nil {
+		log.Printf("Couldn't read the last export's manifest: %v\n", err.Error())
+		return make(map[string]string)
+	}
+	return files
+}
+
+// Records the pages written by this export
+func (ex *exporter) writeManifest(files map[string]string) error {
+	data, err := json.MarshalIndent(files, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ex.writeFile(exportManifest, data, time.Time{})
+}
+
+// Removes pages exported last time that weren't
+// part of this export, such as deleted or newly
+// private pages
+func (ex *exporter) prune(previous, exported map[string]string) error {
+	for name := range previous {
+		if _, ok := exported[name]; ok || name == "index.html" {
+			continue
+		}
+		// only ever pages inside the export
+		clean := path.Clean(name)
+		if clean != name || path.IsAbs(clean) || strings.HasPrefix(clean, "../") || path.Ext(clean) != ".html" {
+			continue
+		}
+		longname := filepath.Join(ex.dir, filepath.FromSlash(name))
+		if err := os.Remove(longname); err != nil && !os.IsNotExist(err) {
+			return errors.New("couldn't remove old page: " + err.Error())
+		}
+		ex.stats.removed++
+	}
+	return nil
+}
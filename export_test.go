@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func Test_exporter_link(t *testing.T) {
+	ex := &exporter{
+		viewPath: "/w/",
+		baseURL:  "https://wiki.example.com",
+		pages:    map[string]bool{"home": true, "howto/ssh": true},
+		assets:   map[string]string{"/css": "wiki.css"},
+	}
+
+	tests := []struct {
+		from   string
+		target string
+		want   string
+	}{
+		{"index.html", "/", "index.html"},
+		{"index.html", "/w/home", "w/home.html"},
+		{"w/home.html", "/w/howto/ssh#keys", "howto/ssh.html#keys"},
+		{"w/howto/ssh.html", "/w/home", "../home.html"},
+		{"w/howto/ssh.html", "/css", "../../wiki.css"},
+		{"w/home.html", "/w/howto", "https://wiki.example.com/w/howto"},
+		{"w/home.html", "/search?q=ssh", "https://wiki.example.com/search?q=ssh"},
+	}
+	for _, tt := range tests {
+		if got := ex.link(tt.from, tt.target); got != tt.want {
+			t.Errorf("exporter.link(%q, %q) = %q, want %q\n", tt.from, tt.target, got, tt.want)
+		}
+	}
+}
+
+func Test_exporter_rewrite(t *testing.T) {
+	ex := &exporter{
+		viewPath: "/w/",
+		baseURL:  "https://wiki.example.com",
+		pages:    map[string]bool{"home": true},
+		assets:   map[string]string{"/css": "wiki.css"},
+	}
+
+	doc := `<a href="/">top</a> <a href="/w/home">home</a> <link href="//cdn.example/x.css"> <img src="//cdn.example/x.png">`
+	want := `<a href="index.html">top</a> <a href="w/home.html">home</a> <link href="//cdn.example/x.css"> <img src="//cdn.example/x.png">`
+	if got := string(ex.rewrite("index.html", []byte(doc))); got != want {
+		t.Errorf("exporter.rewrite():\ngot  %v\nwant %v\n", got, want)
+	}
+}
+
+func Test_exportSite(t *testing.T) {
+	defer privatePageDir(t)()
+
+	dir, err := ioutil.TempDir("", "tildewiki-export")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer os.RemoveAll(dir)
+	// gone.html was exported last time, mine.html wasn't
+	os.MkdirAll(dir+"/w", 0755)
+	files := map[string]string{
+		"w/gone.html":     "old",
+		"w/mine.html":     "not the wiki's",
+		exportManifest:    `{"w/gone.html": "x", "../outside.html": "x"}`,
+		"../outside.html": "",
+	}
+	for name, body := range files {
+		if err := ioutil.WriteFile(dir+"/"+name, []byte(body), 0644); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+	}
+	defer os.Remove(dir + "/../outside.html")
+
+	stats, err := exportSite(dir, false)
+	if err != nil {
+		t.Fatalf("exportSite(): %v\n", err)
+	}
+	if stats.written == 0 || stats.removed != 1 {
+		t.Errorf("exportSite(): got %+v\n", stats)
+	}
+
+	page, err := ioutil.ReadFile(dir + "/w/open.html")
+	if err != nil {
+		t.Fatalf("exportSite(): %v\n", err)
+	}
+	if !strings.Contains(string(page), `href="../index.html"`) {
+		t.Errorf("exportSite(): links not rewritten:\n%s\n", page)
+	}
+	index, err := ioutil.ReadFile(dir + "/index.html")
+	if err != nil || !strings.Contains(string(index), `href="w/open.html"`) || strings.Contains(string(index), "secret") {
+		t.Errorf("exportSite(): index:\n%s\n", index)
+	}
+	for _, gone := range []string{"/w/secret.html", "/w/gone.html"} {
+		if _, err := os.Stat(dir + gone); err == nil {
+			t.Errorf("exportSite(): %v exists\n", gone)
+		}
+	}
+	for _, kept := range []string{"/w/mine.html", "/../outside.html"} {
+		if _, err := os.Stat(dir + kept); err != nil {
+			t.Errorf("exportSite(): removed %v\n", kept)
+		}
+	}
+
+	// nothing changed since
+	pages := stats.written
+	if stats, err := exportSite(dir, false); err != nil || stats.written != 0 || stats.unchanged != pages {
+		t.Errorf("exportSite(): second run got %+v, %v\n", stats, err)
+	}
+	if stats, err := exportSite(dir, true); err != nil || stats.written != pages {
+		t.Errorf("exportSite(): full run got %+v, %v\n", stats, err)
+	}
+
+	// changes outside the page files are picked up
+	confVars.mu.Lock()
+	confVars.tableOfContents = true
+	confVars.mu.Unlock()
+	defer func() {
+		confVars.mu.Lock()
+		confVars.tableOfContents = false
+		confVars.mu.Unlock()
+		triggerRecache()
+	}()
+	triggerRecache()
+	if stats, err := exportSite(dir, false); err != nil || stats.written == 0 {
+		t.Errorf("exportSite(): run after a config change got %+v, %v\n", stats, err)
+	}
+}
+
+// A page named index under a view path of / can't
+// replace the wiki's index
+func Test_exportSite_index(t *testing.T) {
+	defer privatePageDir(t)()
+
+	dir, err := ioutil.TempDir("", "tildewiki-export")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	confVars.mu.Lock()
+	oldView := confVars.viewPath
+	confVars.viewPath = "/"
+	confVars.mu.Unlock()
+	pageCache.mu.Lock()
+	pageCache.pool["index.md"] = newBarePage(dir+"/index.md", "index.md")
+	pageCache.mu.Unlock()
+	defer func() {
+		confVars.mu.Lock()
+		confVars.viewPath = oldView
+		confVars.mu.Unlock()
+		evictPages("index.md")
+	}()
+
+	if _, err := exportSite(dir, false); err != nil {
+		t.Fatalf("exportSite(): %v\n", err)
+	}
+	index, err := ioutil.ReadFile(dir + "/index.html")
+	if err != nil || !strings.Contains(string(index), "Open Page") {
+		t.Errorf("exportSite(): index replaced:\n%s\n", index)
+	}
+	if _, err := os.Stat(dir + "/open.html"); err != nil {
+		t.Errorf("exportSite(): %v\n", err)
+	}
+}
+
+// Drafts are left out like private pages
+func Test_exportSite_draft(t *testing.T) {
+	defer privatePageDir(t)()
+
+	confVars.mu.RLock()
+	pageDir := confVars.pageDir
+	confVars.mu.RUnlock()
+	if err := ioutil.WriteFile(pageDir+"/unfinished.md", []byte("<!--\ntitle: Unfinished\ndraft: true\n-->\n# Unfinished\n"), 0644); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer evictPages("unfinished.md")
+	genPageCache()
+
+	dir, err := ioutil.TempDir("", "tildewiki-export")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := exportSite(dir, false); err != nil {
+		t.Fatalf("exportSite(): %v\n", err)
+	}
+	if _, err := os.Stat(dir + "/w/unfinished.html"); err == nil {
+		t.Errorf("exportSite(): exported a draft\n")
+	}
+	if _, err := os.Stat(dir + "/w/open.html"); err != nil {
+		t.Errorf("exportSite(): %v\n", err)
+	}
+	index, err := ioutil.ReadFile(dir + "/index.html")
+	if err != nil {
+		t.Fatalf("exportSite(): %v\n", err)
+	}
+	if bytes.Contains(index, []byte("unfinished")) || !bytes.Contains(index, []byte("open")) {
+		t.Errorf("exportSite(): index doesn't match the exported pages:\n%s\n", index)
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// content-type constants for the feeds
+const atomutf8 = "application/atom+xml; charset=utf-8"
+const rssutf8 = "application/rss+xml; charset=utf-8"
+
+type atomFeed struct {
+	XMLName  xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title    string      `xml:"title"`
+	Subtitle string      `xml:"subtitle,omitempty"`
+	ID       string      `xml:"id"`
+	Updated  string      `xml:"updated"`
+	Links    []atomLink  `xml:"link"`
+	Author   atomAuthor  `xml:"author"`
+	Entries  []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Link    atomLink    `xml:"link"`
+	Author  *atomAuthor `xml:"author,omitempty"`
+	Summary string      `xml:"summary,omitempty"`
+	Content atomContent `xml:"content"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Generator     string    `xml:"generator"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+	Creator     string  `xml:"http://purl.org/dc/elements/1.1/ creator,omitempty"`
+	Description string  `xml:"description"`
+}
+
+type rssGUID struct {
+	IsPermaLink string `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+// Returns the most recently modified pages,
+// newest first, up to the given count. The
+// feeds are public, so private pages are left out,
+// as are drafts.
+func recentPages(count int) []*Page {
+	pageCache.mu.RLock()
+	pages := make([]*Page, 0, len(pageCache.pool))
+	for _, page := range pageCache.pool {
+		if !page.Modtime.IsZero() && !page.Private && !page.Draft {
+			pages = append(pages, page)
+		}
+	}
+	pageCache.mu.RUnlock()
+
+	sort.Slice(pages, func(i, j int) bool {
+		if pages[i].Modtime.Equal(pages[j].Modtime) {
+			return pages[i].Shortname < pages[j].Shortname
+		}
+		return pages[i].Modtime.After(pages[j].Modtime)
+	})
+	if count > 0 && len(pages) > count {
+		pages = pages[:count]
+	}
+	return pages
+}
+
+// Removes the separators and markup buildPage()
+// adds to the description and author fields
+func plainMeta(page *Page, descSep string) (string, string) {
+	desc := strings.TrimSpace(strings.TrimPrefix(page.Desc, descSep))
+	author := strings.TrimSuffix(strings.TrimPrefix(page.Author, "`by "), "`")
+	return desc, author
+}
+
+// Checks the feed cache. Returns true if the feeds
+// are older than the refresh interval.
+// This method helps satisfy the cacher interface.
+func (feed *feedCacheBlk) checkCache() bool {
+	feed.mu.RLock()
+	defer feed.mu.RUnlock()
+
+	if feed.atom == nil || feed.rss == nil || feed.built.IsZero() {
+		return true
+	}
+
+	if interval, err := time.ParseDuration(viper.GetString("FeedRefreshInterval")); err == nil {
+		if time.Since(feed.built) > interval {
+			return true
+		}
+	} else {
+		log.Printf("Couldn't parse feed refresh interval: %v\n", err.Error())
+	}
+
+	return false
+}
+
+// Rebuilds both feeds from the page cache.
+// This method helps satisfy the cacher interface.
+func (feed *feedCacheBlk) cache() error {
+	confVars.mu.RLock()
+	baseURL := confVars.baseURL
+	viewPath := confVars.viewPath
+	wikiName := confVars.wikiName
+	wikiDesc := confVars.wikiDesc
+	descSep := confVars.descSep
+	count := confVars.feedItems
+	confVars.mu.RUnlock()
+
+	if baseURL == "" {
+		return errors.New("feeds need BaseURL for their IDs")
+	}
+
+	pages := recentPages(count)
+	now := time.Now()
+	updated := now
+	if len(pages) > 0 {
+		updated = pages[0].Modtime
+	}
+
+	atom := atomFeed{
+		Title:    wikiName,
+		Subtitle: wikiDesc,
+		ID:       baseURL + "/",
+		Updated:  updated.Format(time.RFC3339),
+		Links: []atomLink{
+			{Href: baseURL + "/feed.atom", Rel: "self", Type: "application/atom+xml"},
+			{Href: baseURL + "/", Rel: "alternate", Type: "text/html"},
+		},
+		Author:  atomAuthor{Name: wikiName},
+		Entries: make([]atomEntry, 0, len(pages)),
+	}
+	rss := rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:         wikiName,
+			Link:          baseURL + "/",
+			Description:   wikiDesc,
+			LastBuildDate: updated.Format(time.RFC1123Z),
+			Generator:     "TildeWiki " + twvers,
+			Items:         make([]rssItem, 0, len(pages)),
+		},
+	}
+
+	for _, page := range pages {
+		// the lazily loaded cache may not
+		// have rendered the page yet
+		if full, err := peekPage(page.Shortname); err == nil {
+			page = full
+		}
+		link := baseURL + pageURL(viewPath, page.Shortname)
+		desc, author := plainMeta(page, descSep)
+		content := string(page.Content)
+
+		entry := atomEntry{
+			Title:   page.Title,
+			ID:      link,
+			Updated: page.Modtime.Format(time.RFC3339),
+			Link:    atomLink{Href: link, Rel: "alternate", Type: "text/html"},
+			Summary: desc,
+			Content: atomContent{Type: "html", Body: content},
+		}
+		if author != "" {
+			entry.Author = &atomAuthor{Name: author}
+		}
+		atom.Entries = append(atom.Entries, entry)
+
+		if desc != "" {
+			content = "<p><em>" + xmlEscape(desc) + "</em></p>\n" + content
+		}
+		rss.Channel.Items = append(rss.Channel.Items, rssItem{
+			Title:       page.Title,
+			Link:        link,
+			GUID:        rssGUID{IsPermaLink: "true", Value: link},
+			PubDate:     page.Modtime.Format(time.RFC1123Z),
+			Creator:     author,
+			Description: content,
+		})
+	}
+
+	atomOut, err := xml.MarshalIndent(atom, "", "  ")
+	if err != nil {
+		return fmt.Errorf("feedCacheBlk.cache(): atom: %v", err)
+	}
+	rssOut, err := xml.MarshalIndent(rss, "", "  ")
+	if err != nil {
+		return fmt.Errorf("feedCacheBlk.cache(): rss: %v", err)
+	}
+
+	// the feeds only change along with their pages,
+	// so rebuilding doesn't change their ETags
+	feed.mu.Lock()
+	feed.atom = append([]byte(xml.Header), atomOut...)
+	feed.rss = append([]byte(xml.Header), rssOut...)
+	feed.atomETag = contentETag(feed.atom)
+	feed.rssETag = contentETag(feed.rss)
+	feed.modtime = updated
+	feed.built = now
+	feed.mu.Unlock()
+	return nil
+}
+
+// Escapes text for inclusion in HTML feed content
+func xmlEscape(text string) string {
+	buf := bytes.NewBuffer(nil)
+	if err := xml.EscapeText(buf, []byte(text)); err != nil {
+		log.Printf("Couldn't escape feed text: %v\n", err.Error())
+	}
+	return buf.String()
+}
+
+// Serves the Atom feed of recently changed pages
+func atomHandler(w http.ResponseWriter, r *http.Request) {
+	if !feedReady(w, r) {
+		return
+	}
+	feedCache.mu.RLock()
+	body := feedCache.atom
+	etag := feedCache.atomETag
+	modtime := feedCache.modtime
+	feedCache.mu.RUnlock()
+	writeFeed(w, r, body, etag, modtime, atomutf8)
+}
+
+// Serves the RSS feed of recently changed pages
+func rssHandler(w http.ResponseWriter, r *http.Request) {
+	if !feedReady(w, r) {
+		return
+	}
+	feedCache.mu.RLock()
+	body := feedCache.rss
+	etag := feedCache.rssETag
+	modtime := feedCache.modtime
+	feedCache.mu.RUnlock()
+	writeFeed(w, r, body, etag, modtime, rssutf8)
+}
+
+// Refreshes the feeds if they're due. Feed IDs
+// must be absolute, and the Host header can't be
+// trusted to build them for a response shared by
+// everyone, so without BaseURL there are no feeds
+// and a 404 is sent instead.
+func feedReady(w http.ResponseWriter, r *http.Request) bool {
+	if siteURL() == "" {
+		log.Printf("**NOTICE** %v requested, but BaseURL isn't set in the config\n", r.URL.Path)
+		error404(w, r)
+		return false
+	}
+	pingCache(feedCache)
+	return true
+}
+
+// Writes a feed with the headers common to both formats
+func writeFeed(w http.ResponseWriter, r *http.Request, body []byte, etag string, modtime time.Time, ctype string) {
+	if body == nil {
+		log500(w, r, errors.New("feed cache is empty"))
+		return
+	}
+
+	if notModified(w, r, etag, modtime) {
+		return
+	}
+	w.Header().Set("Content-Type", ctype)
+	if err := writeBody(w, r, body); err != nil {
+		log500(w, r, err)
+		return
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Make sure recentPages() is sorted newest first
+// and respects the item count
+func Test_recentPages(t *testing.T) {
+	initConfigParams()
+	log.SetOutput(hush)
+	genPageCache()
+
+	pages := recentPages(0)
+	for i := 1; i < len(pages); i++ {
+		if pages[i].Modtime.After(pages[i-1].Modtime) {
+			t.Errorf("recentPages(): %v is newer than %v\n", pages[i].Shortname, pages[i-1].Shortname)
+		}
+	}
+	if got := recentPages(1); len(got) != 1 {
+		t.Errorf("recentPages(1) returned %v pages\n", len(got))
+	}
+}
+
+// Drafts are left out of the feeds and the page
+// listings, like the sitemap
+func Test_recentPages_draft(t *testing.T) {
+	defer privatePageDir(t)()
+
+	confVars.mu.RLock()
+	pageDir := confVars.pageDir
+	confVars.mu.RUnlock()
+	if err := ioutil.WriteFile(pageDir+"/unfinished.md", []byte("<!--\ntitle: Unfinished\ndraft: true\n-->\n# Unfinished\n"), 0644); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer evictPages("unfinished.md")
+	genPageCache()
+
+	for _, page := range recentPages(0) {
+		if page.Draft {
+			t.Errorf("recentPages(): listed the draft\n")
+		}
+	}
+	if index := genIndex(true); bytes.Contains(index, []byte("Unfinished")) {
+		t.Errorf("genIndex(): listed the draft:\n%s\n", index)
+	}
+	if menu := gopherMenu(); bytes.Contains(menu, []byte("Unfinished")) {
+		t.Errorf("gopherMenu(): listed the draft:\n%s\n", menu)
+	}
+}
+
+// Builds the feeds and checks they're well-formed
+// and hold an entry for each page
+func Test_feedCacheBlk_cache(t *testing.T) {
+	initConfigParams()
+	log.SetOutput(hush)
+	genPageCache()
+	defer feedBaseURL("https://wiki.example.com")()
+
+	if !feedCache.checkCache() {
+		t.Errorf("feedCacheBlk.checkCache(): empty cache doesn't need refreshing\n")
+	}
+	before := pageCache.stats()
+	if err := feedCache.cache(); err != nil {
+		t.Fatalf("feedCacheBlk.cache(): %v\n", err)
+	}
+	if after := pageCache.stats(); after.Hits != before.Hits || after.Misses != before.Misses {
+		t.Errorf("feedCacheBlk.cache(): counted as page views: %+v, then %+v\n", before, after)
+	}
+	if feedCache.checkCache() {
+		t.Errorf("feedCacheBlk.checkCache(): fresh cache needs refreshing\n")
+	}
+
+	var atom atomFeed
+	if err := xml.Unmarshal(feedCache.atom, &atom); err != nil {
+		t.Errorf("feedCacheBlk.cache(): atom doesn't parse: %v\n", err)
+	}
+	var rss rssFeed
+	if err := xml.Unmarshal(feedCache.rss, &rss); err != nil {
+		t.Errorf("feedCacheBlk.cache(): rss doesn't parse: %v\n", err)
+	}
+
+	want := len(recentPages(confVars.feedItems))
+	if len(atom.Entries) != want || len(rss.Channel.Items) != want {
+		t.Errorf("feedCacheBlk.cache(): got %v atom and %v rss items, want %v\n", len(atom.Entries), len(rss.Channel.Items), want)
+	}
+	for _, entry := range atom.Entries {
+		if !strings.HasPrefix(entry.ID, "https://wiki.example.com/") {
+			t.Errorf("feedCacheBlk.cache(): relative entry ID %q\n", entry.ID)
+		}
+	}
+
+	// nothing changed, so neither did the feed
+	etag := feedCache.atomETag
+	if err := feedCache.cache(); err != nil || feedCache.atomETag != etag {
+		t.Errorf("feedCacheBlk.cache(): rebuilding changed the ETag: %v\n", err)
+	}
+}
+
+// Sets BaseURL and clears the feed cache. The
+// returned func restores both.
+func feedBaseURL(baseURL string) func() {
+	confVars.mu.Lock()
+	oldBase := confVars.baseURL
+	confVars.baseURL = baseURL
+	confVars.mu.Unlock()
+	feedCache.mu.Lock()
+	feedCache.built = time.Time{}
+	feedCache.mu.Unlock()
+
+	return func() {
+		confVars.mu.Lock()
+		confVars.baseURL = oldBase
+		confVars.mu.Unlock()
+		feedCache.mu.Lock()
+		feedCache.built = time.Time{}
+		feedCache.mu.Unlock()
+	}
+}
+
+// Checks the feeds are revalidated with a 304,
+// HEAD requests get no body, and there are no
+// feeds without BaseURL
+func Test_atomHandler(t *testing.T) {
+	initConfigParams()
+	log.SetOutput(hush)
+	genPageCache()
+
+	restore := feedBaseURL("")
+	w := httptest.NewRecorder()
+	atomHandler(w, httptest.NewRequest("GET", "/feed.atom", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("atomHandler(): got %v without BaseURL\n", w.Code)
+	}
+	restore()
+	defer feedBaseURL("https://wiki.example.com")()
+
+	w = httptest.NewRecorder()
+	atomHandler(w, httptest.NewRequest("GET", "/feed.atom", nil))
+	etag := w.Header().Get("ETag")
+	if w.Code != 200 || etag == "" || w.Header().Get("Last-Modified") == "" || w.Header().Get("Content-Type") != atomutf8 {
+		t.Fatalf("atomHandler(): got %v with headers %v\n", w.Code, w.Header())
+	}
+
+	r := httptest.NewRequest("GET", "/feed.atom", nil)
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	atomHandler(w, r)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("atomHandler(): got %v for a current ETag\n", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	rssHandler(w, httptest.NewRequest("HEAD", "/feed.rss", nil))
+	if w.Code != 200 || w.Body.Len() != 0 || w.Header().Get("Content-Length") == "" {
+		t.Errorf("rssHandler(): HEAD got %v with %v bytes\n", w.Code, w.Body.Len())
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Longest request line accepted from a Gemini
+// client, not counting the CRLF
+const maxGeminiRequest = 1024
+
+// Time a Gemini client has to send its request
+// and read the response
+const geminiTimeout = 15 * time.Second
+
+// MIME type sent with every gemtext response
+const gemtextutf8 = "text/gemini; charset=utf-8"
+
+// Listens for Gemini requests on the given address,
+// using the configured certificate, which is reloaded
+// when it changes. Runs alongside the HTTP server,
+// sharing its caches.
+func serveGemini(addr, certFile, keyFile string) error {
+	certs, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	ln, err := tls.Listen("tcp", addr, certs.tlsConfig())
+	if err != nil {
+		return err
+	}
+	trackListener(ln)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go handleGemini(conn)
+	}
+}
+
+// Answers a single Gemini request
+func handleGemini(conn net.Conn) {
+	defer func() {
+		if err := conn.Close(); err != nil {
+			log.Printf("Couldn't close gemini connection: %v\n", err.Error())
+		}
+	}()
+
+	if err := conn.SetDeadline(time.Now().Add(geminiTimeout)); err != nil {
+		log.Printf("Couldn't set gemini deadline: %v\n", err.Error())
+	}
+
+	status, meta, body := geminiResponse(conn)
+
+	if _, err := io.WriteString(conn, status+" "+meta+"\r\n"); err != nil {
+		log.Printf("Couldn't write gemini response: %v\n", err.Error())
+		return
+	}
+	if body != nil {
+		if _, err := conn.Write(body); err != nil {
+			log.Printf("Couldn't write gemini response: %v\n", err.Error())
+			return
+		}
+	}
+	log.Printf("**** %v :: gemini :: %v %v\n", conn.RemoteAddr(), status, meta)
+}
+
+// Reads the request and returns the status code,
+// the meta line and the body to send back
+func geminiResponse(r io.Reader) (string, string, []byte) {
+	line, err := bufio.NewReaderSize(io.LimitReader(r, maxGeminiRequest+2), maxGeminiRequest+2).ReadString('\n')
+	if err != nil {
+		return "59", "Bad request", nil
+	}
+
+	req, err := url.Parse(strings.TrimRight(line, "\r\n"))
+	if err != nil || (req.Scheme != "gemini" && req.Scheme != "") {
+		return "59", "Bad request", nil
+	}
+
+	confVars.mu.RLock()
+	viewPath := confVars.viewPath
+	confVars.mu.RUnlock()
+
+	switch {
+	case req.Path == "" || req.Path == "/":
+		pingCache(indexCache)
+		indexCache.mu.RLock()
+		body := indexCache.page.Gemtext
+		indexCache.mu.RUnlock()
+		return "20", gemtextutf8, body
+	case strings.HasPrefix(req.Path, viewPath):
+		page, err := freshPage(strings.TrimPrefix(req.Path, viewPath) + ".md")
+		if err != nil || page.Gemtext == nil || page.Private {
+			return "51", "Not found", nil
+		}
+		return "20", gemtextutf8, page.Gemtext
+	}
+
+	return "51", "Not found", nil
+}
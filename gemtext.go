@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+)
+
+// Matches inline markdown links and images,
+// capturing the label and the URL
+var mdInlineLinkRegex = regexp.MustCompile(`!?\[([^\]]*)\]\(([^)\s]+)(?:\s+"[^"]*")?\)`)
+
+// Matches ordered and unordered list item markers
+var mdListRegex = regexp.MustCompile(`^\s*(?:[*+-]|\d+[.)])\s+`)
+
+// Emphasis and code markers dropped from gemtext
+var mdEmphasis = strings.NewReplacer("**", "", "__", "", "`", "")
+
+// A link pulled out of a line of markdown
+type gemLink struct {
+	url   string
+	label string
+}
+
+// Converts a markdown document to gemtext.
+// Headings, lists, quotes and preformatted blocks
+// map onto their gemtext equivalents. Paragraphs
+// are joined onto a single line, and links are
+// moved onto link lines of their own.
+func toGemtext(data []byte) []byte {
+	confVars.mu.RLock()
+	viewPath := confVars.viewPath
+	confVars.mu.RUnlock()
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	para := make([]string, 0)
+	inpre := false
+
+	// writes out the paragraph collected so far
+	flush := func() {
+		if len(para) > 0 {
+			writeGemLine(out, "", strings.Join(para, " "), viewPath)
+			para = para[:0]
+		}
+	}
+
+	for _, line := range strings.Split(strings.Trim(string(stripHeader(data)), "\r\n"), "\n") {
+		line = strings.TrimRight(line, "\r")
+		trimmed := strings.TrimSpace(line)
+
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			flush()
+			if inpre {
+				out.WriteString("```\n")
+			} else {
+				out.WriteString("```" + strings.TrimLeft(trimmed, "`~") + "\n")
+			}
+			inpre = !inpre
+			continue
+		}
+		if inpre {
+			out.WriteString(line + "\n")
+			continue
+		}
+
+		switch {
+		case trimmed == "":
+			flush()
+			out.WriteString("\n")
+		case strings.HasPrefix(trimmed, "<!--") && strings.HasSuffix(trimmed, "-->"):
+			flush()
+		case strings.HasPrefix(trimmed, "#"):
+			flush()
+			level := len(trimmed) - len(strings.TrimLeft(trimmed, "#"))
+			if level > 3 {
+				level = 3
+			}
+			heading := strings.TrimSpace(strings.Trim(trimmed, "#"))
+			writeGemLine(out, strings.Repeat("#", level)+" ", heading, viewPath)
+		case mdListRegex.MatchString(line):
+			flush()
+			writeGemLine(out, "* ", mdListRegex.ReplaceAllString(line, ""), viewPath)
+		case strings.HasPrefix(trimmed, ">"):
+			flush()
+			writeGemLine(out, "> ", strings.TrimSpace(strings.TrimLeft(trimmed, ">")), viewPath)
+		case trimmed == "---" || trimmed == "***" || trimmed == "___":
+			flush()
+		default:
+			para = append(para, trimmed)
+		}
+	}
+	flush()
+	if inpre {
+		out.WriteString("```\n")
+	}
+
+	return out.Bytes()
+}
+
+// Writes a single line of gemtext. Links are replaced
+// by their labels, then written on link lines below.
+// A line that starts with its only link becomes
+// a link line itself.
+func writeGemLine(out *bytes.Buffer, prefix, text, viewPath string) {
+	links := make([]gemLink, 0)
+
+	text = wikiLinkRegex.ReplaceAllStringFunc(text, func(match string) string {
+		sub := wikiLinkRegex.FindStringSubmatch(match)
+		label := sub[1]
+		if sub[2] != "" {
+			label = strings.TrimSpace(sub[2])
+		}
+		links = append(links, gemLink{url: viewPath + sub[1], label: label})
+		return label
+	})
+	text = mdInlineLinkRegex.ReplaceAllStringFunc(text, func(match string) string {
+		sub := mdInlineLinkRegex.FindStringSubmatch(match)
+		label := sub[1]
+		if label == "" {
+			label = sub[2]
+		}
+		links = append(links, gemLink{url: sub[2], label: label})
+		return label
+	})
+	text = strings.TrimSpace(mdEmphasis.Replace(text))
+
+	if len(links) == 1 && prefix != "# " && prefix != "## " && prefix != "### " && strings.HasPrefix(text, links[0].label) {
+		out.WriteString("=> " + links[0].url + " " + text + "\n")
+		return
+	}
+
+	out.WriteString(prefix + text + "\n")
+	for _, link := range links {
+		out.WriteString("=> " + link.url + " " + link.label + "\n")
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"testing"
+)
+
+var toGemtextCases = []struct {
+	name string
+	data string
+	want string
+}{
+	{
+		name: "header and headings",
+		data: "<!--\ntitle: t\n-->\n# One\n#### Four\n",
+		want: "# One\n### Four\n",
+	},
+	{
+		name: "paragraph with link",
+		data: "some **bold**\ntext with [a link](https://example.com) in it\n",
+		want: "some bold text with a link in it\n=> https://example.com a link\n",
+	},
+	{
+		name: "list of links",
+		data: "* [Example](/w/example) :: desc\n- [[test1|Test]]\n",
+		want: "=> /w/example Example :: desc\n=> /w/test1 Test\n",
+	},
+	{
+		name: "preformatted",
+		data: "```go\n# not a heading\n* not a list\n```\n",
+		want: "```go\n# not a heading\n* not a list\n```\n",
+	},
+	{
+		name: "quote",
+		data: "> quoted `code`\n",
+		want: "> quoted code\n",
+	},
+}
+
+func Test_toGemtext(t *testing.T) {
+	initConfigParams()
+	for _, tt := range toGemtextCases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(toGemtext([]byte(tt.data))); got != tt.want {
+				t.Errorf("toGemtext() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+func Benchmark_toGemtext(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		for _, c := range toGemtextCases {
+			toGemtext([]byte(c.data))
+		}
+	}
+}
+
+var geminiResponseCases = []struct {
+	name   string
+	req    string
+	status string
+	body   string
+}{
+	{
+		name:   "index",
+		req:    "gemini://localhost/\r\n",
+		status: "20",
+		body:   "=> /w/example Example Page",
+	},
+	{
+		name:   "page",
+		req:    "gemini://localhost/w/example\r\n",
+		status: "20",
+		body:   "# template heading",
+	},
+	{
+		name:   "missing",
+		req:    "gemini://localhost/w/fake\r\n",
+		status: "51",
+	},
+	{
+		name:   "wrong scheme",
+		req:    "https://localhost/\r\n",
+		status: "59",
+	},
+}
+
+func Test_geminiResponse(t *testing.T) {
+	initConfigParams()
+	log.SetOutput(hush)
+	genPageCache()
+	for _, tt := range geminiResponseCases {
+		t.Run(tt.name, func(t *testing.T) {
+			status, _, body := geminiResponse(strings.NewReader(tt.req))
+			if status != tt.status || !strings.Contains(string(body), tt.body) {
+				t.Errorf("geminiResponse() = %v, %q .. want %v, %q", status, body, tt.status, tt.body)
+			}
+		})
+	}
+}
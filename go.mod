@@ -3,15 +3,17 @@ module github.com/gbmor/tildewiki
 go 1.11
 
 require (
+	github.com/alecthomas/chroma v0.6.3
 	github.com/fsnotify/fsnotify v1.4.7
 	github.com/gbmor-forks/blackfriday.v2-patched v0.0.0-20190422230759-91071f2561f1
 	github.com/gorilla/handlers v1.4.0
 	github.com/gorilla/mux v1.7.2
 	github.com/kr/pretty v0.1.0 // indirect
 	github.com/pelletier/go-toml v1.4.0 // indirect
-	github.com/shurcooL/sanitized_anchor_name v1.0.0 // indirect
+	github.com/shurcooL/sanitized_anchor_name v1.0.0
 	github.com/spf13/viper v1.3.2
 	github.com/stretchr/testify v1.3.0 // indirect
+	golang.org/x/crypto v0.0.0-20181203042331-505ab145d0a9
 	golang.org/x/sys v0.0.0-20190508220229-2d0786266e9c // indirect
 	golang.org/x/text v0.3.2 // indirect
 	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
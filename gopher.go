@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// Longest selector accepted from a gopher client
+const maxSelectorLen = 1024
+
+// Time a gopher client has to send its selector
+// and read the response
+const gopherTimeout = 15 * time.Second
+
+// Listens for gopher requests on the given address.
+// Runs alongside the HTTP server, sharing its caches.
+func serveGopher(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	trackListener(ln)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go handleGopher(conn)
+	}
+}
+
+// Answers a single gopher request
+func handleGopher(conn net.Conn) {
+	defer func() {
+		if err := conn.Close(); err != nil {
+			log.Printf("Couldn't close gopher connection: %v\n", err.Error())
+		}
+	}()
+
+	if err := conn.SetDeadline(time.Now().Add(gopherTimeout)); err != nil {
+		log.Printf("Couldn't set gopher deadline: %v\n", err.Error())
+	}
+
+	selector, err := readSelector(conn)
+	if err != nil {
+		log.Printf("**** %v :: gopher :: bad request :: %v\n", conn.RemoteAddr(), err.Error())
+		return
+	}
+
+	var resp []byte
+	confVars.mu.RLock()
+	viewPath := confVars.viewPath
+	confVars.mu.RUnlock()
+
+	switch {
+	case selector == "" || selector == "/":
+		resp = gopherMenu()
+	case strings.HasPrefix(selector, viewPath):
+		resp, err = gopherPage(strings.TrimPrefix(selector, viewPath))
+	default:
+		err = errors.New("not found")
+	}
+
+	if err != nil {
+		resp = gopherError(err.Error())
+	}
+
+	if _, err := conn.Write(resp); err != nil {
+		log.Printf("Couldn't write gopher response: %v\n", err.Error())
+		return
+	}
+	log.Printf("**** %v :: gopher :: %v\n", conn.RemoteAddr(), selector)
+}
+
+// Reads the selector line sent by the client,
+// dropping any search string after a tab
+func readSelector(r io.Reader) (string, error) {
+	line, err := bufio.NewReaderSize(io.LimitReader(r, maxSelectorLen), maxSelectorLen).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if i := strings.IndexByte(line, '\t'); i >= 0 {
+		line = line[:i]
+	}
+	return line, nil
+}
+
+// Returns the host and port advertised in menu items
+func gopherAddr() (string, string) {
+	confVars.mu.RLock()
+	defer confVars.mu.RUnlock()
+	return confVars.gopherHost, strings.TrimPrefix(confVars.gopherPort, ":")
+}
+
+// Formats a single gophermap line
+func gopherItem(itemtype byte, display, selector, host, port string) string {
+	display = strings.Replace(display, "\t", " ", -1)
+	return string(itemtype) + display + "\t" + selector + "\t" + host + "\t" + port + "\r\n"
+}
+
+// Formats an informational gophermap line
+func gopherInfo(text string) string {
+	return gopherItem('i', text, "", "null.host", "1")
+}
+
+// Builds the gophermap for the front page from the
+// index file, replacing the anchor comment with a
+// text item for each page
+func gopherMenu() []byte {
+	host, port := gopherAddr()
+	confVars.mu.RLock()
+	indexpath := confVars.assetsDir + "/" + confVars.indexFile
+	viewPath := confVars.viewPath
+	descSep := confVars.descSep
+	confVars.mu.RUnlock()
+
+	buf := bytes.NewBuffer(nil)
+	index, err := readFileLines(indexpath)
+	if err != nil {
+		log.Printf("Couldn't read index for gopher: %v\n", err.Error())
+		index = []string{"<!--pagelist-->"}
+	}
+
+	for _, line := range index {
+		if line != "<!--pagelist-->" {
+			buf.WriteString(gopherInfo(line))
+			continue
+		}
+
+		files, err := indexFiles()
+		if err != nil {
+			buf.WriteString(gopherInfo("PageDir can't be read."))
+			continue
+		}
+		files = withoutDrafts(publicNames(files))
+		if len(files) == 0 {
+			buf.WriteString(gopherInfo("No wiki pages! Add some content."))
+		}
+		for _, f := range files {
+			page := loadIndexPage(f)
+			if page == nil {
+				continue
+			}
+			display := page.Title
+			if desc, _ := plainMeta(page, descSep); desc != "" {
+				display += " " + descSep + " " + desc
+			}
+			buf.WriteString(gopherItem('0', display, viewPath+strings.TrimSuffix(page.Shortname, ".md"), host, port))
+		}
+	}
+
+	buf.WriteString(".\r\n")
+	return buf.Bytes()
+}
+
+// Returns a page's raw markdown as a gopher text item
+func gopherPage(name string) ([]byte, error) {
+	filename := name + ".md"
+	page, err := freshPage(filename)
+	if err != nil || page.Private {
+		return nil, errors.New("not found")
+	}
+
+	buf := bytes.NewBuffer(nil)
+	for _, line := range strings.Split(strings.TrimRight(string(page.Raw), "\n"), "\n") {
+		line = strings.TrimRight(line, "\r")
+		// a lone period ends the response, so
+		// escape lines beginning with one
+		if strings.HasPrefix(line, ".") {
+			line = "." + line
+		}
+		buf.WriteString(line + "\r\n")
+	}
+	buf.WriteString(".\r\n")
+	return buf.Bytes(), nil
+}
+
+// Formats an error response
+func gopherError(msg string) []byte {
+	return []byte(gopherItem('3', msg, "", "null.host", "1") + ".\r\n")
+}
+
+// Reads a file and splits it into lines
+func readFileLines(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimRight(string(data), "\n"), "\n"), nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"testing"
+)
+
+var readSelectorCases = []struct {
+	name string
+	req  string
+	want string
+}{
+	{
+		name: "root",
+		req:  "\r\n",
+		want: "",
+	},
+	{
+		name: "page",
+		req:  "/w/example\r\n",
+		want: "/w/example",
+	},
+	{
+		name: "search string",
+		req:  "/w/example\tquery\r\n",
+		want: "/w/example",
+	},
+}
+
+func Test_readSelector(t *testing.T) {
+	for _, tt := range readSelectorCases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := readSelector(strings.NewReader(tt.req)); got != tt.want || err != nil {
+				t.Errorf("readSelector() = %q, %v .. want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+// Sends a selector to handleGopher() over an
+// in-memory connection and returns the response
+func gopherRequest(selector string) []byte {
+	client, server := net.Pipe()
+	go handleGopher(server)
+	go func() {
+		_, _ = client.Write([]byte(selector + "\r\n"))
+	}()
+	resp, _ := ioutil.ReadAll(client)
+	_ = client.Close()
+	return resp
+}
+
+func Test_handleGopher(t *testing.T) {
+	initConfigParams()
+	log.SetOutput(hush)
+	genPageCache()
+
+	t.Run("menu", func(t *testing.T) {
+		resp := gopherRequest("")
+		if !bytes.Contains(resp, []byte("0Example Page")) || !bytes.Contains(resp, []byte("\t/w/example\t")) {
+			t.Errorf("handleGopher(): menu is missing the example page:\n%s", resp)
+		}
+		if !bytes.HasSuffix(resp, []byte("\r\n.\r\n")) {
+			t.Errorf("handleGopher(): menu isn't terminated\n")
+		}
+	})
+
+	t.Run("page", func(t *testing.T) {
+		resp := gopherRequest("/w/example")
+		if !bytes.Contains(resp, []byte("# template heading\r\n")) {
+			t.Errorf("handleGopher(): page doesn't hold the raw markdown:\n%s", resp)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		if resp := gopherRequest("/w/fake"); !bytes.HasPrefix(resp, []byte("3")) {
+			t.Errorf("handleGopher(): missing page didn't return an error item:\n%s", resp)
+		}
+	})
+}
@@ -1,12 +1,11 @@
 package main
 
 import (
-	"crypto/sha256"
-	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -14,49 +13,83 @@ import (
 // handler for viewing content pages (not the index page)
 func pageHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	filename := vars["pageReq"]
-	filename += ".md"
+	name := vars["pageReq"]
+	filename := name + ".md"
 
-	page, err := pullFromCache(filename)
+	page, err := freshPage(filename)
 	if err != nil {
+		// a directory without a page of the
+		// same name gets a listing instead
+		if isPageDir(name) {
+			dirHandler(w, r, name)
+			return
+		}
 		log.Printf("%v\n", err)
+		error404(w, r)
+		return
 	}
+	servePage(w, r, page)
+}
 
-	pingCache(page)
-
+// Writes a cached page as HTML, markdown or JSON.
+// Shared by the wiki's pages and users' pages.
+func servePage(w http.ResponseWriter, r *http.Request, page *Page) {
 	if page.Body == nil {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
 
-	etag := fmt.Sprintf("%x", sha256.Sum256([]byte(page.Modtime.String())))
+	// the same URL can serve the page as HTML,
+	// markdown or JSON, depending on the Accept header
+	w.Header().Set("Vary", "Accept")
+	switch negotiate(r.Header.Get("Accept"), pageOffers) {
+	case "text/markdown":
+		writeRaw(w, r, page)
+		return
+	case "application/json":
+		writeJSON(w, r, page)
+		return
+	}
 
-	w.Header().Set("ETag", "\""+etag+"\"")
+	if notModified(w, r, page.ETag, page.LastMod) {
+		return
+	}
 	w.Header().Set("Content-Type", htmlutf8)
 	w.Header().Set("Link", "</>; rel=\"contents\", </css>; rel=\"stylesheet\"")
-	_, err = w.Write(page.Body)
-	if err != nil {
+	if err := writeBody(w, r, page.Body); err != nil {
 		log500(w, r, err)
 		return
 	}
-	log200(r)
 }
 
 // Handler for viewing the index page.
 func indexHandler(w http.ResponseWriter, r *http.Request) {
 	pingCache(indexCache)
 
-	etag := fmt.Sprintf("%x", sha256.Sum256([]byte(indexCache.page.Modtime.String())))
+	indexCache.mu.RLock()
+	body := indexCache.page.Body
+	etag := indexCache.page.ETag
+	if requestUser(r) != "" && indexCache.page.MemberBody != nil {
+		body = indexCache.page.MemberBody
+		etag = indexCache.page.MemberETag
+	}
+	lastmod := indexCache.page.LastMod
+	indexCache.mu.RUnlock()
 
-	w.Header().Set("ETag", "\""+etag+"\"")
+	if notModified(w, r, etag, lastmod) {
+		return
+	}
 	w.Header().Set("Content-Type", htmlutf8)
-	w.Header().Set("Link", "</>; rel=\"contents\", </css>; rel=\"stylesheet\"")
-	_, err := w.Write(indexCache.page.Body)
+	link := "</>; rel=\"contents\", </css>; rel=\"stylesheet\""
+	if siteURL() != "" {
+		link += ", </feed.atom>; rel=\"alternate\"; type=\"application/atom+xml\""
+	}
+	w.Header().Set("Link", link)
+	err := writeBody(w, r, body)
 	if err != nil {
 		log500(w, r, err)
 		return
 	}
-	log200(r)
 }
 
 // Serves the favicon as a URL.
@@ -80,21 +113,22 @@ func iconHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	stat, err := os.Stat(longname)
-	if err != nil {
-		log.Printf("Couldn't stat icon to send ETag header: %v\n", err.Error())
+	var modtime time.Time
+	if stat, err := os.Stat(longname); err == nil {
+		modtime = stat.ModTime()
+	} else {
+		log.Printf("Couldn't stat icon to send Last-Modified header: %v\n", err.Error())
 	}
 
-	etag := fmt.Sprintf("%x", sha256.Sum256([]byte(stat.ModTime().String())))
-
-	w.Header().Set("ETag", "\""+etag+"\"")
+	if notModified(w, r, contentETag(icon), modtime) {
+		return
+	}
 	w.Header().Set("Content-Type", http.DetectContentType(icon))
-	_, err = w.Write(icon)
+	err = writeBody(w, r, icon)
 	if err != nil {
 		log500(w, r, err)
 		return
 	}
-	log200(r)
 }
 
 // Serves the local css file as a url.
@@ -124,19 +158,20 @@ func cssHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	stat, err := os.Stat(cssPath)
-	if err != nil {
-		log.Printf("Couldn't stat CSS file to send ETag header: %v\n", err.Error())
+	var modtime time.Time
+	if stat, err := os.Stat(cssPath); err == nil {
+		modtime = stat.ModTime()
+	} else {
+		log.Printf("Couldn't stat CSS file to send Last-Modified header: %v\n", err.Error())
 	}
 
-	etag := fmt.Sprintf("%x", sha256.Sum256([]byte(stat.ModTime().String())))
-
-	w.Header().Set("ETag", "\""+etag+"\"")
+	if notModified(w, r, contentETag(css), modtime) {
+		return
+	}
 	w.Header().Set("Content-Type", cssutf8)
-	_, err = w.Write(css)
+	err = writeBody(w, r, css)
 	if err != nil {
 		log500(w, r, err)
 		return
 	}
-	log200(r)
 }
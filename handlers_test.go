@@ -3,8 +3,14 @@ package main
 import (
 	"bytes"
 	"io/ioutil"
+	"log"
+	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
 )
 
 // This is a pretty strict test. Make sure the
@@ -111,8 +117,8 @@ func Test_cssHandler(t *testing.T) {
 	})
 }
 
-// Tests if /500 returns a status 200, which means
-// the handler is working. Doesn't test for 500-triggering
+// Tests if /500 returns a status 500 with the
+// custom page. Doesn't test for 500-triggering
 // situations yet.
 func Test_error500(t *testing.T) {
 	name := "Error 500 Handler Test"
@@ -122,15 +128,15 @@ func Test_error500(t *testing.T) {
 	t.Run(name, func(t *testing.T) {
 		error500(w, r)
 		resp := w.Result()
-		if resp.StatusCode != 200 {
+		if resp.StatusCode != http.StatusInternalServerError || resp.Header.Get("Content-Type") != htmlutf8 {
 			t.Errorf("error500(): %v\n", resp.StatusCode)
 		}
 	})
 }
 
-// Tests for a 200 status code because it serves requests
-// that fail the regex path validation, rather than a traditional
-// 404 status code.
+// Tests for a 404 status code with the custom page,
+// as served for requests that fail the regex path
+// validation.
 func Test_error404(t *testing.T) {
 	name := "Error 404 Handler Test"
 	initConfigParams()
@@ -139,8 +145,133 @@ func Test_error404(t *testing.T) {
 	t.Run(name, func(t *testing.T) {
 		error404(w, r)
 		resp := w.Result()
-		if resp.StatusCode != 200 {
+		if resp.StatusCode != http.StatusNotFound || resp.Header.Get("Content-Type") != htmlutf8 {
 			t.Errorf("error404(): %v\n", resp.StatusCode)
 		}
 	})
 }
+
+// Revalidates a page with each kind of conditional
+// header and checks for a 304 without a body
+func Test_pageHandler_conditional(t *testing.T) {
+	initConfigParams()
+	log.SetOutput(hush)
+	genPageCache()
+
+	page, err := freshPage("example.md")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	lastmod := page.LastMod.UTC().Format(http.TimeFormat)
+	older := page.LastMod.Add(-time.Hour).UTC().Format(http.TimeFormat)
+
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		want   int
+	}{
+		{"no validators", "", "", 200},
+		{"matching etag", "If-None-Match", "\"" + page.ETag + "\"", 304},
+		{"weak etag in a list", "If-None-Match", "\"nope\", W/\"" + page.ETag + "\"", 304},
+		{"wildcard", "If-None-Match", "*", 304},
+		{"stale etag", "If-None-Match", "\"nope\"", 200},
+		{"same time", "If-Modified-Since", lastmod, 304},
+		{"older time", "If-Modified-Since", older, 200},
+		{"bad time", "If-Modified-Since", "yesterday", 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "localhost:8080/w/example", nil)
+			if tt.header != "" {
+				r.Header.Set(tt.header, tt.value)
+			}
+			r = mux.SetURLVars(r, map[string]string{"pageReq": "example"})
+			pageHandler(w, r)
+
+			if w.Code != tt.want {
+				t.Errorf("pageHandler(): got %v, want %v\n", w.Code, tt.want)
+			}
+			if w.Header().Get("ETag") != "\""+page.ETag+"\"" || w.Header().Get("Last-Modified") != lastmod {
+				t.Errorf("pageHandler(): missing validators: %v\n", w.Header())
+			}
+			if w.Header().Get("Cache-Control") == "" {
+				t.Errorf("pageHandler(): missing Cache-Control\n")
+			}
+			if tt.want == 304 && w.Body.Len() != 0 {
+				t.Errorf("pageHandler(): 304 with a body\n")
+			}
+		})
+	}
+}
+
+// HEAD gets the headers of a GET without the body
+func Test_pageHandler_head(t *testing.T) {
+	initConfigParams()
+	log.SetOutput(hush)
+	genPageCache()
+
+	page, err := freshPage("example.md")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("HEAD", "localhost:8080/w/example", nil)
+	r = mux.SetURLVars(r, map[string]string{"pageReq": "example"})
+	pageHandler(w, r)
+
+	if w.Code != 200 || w.Body.Len() != 0 {
+		t.Errorf("pageHandler(): HEAD got %v with %v bytes\n", w.Code, w.Body.Len())
+	}
+	if w.Header().Get("Content-Length") != strconv.Itoa(len(page.Body)) {
+		t.Errorf("pageHandler(): HEAD Content-Length %v, want %v\n", w.Header().Get("Content-Length"), len(page.Body))
+	}
+}
+
+// Make sure the index and icon revalidate too
+func Test_notModified_assets(t *testing.T) {
+	initConfigParams()
+	log.SetOutput(hush)
+
+	for name, handler := range map[string]http.HandlerFunc{"/": indexHandler, "/icon": iconHandler} {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "localhost:8080"+name, nil))
+		etag := w.Header().Get("ETag")
+		if etag == "" || w.Header().Get("Last-Modified") == "" {
+			t.Errorf("%v: missing validators\n", name)
+			continue
+		}
+
+		w = httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "localhost:8080"+name, nil)
+		r.Header.Set("If-None-Match", etag)
+		handler(w, r)
+		if w.Code != 304 {
+			t.Errorf("%v: got %v, want 304\n", name, w.Code)
+		}
+	}
+}
+
+// A page only counts as modified when
+// its rendered content changes
+func Test_lastModified(t *testing.T) {
+	modtime := time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC)
+	later := modtime.Add(time.Hour)
+	page := &Page{Modtime: modtime, ETag: "new"}
+
+	if got := lastModified(&Page{}, page); !got.Equal(modtime) {
+		t.Errorf("lastModified(): first render got %v\n", got)
+	}
+	if got := lastModified(&Page{ETag: "new", LastMod: later}, page); !got.Equal(later) {
+		t.Errorf("lastModified(): unchanged render got %v\n", got)
+	}
+	if got := lastModified(&Page{ETag: "old", LastMod: modtime}, page); !got.After(later) {
+		t.Errorf("lastModified(): changed render got %v\n", got)
+	}
+	if got := lastModified(&Page{ETag: "old", LastMod: modtime.Add(-time.Hour)}, page); !got.Equal(modtime) {
+		t.Errorf("lastModified(): edited file got %v\n", got)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/chroma"
+	chromahtml "github.com/alecthomas/chroma/formatters/html"
+	"github.com/alecthomas/chroma/lexers"
+	"github.com/alecthomas/chroma/styles"
+)
+
+// Route serving the highlighting theme, next to /css
+const highlightCSSPath = "/css/highlight"
+
+// Highlighted code is marked up with CSS classes
+// rather than inline styles, so the theme can be
+// changed without re-rendering every page
+var highlighter = chromahtml.New(chromahtml.WithClasses(), chromahtml.TabWidth(4))
+
+// Returns true if fenced code blocks are highlighted
+func highlightEnabled() bool {
+	confVars.mu.RLock()
+	defer confVars.mu.RUnlock()
+	return confVars.syntaxHighlight
+}
+
+// Returns the configured highlighting theme, falling
+// back to chroma's default for unknown names. Those
+// are logged when the config is loaded.
+func highlightStyle() *chroma.Style {
+	confVars.mu.RLock()
+	name := confVars.highlightStyle
+	confVars.mu.RUnlock()
+	return styles.Get(name)
+}
+
+// Returns true if chroma has a theme by this name.
+// An empty name quietly uses the default.
+func knownHighlightStyle(name string) bool {
+	if name == "" {
+		return true
+	}
+	_, ok := styles.Registry[name]
+	return ok
+}
+
+// Writes a fenced code block with syntax highlighting.
+// The language is the first word of the block's info
+// string. Returns false, having written nothing, if
+// the language isn't known so the block can be
+// rendered plain.
+func highlightCode(w io.Writer, info, code []byte) bool {
+	fields := strings.Fields(string(info))
+	if len(fields) == 0 {
+		return false
+	}
+	lexer := lexers.Get(fields[0])
+	if lexer == nil {
+		return false
+	}
+
+	tokens, err := chroma.Coalesce(lexer).Tokenise(nil, string(code))
+	if err != nil {
+		log.Printf("Couldn't highlight %v code: %v\n", fields[0], err.Error())
+		return false
+	}
+	// the classes don't depend on the style
+	buf := bytes.NewBuffer(nil)
+	if err := highlighter.Format(buf, styles.Fallback, tokens); err != nil {
+		log.Printf("Couldn't highlight %v code: %v\n", fields[0], err.Error())
+		return false
+	}
+	_, err = w.Write(buf.Bytes())
+	return err == nil
+}
+
+// Generates the stylesheet for the highlighting theme
+func highlightCSS() ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	if err := highlighter.WriteCSS(buf, highlightStyle()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Serves the stylesheet for the highlighting theme
+func highlightCSSHandler(w http.ResponseWriter, r *http.Request) {
+	if !highlightEnabled() {
+		error404(w, r)
+		return
+	}
+
+	css, err := highlightCSS()
+	if err != nil {
+		log500(w, r, err)
+		return
+	}
+
+	if notModified(w, r, contentETag(css), time.Time{}) {
+		return
+	}
+	w.Header().Set("Content-Type", cssutf8)
+	if err := writeBody(w, r, css); err != nil {
+		log500(w, r, err)
+		return
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var codeDoc = []byte("# Code\n\n```go\nfunc main() {}\n```\n\n```nosuchlang\n<b>plain</b>\n```\n\n    indented\n")
+
+func Test_renderMarkdown_highlight(t *testing.T) {
+	initConfigParams()
+	confVars.mu.Lock()
+	confVars.syntaxHighlight = true
+	confVars.mu.Unlock()
+
+	out := renderMarkdown(codeDoc, false, false)
+	for _, want := range []string{
+		`<pre class="chroma">`,
+		`<span class="kd">func</span>`,
+		"<code class=\"language-nosuchlang\">&lt;b&gt;plain&lt;/b&gt;\n</code>",
+		"<pre><code>indented\n</code></pre>",
+	} {
+		if !bytes.Contains(out, []byte(want)) {
+			t.Errorf("renderMarkdown(): missing %q in:\n%s\n", want, out)
+		}
+	}
+
+	confVars.mu.Lock()
+	confVars.syntaxHighlight = false
+	confVars.mu.Unlock()
+
+	if out := renderMarkdown(codeDoc, false, false); bytes.Contains(out, []byte("chroma")) {
+		t.Errorf("renderMarkdown(): highlighted with SyntaxHighlight off:\n%s\n", out)
+	}
+}
+
+func Test_highlightCSSHandler(t *testing.T) {
+	initConfigParams()
+
+	w := httptest.NewRecorder()
+	highlightCSSHandler(w, httptest.NewRequest("GET", highlightCSSPath, nil))
+	if w.Code == http.StatusOK && strings.Contains(w.Body.String(), ".chroma") {
+		t.Errorf("highlightCSSHandler(): served the stylesheet with SyntaxHighlight off\n")
+	}
+
+	confVars.mu.Lock()
+	confVars.syntaxHighlight = true
+	confVars.mu.Unlock()
+	defer func() {
+		confVars.mu.Lock()
+		confVars.syntaxHighlight = false
+		confVars.mu.Unlock()
+	}()
+
+	w = httptest.NewRecorder()
+	highlightCSSHandler(w, httptest.NewRequest("GET", highlightCSSPath, nil))
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/css") {
+		t.Fatalf("highlightCSSHandler(): got %v %v\n", w.Code, w.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(w.Body.String(), ".chroma .kd") {
+		t.Errorf("highlightCSSHandler(): no token classes in:\n%s\n", w.Body.String())
+	}
+
+	etag := w.Header().Get("ETag")
+	r := httptest.NewRequest("GET", highlightCSSPath, nil)
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	highlightCSSHandler(w, r)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("highlightCSSHandler(): got %v for a current ETag\n", w.Code)
+	}
+}
+
+func Test_knownHighlightStyle(t *testing.T) {
+	for name, want := range map[string]bool{"github": true, "": true, "no-such-style": false} {
+		if got := knownHighlightStyle(name); got != want {
+			t.Errorf("knownHighlightStyle(%q) = %v, want %v\n", name, got, want)
+		}
+	}
+}
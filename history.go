@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Identity used for commits to the page history
+const gitIdent = "TildeWiki <tildewiki@localhost>"
+
+// Format used when displaying revision times
+const revTimeFormat = "2006-01-02 15:04 MST"
+
+// Serializes access to the page directory's
+// git repository. git takes a lock on the index
+// and fails if two commands touch it at once.
+var gitMu sync.Mutex
+
+// Validates revision hashes passed in URLs
+var validRev = regexp.MustCompile("^[0-9a-f]{7,40}$")
+
+// A single entry in a page's history
+type revision struct {
+	Hash    string
+	Author  string
+	Time    time.Time
+	Subject string
+}
+
+// Runs git in the page directory, returning stdout.
+// The committer identity is always set so commits
+// work on hosts without a global git config. The
+// repository is pinned to the one in the directory,
+// so git never falls back to a repository enclosing
+// it, such as a checkout of TildeWiki itself.
+func runGit(dir string, args ...string) ([]byte, error) {
+	name, email := splitIdent(gitIdent)
+	sub := args[0]
+	args = append([]string{"-C", dir, "--git-dir=.git", "--work-tree=.", "-c", "user.name=" + name, "-c", "user.email=" + email}, args...)
+	cmd := exec.Command("git", args...)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return out, fmt.Errorf("git %v: %v: %v", sub, err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// Splits "Name <email>" into its parts
+func splitIdent(ident string) (string, string) {
+	i := strings.Index(ident, "<")
+	if i < 0 {
+		return strings.TrimSpace(ident), ""
+	}
+	return strings.TrimSpace(ident[:i]), strings.Trim(ident[i:], "<> ")
+}
+
+// Returns true once the page directory has
+// its own history repository
+func repoExists(dir string) bool {
+	_, err := os.Stat(dir + "/.git")
+	return err == nil
+}
+
+// Creates a git repository in the page directory
+// if there isn't one already, committing the pages
+// already there so their original text is kept.
+// Called with gitMu held.
+func ensureRepo(dir string) error {
+	if repoExists(dir) {
+		return nil
+	}
+	log.Printf("**NOTICE** Initializing page history repository in %v\n", dir)
+	if _, err := runGit(dir, "init", "-q"); err != nil {
+		return err
+	}
+
+	names, err := walkPages(dir)
+	if err != nil || len(names) == 0 {
+		return err
+	}
+	if _, err := runGit(dir, append([]string{"add", "--all", "--"}, names...)...); err != nil {
+		return err
+	}
+	_, err = runGit(dir, "commit", "-q", "--author", gitIdent, "-m", "Record existing pages")
+	return err
+}
+
+// Creates the history repository when history is
+// on, before any page can change. Called at startup
+// and when the config is reloaded.
+func initHistory() {
+	if !historyEnabled() {
+		return
+	}
+	confVars.mu.RLock()
+	pageDir := confVars.pageDir
+	confVars.mu.RUnlock()
+
+	gitMu.Lock()
+	defer gitMu.Unlock()
+	if err := ensureRepo(pageDir); err != nil {
+		log.Printf("Couldn't set up page history in %v: %v\n", pageDir, err.Error())
+	}
+}
+
+// Splits a page's path into the directory holding
+// the history repository and the page's path within
+// it. The repository lives at the top of PageDir,
+// so pages in subdirectories share it.
+func repoPath(longname string) (string, string) {
+	confVars.mu.RLock()
+	pageDir := confVars.pageDir
+	confVars.mu.RUnlock()
+
+	if rel, err := filepath.Rel(pageDir, longname); err == nil && !strings.HasPrefix(rel, "..") {
+		return pageDir, filepath.ToSlash(rel)
+	}
+	dir, file := filepath.Split(longname)
+	if dir == "" {
+		dir = "."
+	}
+	return dir, file
+}
+
+// Commits the current state of a page if it differs
+// from the last commit. author may be empty, in which
+// case the commit is attributed to TildeWiki.
+func commitPage(longname, author, msg string) error {
+	gitMu.Lock()
+	defer gitMu.Unlock()
+	return commitLocked(longname, author, msg)
+}
+
+// Writes a page from the browser and, with history
+// on, commits it in the same step, so the file
+// watcher can't commit it first under TildeWiki's
+// name. A failed commit is only logged.
+func savePage(longname string, body []byte, author, msg string) error {
+	if !historyEnabled() {
+		return writePage(longname, body)
+	}
+
+	gitMu.Lock()
+	defer gitMu.Unlock()
+	if err := writePage(longname, body); err != nil {
+		return err
+	}
+	if err := commitLocked(longname, author, msg); err != nil {
+		log.Printf("Couldn't commit %v to history: %v\n", longname, err.Error())
+	}
+	return nil
+}
+
+// Records a change to a page made on disk. Called
+// by the file watcher; pages saved from the browser
+// are committed when they're written.
+func recordChange(pageDir, name, msg string) {
+	if !historyEnabled() || isUserPage(name) {
+		return
+	}
+	if err := commitPage(pageDir+"/"+name, "", msg); err != nil {
+		log.Printf("Couldn't commit %v to history: %v\n", name, err.Error())
+	}
+}
+
+// Does the work of commitPage(). Called with gitMu held.
+func commitLocked(longname, author, msg string) error {
+	dir, file := repoPath(longname)
+	if author == "" {
+		author = gitIdent
+	}
+
+	if err := ensureRepo(dir); err != nil {
+		return err
+	}
+
+	// --all so a deleted page is recorded as well
+	if _, err := runGit(dir, "add", "--all", "--", file); err != nil {
+		return err
+	}
+
+	// nothing staged means nothing changed since
+	// the last commit, so there's nothing to do
+	if out, err := runGit(dir, "diff", "--cached", "--name-only", "--", file); err != nil || len(bytes.TrimSpace(out)) == 0 {
+		return err
+	}
+
+	_, err := runGit(dir, "commit", "-q", "--author", author, "-m", msg, "--", file)
+	return err
+}
+
+// Returns the revisions of a page, newest first.
+func pageHistory(longname string) ([]revision, error) {
+	return gitLog(longname)
+}
+
+// Returns the most recent revision of a page. The
+// second value is false if it has never been committed.
+func lastRevision(longname string) (revision, bool, error) {
+	revs, err := gitLog(longname, "-1")
+	if err != nil || len(revs) == 0 {
+		return revision{}, false, err
+	}
+	return revs[0], true, nil
+}
+
+// Reads a page's revisions from git log, newest
+// first. Reading the log doesn't touch the index,
+// so it doesn't wait on gitMu.
+func gitLog(longname string, args ...string) ([]revision, error) {
+	dir, file := repoPath(longname)
+	if !repoExists(dir) {
+		return nil, nil
+	}
+	args = append(append([]string{"log", "--format=%H%x1f%an%x1f%at%x1f%s"}, args...), "--", file)
+	out, err := runGit(dir, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	revs := make([]revision, 0)
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Split(line, "\x1f")
+		if len(fields) != 4 {
+			continue
+		}
+		stamp, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			log.Printf("Bad timestamp in history of %v: %v\n", longname, err.Error())
+		}
+		revs = append(revs, revision{
+			Hash:    fields[0],
+			Author:  fields[1],
+			Time:    time.Unix(stamp, 0),
+			Subject: fields[3],
+		})
+	}
+	return revs, nil
+}
+
+// Returns the contents of a page at a given revision
+func pageAtRevision(longname, rev string) (pagedata, error) {
+	if !validRev.MatchString(rev) {
+		return nil, errors.New("invalid revision " + rev)
+	}
+	dir, file := repoPath(longname)
+
+	gitMu.Lock()
+	defer gitMu.Unlock()
+	return runGit(dir, "show", rev+":./"+file)
+}
+
+// Fills in the revision fields of a page from the
+// most recent commit touching it. Only reads the
+// history: changes are committed when they're saved
+// or seen by the file watcher, not when rendering.
+func (page *Page) setRevision() {
+	rev, ok, err := lastRevision(page.Longname)
+	if err != nil {
+		log.Printf("Couldn't read history of %v: %v\n", page.Shortname, err.Error())
+		return
+	}
+	if !ok {
+		return
+	}
+
+	page.Revision = rev.Hash
+	page.RevAuthor = rev.Author
+	page.RevTime = rev.Time
+}
+
+// Markdown appended to a page when history is
+// enabled, showing its current revision
+func revisionFooter(name, rev, author string, revtime time.Time) []byte {
+	if rev == "" {
+		return nil
+	}
+	return []byte(fmt.Sprintf("\n\n---\n\n*Revision [`%v`](/history/%v) by %v, %v*\n",
+		rev[:7], name, author, revtime.Format(revTimeFormat)))
+}
+
+// Returns whether git history is switched on
+func historyEnabled() bool {
+	confVars.mu.RLock()
+	defer confVars.mu.RUnlock()
+	return confVars.gitHistory
+}
+
+// Lists the revisions of a page
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	if !historyEnabled() {
+		error404(w, r)
+		return
+	}
+
+	name := mux.Vars(r)["pageReq"]
+	confVars.mu.RLock()
+	longname := confVars.pageDir + "/" + name + ".md"
+	viewPath := confVars.viewPath
+	title := "History of " + name + " " + confVars.titleSep + " " + confVars.wikiName
+	confVars.mu.RUnlock()
+
+	revs, err := pageHistory(longname)
+	if err != nil {
+		log500(w, r, err)
+		return
+	}
+	if len(revs) == 0 {
+		error404(w, r)
+		return
+	}
+
+	buf := bytes.NewBuffer(nil)
+	buf.WriteString("# History of [" + name + "](" + viewPath + name + ")\n\n")
+	for _, rev := range revs {
+		buf.WriteString(fmt.Sprintf("* [`%v`](/history/%v/%v) %v :: %v :: %v\n",
+			rev.Hash[:7], name, rev.Hash, rev.Time.Format(revTimeFormat), rev.Author, rev.Subject))
+	}
+
+	w.Header().Set("Content-Type", htmlutf8)
+	w.Header().Set("Cache-Control", "no-cache")
+	if _, err := w.Write(render(buf.Bytes(), title)); err != nil {
+		log500(w, r, err)
+		return
+	}
+}
+
+// Renders a page as it was at an old revision
+func revisionHandler(w http.ResponseWriter, r *http.Request) {
+	if !historyEnabled() {
+		error404(w, r)
+		return
+	}
+
+	vars := mux.Vars(r)
+	name := vars["pageReq"]
+	rev := vars["rev"]
+	confVars.mu.RLock()
+	longname := confVars.pageDir + "/" + name + ".md"
+	titleSep := confVars.titleSep
+	wikiName := confVars.wikiName
+	confVars.mu.RUnlock()
+
+	raw, err := pageAtRevision(longname, rev)
+	if err != nil {
+		log.Printf("%v\n", err.Error())
+		error404(w, r)
+		return
+	}
+
+	title, _, _ := raw.getMeta()
+	if title == "" {
+		title = name
+	}
+
+	buf := bytes.NewBuffer(nil)
+	buf.WriteString("*Viewing revision `" + rev + "` of [" + name + "](/history/" + name + ")*\n\n")
+	if editEnabled() {
+		buf.WriteString("<form method=\"post\" action=\"/revert/" + name + "/" + rev + "\"><input type=\"hidden\" name=\"" + csrfField + "\" value=\"" + csrfToken(w, r) + "\"><input type=\"submit\" value=\"Revert to this revision\"></form>\n\n")
+	}
+
+	// old revisions may hold HTML that has since been
+	// removed from the page, so none of it is rendered
+	content := append(renderFragment(buf.Bytes()), renderMarkdown(raw, false, true)...)
+
+	w.Header().Set("Content-Type", htmlutf8)
+	if _, err := w.Write(applyLayout(newLayoutData(title+" ("+rev+") "+titleSep+" "+wikiName, content))); err != nil {
+		log500(w, r, err)
+		return
+	}
+}
+
+// Restores a page to an old revision, recording
+// the revert as a new commit
+func revertHandler(w http.ResponseWriter, r *http.Request) {
+	confVars.mu.RLock()
+	pageDir := confVars.pageDir
+	viewPath := confVars.viewPath
+	confVars.mu.RUnlock()
+
+	if !historyEnabled() || !editEnabled() {
+		error404(w, r)
+		return
+	}
+	if !requireSignIn(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !checkCSRF(r) {
+		csrfRejected(w)
+		return
+	}
+
+	vars := mux.Vars(r)
+	name := vars["pageReq"]
+	rev := vars["rev"]
+	filename := name + ".md"
+	longname := pageDir + "/" + filename
+
+	raw, err := pageAtRevision(longname, rev)
+	if err != nil {
+		log.Printf("%v\n", err.Error())
+		error404(w, r)
+		return
+	}
+
+	if err := savePage(longname, raw, editAuthor(r), "Revert "+filename+" to "+rev); err != nil {
+		log500(w, r, err)
+		return
+	}
+
+	invalidatePage(longname, filename)
+
+	log.Printf("**NOTICE** Page %v reverted to %v by %v\n", filename, rev, getIPfromCtx(r.Context()))
+	http.Redirect(w, r, viewPath+name, http.StatusSeeOther)
+}
+
+// Author recorded for changes made from the browser
+func editAuthor(r *http.Request) string {
+	if user := requestUser(r); user != "" {
+		return user + " <" + user + "@localhost>"
+	}
+	return "Web edit from " + getIPfromCtx(r.Context()).String() + " <tildewiki@localhost>"
+}
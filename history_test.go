@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// Commits two versions of a page, then makes sure
+// both show up in the history and the old one
+// can be retrieved
+func Test_pageHistory(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skipf("git not installed, skipping history tests ...\n")
+	}
+	log.SetOutput(hush)
+
+	dir, err := ioutil.TempDir("", "tildewiki-test")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	longname := dir + "/history.md"
+	first := []byte("# first\n")
+	second := []byte("# second\n")
+
+	if err := writePage(longname, first); err != nil {
+		t.Fatalf("writePage(): %v\n", err)
+	}
+	if err := commitPage(longname, "", "first"); err != nil {
+		t.Fatalf("commitPage(): %v\n", err)
+	}
+
+	// committing an unchanged page shouldn't
+	// create an empty commit
+	if err := commitPage(longname, "", "unchanged"); err != nil {
+		t.Errorf("commitPage(): unchanged page: %v\n", err)
+	}
+
+	if err := writePage(longname, second); err != nil {
+		t.Fatalf("writePage(): %v\n", err)
+	}
+	if err := commitPage(longname, "Someone <someone@localhost>", "second"); err != nil {
+		t.Fatalf("commitPage(): %v\n", err)
+	}
+
+	revs, err := pageHistory(longname)
+	if err != nil {
+		t.Fatalf("pageHistory(): %v\n", err)
+	}
+	if len(revs) != 2 {
+		t.Fatalf("pageHistory(): got %v revisions, want 2\n", len(revs))
+	}
+	if revs[0].Subject != "second" || revs[0].Author != "Someone" {
+		t.Errorf("pageHistory(): newest revision is %v by %v\n", revs[0].Subject, revs[0].Author)
+	}
+
+	old, err := pageAtRevision(longname, revs[1].Hash)
+	if err != nil || !bytes.Equal(old, first) {
+		t.Errorf("pageAtRevision(): got %q, %v\n", old, err)
+	}
+
+	if _, err := pageAtRevision(longname, "HEAD; rm -rf /"); err == nil {
+		t.Errorf("pageAtRevision(): accepted an invalid revision\n")
+	}
+}
+
+// Pages already on disk are committed when history
+// is set up, so their original text can be restored
+func Test_initHistory(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skipf("git not installed, skipping history tests ...\n")
+	}
+	initConfigParams()
+	log.SetOutput(hush)
+
+	dir, err := ioutil.TempDir("", "tildewiki-test")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	original := []byte("# original\n")
+	longname := dir + "/sub/existing.md"
+	os.Mkdir(dir+"/sub", 0755)
+	if err := writePage(longname, original); err != nil {
+		t.Fatalf("writePage(): %v\n", err)
+	}
+
+	confVars.mu.Lock()
+	oldDir := confVars.pageDir
+	confVars.pageDir = dir
+	confVars.gitHistory = true
+	confVars.mu.Unlock()
+	defer func() {
+		confVars.mu.Lock()
+		confVars.pageDir = oldDir
+		confVars.gitHistory = false
+		confVars.mu.Unlock()
+	}()
+
+	initHistory()
+	if err := savePage(longname, []byte("# edited\n"), "", "edit"); err != nil {
+		t.Fatalf("savePage(): %v\n", err)
+	}
+
+	revs, err := pageHistory(longname)
+	if err != nil || len(revs) != 2 {
+		t.Fatalf("pageHistory(): got %v, %v\n", revs, err)
+	}
+	if old, err := pageAtRevision(longname, revs[1].Hash); err != nil || !bytes.Equal(old, original) {
+		t.Errorf("pageAtRevision(): got %q, %v, want the original text\n", old, err)
+	}
+}
+
+// Until the page directory has its own repository,
+// there's no history, even inside another repository
+func Test_pageHistory_noRepo(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skipf("git not installed, skipping history tests ...\n")
+	}
+	log.SetOutput(hush)
+
+	outer, err := ioutil.TempDir("", "tildewiki-test")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v\n", err)
+	}
+	defer os.RemoveAll(outer)
+
+	dir := outer + "/pages"
+	os.Mkdir(dir, 0755)
+	longname := dir + "/enclosed.md"
+	if err := writePage(longname, []byte("# enclosed\n")); err != nil {
+		t.Fatalf("writePage(): %v\n", err)
+	}
+	if _, err := runGit(outer, "init", "-q"); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if _, err := runGit(outer, "add", "--all"); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if _, err := runGit(outer, "commit", "-q", "-m", "outer"); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	head, err := runGit(outer, "rev-parse", "HEAD")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	if revs, err := pageHistory(longname); err != nil || len(revs) != 0 {
+		t.Errorf("pageHistory(): got %v, %v from the enclosing repository\n", revs, err)
+	}
+	if _, err := pageAtRevision(longname, string(bytes.TrimSpace(head))); err == nil {
+		t.Errorf("pageAtRevision(): read from the enclosing repository\n")
+	}
+}
+
+// Make sure HTML committed in an old revision
+// isn't served from the history
+func Test_revisionHandler_html(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skipf("git not installed, skipping history tests ...\n")
+	}
+	initConfigParams()
+	log.SetOutput(hush)
+
+	dir, err := ioutil.TempDir("", "tildewiki-test")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	longname := dir + "/defaced.md"
+	if err := writePage(longname, []byte("# Defaced\n\n<script>alert(1)</script>\n\nstill [[here]]\n")); err != nil {
+		t.Fatalf("writePage(): %v\n", err)
+	}
+	if err := commitPage(longname, "", "deface"); err != nil {
+		t.Fatalf("commitPage(): %v\n", err)
+	}
+	revs, err := pageHistory(longname)
+	if err != nil || len(revs) != 1 {
+		t.Fatalf("pageHistory(): %v, %v\n", revs, err)
+	}
+
+	confVars.mu.Lock()
+	oldDir := confVars.pageDir
+	confVars.pageDir = dir
+	confVars.gitHistory = true
+	confVars.mu.Unlock()
+	defer func() {
+		confVars.mu.Lock()
+		confVars.pageDir = oldDir
+		confVars.gitHistory = false
+		confVars.mu.Unlock()
+	}()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/history/defaced/"+revs[0].Hash, nil)
+	r = mux.SetURLVars(r, map[string]string{"pageReq": "defaced", "rev": revs[0].Hash})
+	revisionHandler(w, r)
+	body := w.Body.String()
+	if strings.Contains(body, "<script>alert") {
+		t.Errorf("revisionHandler(): served the revision's HTML:\n%s\n", body)
+	}
+	if !strings.Contains(body, "Viewing revision") || !strings.Contains(body, `class="wikilink`) {
+		t.Errorf("revisionHandler(): revision not rendered:\n%s\n", body)
+	}
+}
+
+// Make sure rendering only reads the history,
+// while the watcher records changes made on disk
+func Test_setRevision_readOnly(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skipf("git not installed, skipping history tests ...\n")
+	}
+	initConfigParams()
+	log.SetOutput(hush)
+
+	dir, err := ioutil.TempDir("", "tildewiki-test")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	confVars.mu.Lock()
+	oldDir := confVars.pageDir
+	confVars.pageDir = dir
+	confVars.gitHistory = true
+	confVars.mu.Unlock()
+	defer func() {
+		confVars.mu.Lock()
+		confVars.pageDir = oldDir
+		confVars.gitHistory = false
+		confVars.mu.Unlock()
+	}()
+
+	longname := dir + "/quiet.md"
+	if err := writePage(longname, []byte("# quiet\n")); err != nil {
+		t.Fatalf("writePage(): %v\n", err)
+	}
+	if err := commitPage(longname, "", "first"); err != nil {
+		t.Fatalf("commitPage(): %v\n", err)
+	}
+	if err := writePage(longname, []byte("# changed\n")); err != nil {
+		t.Fatalf("writePage(): %v\n", err)
+	}
+
+	page, err := buildPage(longname)
+	if err != nil {
+		t.Fatalf("buildPage(): %v\n", err)
+	}
+	revs, err := pageHistory(longname)
+	if err != nil || len(revs) != 1 {
+		t.Fatalf("buildPage(): rendering committed: %v revisions, %v\n", len(revs), err)
+	}
+	if page.Revision != revs[0].Hash {
+		t.Errorf("buildPage(): revision %q, want %q\n", page.Revision, revs[0].Hash)
+	}
+
+	recordChange(dir, "quiet.md", "Update quiet.md")
+	if revs, err := pageHistory(longname); err != nil || len(revs) != 2 || revs[0].Subject != "Update quiet.md" {
+		t.Errorf("recordChange(): got %v, %v\n", revs, err)
+	}
+}
+
+var splitIdentCases = []struct {
+	ident string
+	name  string
+	email string
+}{
+	{
+		ident: "TildeWiki <tildewiki@localhost>",
+		name:  "TildeWiki",
+		email: "tildewiki@localhost",
+	},
+	{
+		ident: "nobody",
+		name:  "nobody",
+		email: "",
+	},
+}
+
+func Test_splitIdent(t *testing.T) {
+	for _, tt := range splitIdentCases {
+		t.Run(tt.ident, func(t *testing.T) {
+			if name, email := splitIdent(tt.ident); name != tt.name || email != tt.email {
+				t.Errorf("splitIdent() = %v, %v .. want %v, %v", name, email, tt.name, tt.email)
+			}
+		})
+	}
+}
@@ -2,12 +2,17 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/gorilla/handlers"
 )
 
 // Attach requester's IP address to context value
@@ -34,6 +39,44 @@ func getIPfromCtx(ctx context.Context) net.IP {
 	return net.ParseIP(uip)
 }
 
+// Records the status a handler responds with
+// and how many bytes of body it writes
+type responseRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(p []byte) (int, error) {
+	n, err := rec.ResponseWriter.Write(p)
+	rec.written += int64(n)
+	return n, err
+}
+
+// Compresses responses to GET requests. HEAD requests
+// skip compression: there's no body to compress, and
+// the empty gzip stream would otherwise be reported
+// as the Content-Length.
+func compressMiddleware(hop http.Handler) http.Handler {
+	compressed := handlers.CompressHandler(hop)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			hop.ServeHTTP(w, r)
+			return
+		}
+		compressed.ServeHTTP(w, r)
+	})
+}
+
 func ipMiddleware(hop http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := newCtxUserIP(r.Context(), r)
@@ -41,12 +84,6 @@ func ipMiddleware(hop http.Handler) http.Handler {
 	})
 }
 
-func log200(r *http.Request) {
-	useragent := r.Header["User-Agent"]
-	uip := getIPfromCtx(r.Context())
-	log.Printf("**** %v :: 200 :: %v %v :: %v\n", uip, r.Method, r.URL, useragent)
-}
-
 // wrapper for testing 500 pages via /500
 func error500(w http.ResponseWriter, r *http.Request) {
 	log500(w, r, fmt.Errorf("500 Page Accessed Directly, No Error"))
@@ -55,11 +92,11 @@ func error500(w http.ResponseWriter, r *http.Request) {
 // this is a custom 500 page using a markdown doc
 // in the assets directory.
 // if the markdown doc can't be read, default to
-// net/http's error handling
+// net/http's error handling. the request itself is
+// recorded in the access log; the error goes to
+// the error log.
 func log500(w http.ResponseWriter, r *http.Request, topErr error) {
-	useragent := r.Header["User-Agent"]
-	uip := getIPfromCtx(r.Context())
-	log.Printf("**** %v :: 500 :: %v %v :: %v :: %v\n", uip, r.Method, r.URL, useragent, topErr.Error())
+	log.Printf("Error serving %v %v to %v: %v\n", r.Method, r.URL, getIPfromCtx(r.Context()), topErr.Error())
 
 	confVars.mu.RLock()
 	e500 := confVars.assetsDir + "/500.md"
@@ -73,6 +110,7 @@ func log500(w http.ResponseWriter, r *http.Request, topErr error) {
 	}
 
 	w.Header().Set("Content-Type", htmlutf8)
+	w.WriteHeader(http.StatusInternalServerError)
 	_, err = w.Write(render(file, "500: Internal Server Error"))
 	if err != nil {
 		log.Printf("Failed to write to HTTP stream: %v\n", err.Error())
@@ -97,9 +135,84 @@ func error404(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", htmlutf8)
+	w.WriteHeader(http.StatusNotFound)
 	_, err = w.Write(render(file, "404: Not Found"))
 	if err != nil {
 		log.Printf("Failed to write to HTTP stream: %v\n", err.Error())
 		error500(w, r)
 	}
 }
+
+// Computes a strong ETag from a response body
+func contentETag(body []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(body))
+}
+
+// Sets the validator and caching headers for a
+// response, then checks the request's conditional
+// headers against them. Returns true if the client's
+// copy is current, in which case a 304 has been sent.
+func notModified(w http.ResponseWriter, r *http.Request, etag string, modtime time.Time) bool {
+	confVars.mu.RLock()
+	cacheControl := confVars.cacheControl
+	confVars.mu.RUnlock()
+
+	if etag != "" {
+		w.Header().Set("ETag", "\""+etag+"\"")
+	}
+	if !modtime.IsZero() {
+		w.Header().Set("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+	}
+	if cacheControl != "" && w.Header().Get("Cache-Control") == "" {
+		w.Header().Set("Cache-Control", cacheControl)
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	// If-None-Match takes precedence when both are sent
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if !etagMatch(inm, etag) {
+			return false
+		}
+	} else if ims := r.Header.Get("If-Modified-Since"); ims != "" && !modtime.IsZero() {
+		since, err := http.ParseTime(ims)
+		if err != nil || modtime.Truncate(time.Second).After(since) {
+			return false
+		}
+	} else {
+		return false
+	}
+
+	w.Header().Del("Content-Type")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// Returns true if an If-None-Match header lists the
+// ETag, using the weak comparison RFC 7232 asks for
+func etagMatch(header, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == "\""+etag+"\"" {
+			return true
+		}
+	}
+	return false
+}
+
+// Writes a response body, leaving it out of
+// responses to HEAD requests
+func writeBody(w http.ResponseWriter, r *http.Request, body []byte) error {
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	_, err := w.Write(body)
+	return err
+}
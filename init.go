@@ -1,11 +1,14 @@
 package main
 
 import (
+	"io/ioutil"
 	"log"
-	"os"
 )
 
-func init() {
+// Sets up what only the server needs: the logo,
+// a watched config and the log files. Subcommands
+// such as export are dispatched before this runs.
+func setUpServer() {
 	// show the logo, repo link, etc
 	setUpUsTheWiki()
 
@@ -18,20 +21,12 @@ func init() {
 	filog := confVars.fileLogging
 	qlog := confVars.quietLogging
 	logfi := confVars.logFile
+	accessfi := confVars.accessLogFile
 	confVars.mu.RUnlock()
 	if filog && !qlog {
-		if llogfile, err := os.OpenFile(logfi, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600); err == nil {
+		if llogfile, err := openLogFile(logfi); err == nil {
 			log.SetOutput(llogfile)
-
-			go func() {
-				<-closelog
-				log.Printf("Closing log file ...\n")
-				err := llogfile.Close()
-				if err != nil {
-					log.Printf("Couldn't close log file: %v\n", err.Error())
-				}
-			}()
-
+			errorLog = llogfile
 		} else {
 			log.Printf("Couldn't log to file: %v\n", err.Error())
 		}
@@ -39,23 +34,18 @@ func init() {
 
 	// Tell TildeWiki to be quiet,
 	if qlog {
-		if llogfile, err := os.Open("/dev/null"); err == nil {
-			log.SetOutput(llogfile)
-
-			go func() {
-				// I don't know why I'm bothering to do this for /dev/null
-				// ...
-				// whatever
-				<-closelog
-				log.Printf("Closing log file ...\n")
-				err := llogfile.Close()
-				if err != nil {
-					log.Printf("Couldn't close log file: %v\n", err.Error())
-				}
-			}()
+		log.SetOutput(ioutil.Discard)
+		accessLog.out = ioutil.Discard
+		return
+	}
 
+	// requests go to their own log
+	if accessfi != "" {
+		if alogfile, err := openLogFile(accessfi); err == nil {
+			accessLog.out = alogfile
+			accessLog.file = alogfile
 		} else {
-			log.Printf("Couldn't quiet logging: %v\n", err.Error())
+			log.Printf("Couldn't open access log: %v\n", err.Error())
 		}
 	}
 }
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"log"
+	"time"
+)
+
+// Used when no layout file is configured, or
+// the configured one can't be loaded. Produces
+// the same document blackfriday's CompletePage
+// flag used to.
+const defaultLayout = `<!DOCTYPE html>
+<html>
+<head>
+  <title>{{.Title}}</title>
+  <meta charset="utf-8">
+  <meta name="application-name" content="TildeWiki {{.Version}} :: https://github.com/gbmor/tildewiki">
+  <meta name="viewport" content="width=device-width, initial-scale=1.0">
+  <link rel="stylesheet" type="text/css" href="{{.CSS}}">
+  {{- with .HighlightCSS}}
+  <link rel="stylesheet" type="text/css" href="{{.}}">
+  {{- end}}
+  <link rel="icon" type="image/x-icon" href="/icon">
+</head>
+<body>
+
+{{.Body}}
+</body>
+</html>
+`
+
+// Data passed to the layout template. Page is nil
+// for documents that aren't wiki pages, such as
+// the index, error pages and listings.
+type layoutData struct {
+	Title        string
+	Body         template.HTML
+	Page         *Page
+	Desc         string
+	Author       string
+	Modtime      time.Time
+	WikiName     string
+	WikiDesc     string
+	TitleSep     string
+	DescSep      string
+	ViewPath     string
+	CSS          string
+	HighlightCSS string
+	Feed         string
+	Version      string
+}
+
+// (Re-)Loads the layout template from AssetsDir.
+// If the file can't be parsed, the previously
+// loaded layout stays in use.
+func loadLayout() {
+	confVars.mu.RLock()
+	layoutFile := confVars.layoutFile
+	assetsDir := confVars.assetsDir
+	confVars.mu.RUnlock()
+
+	var tmpl *template.Template
+	var err error
+	if layoutFile == "" {
+		tmpl, err = template.New("layout").Parse(defaultLayout)
+	} else {
+		tmpl, err = template.ParseFiles(assetsDir + "/" + layoutFile)
+	}
+
+	if err != nil {
+		log.Printf("Couldn't load layout %v: %v\n", layoutFile, err.Error())
+		layoutCache.mu.Lock()
+		if layoutCache.tmpl == nil {
+			layoutCache.tmpl = template.Must(template.New("layout").Parse(defaultLayout))
+		}
+		layoutCache.mu.Unlock()
+		return
+	}
+
+	layoutCache.mu.Lock()
+	layoutCache.tmpl = tmpl
+	layoutCache.mu.Unlock()
+}
+
+// Reloads the layout and flags everything
+// rendered with the old one for re-caching
+func reloadLayout() {
+	loadLayout()
+	triggerRecache()
+	indexCache.mu.Lock()
+	indexCache.page.LastTally = time.Time{}
+	indexCache.mu.Unlock()
+	feedCache.mu.Lock()
+	feedCache.built = time.Time{}
+	feedCache.mu.Unlock()
+}
+
+// Fills in the layout data common to every document
+func newLayoutData(title string, body []byte) *layoutData {
+	confVars.mu.RLock()
+	defer confVars.mu.RUnlock()
+
+	css := confVars.cssPath
+	if cssLocal([]byte(css)) {
+		css = "/css"
+	}
+	var highlightCSS string
+	if confVars.syntaxHighlight {
+		highlightCSS = highlightCSSPath
+	}
+	// the feeds are only served with BaseURL set
+	var feed string
+	if confVars.baseURL != "" {
+		feed = "/feed.atom"
+	}
+
+	return &layoutData{
+		Title:        title,
+		Body:         template.HTML(body),
+		WikiName:     confVars.wikiName,
+		WikiDesc:     confVars.wikiDesc,
+		TitleSep:     confVars.titleSep,
+		DescSep:      confVars.descSep,
+		ViewPath:     confVars.viewPath,
+		CSS:          css,
+		HighlightCSS: highlightCSS,
+		Feed:         feed,
+		Version:      twvers,
+	}
+}
+
+// Wraps a rendered HTML fragment in the layout
+func applyLayout(data *layoutData) []byte {
+	layoutCache.mu.RLock()
+	tmpl := layoutCache.tmpl
+	layoutCache.mu.RUnlock()
+
+	if tmpl == nil {
+		loadLayout()
+		layoutCache.mu.RLock()
+		tmpl = layoutCache.tmpl
+		layoutCache.mu.RUnlock()
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := tmpl.Execute(buf, data); err != nil {
+		log.Printf("Couldn't execute layout for %v: %v\n", data.Title, err.Error())
+		return []byte(data.Body)
+	}
+	return buf.Bytes()
+}
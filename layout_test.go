@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+)
+
+// Make sure the layout wraps the title and body
+func Test_applyLayout(t *testing.T) {
+	initConfigParams()
+	log.SetOutput(hush)
+
+	out := applyLayout(newLayoutData("Layout Test", []byte("<p>layout body</p>")))
+	if !bytes.Contains(out, []byte("<title>Layout Test</title>")) {
+		t.Errorf("applyLayout(): missing title:\n%s\n", out)
+	}
+	if !bytes.Contains(out, []byte("<p>layout body</p>")) {
+		t.Errorf("applyLayout(): body was escaped or dropped:\n%s\n", out)
+	}
+}
+
+// Loads a custom layout, then checks a broken
+// one leaves it in place
+func Test_loadLayout(t *testing.T) {
+	initConfigParams()
+	log.SetOutput(hush)
+
+	dir, err := ioutil.TempDir("", "tildewiki-layout")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	confVars.mu.Lock()
+	oldDir, oldFile := confVars.assetsDir, confVars.layoutFile
+	confVars.assetsDir = dir
+	confVars.layoutFile = "test.html"
+	confVars.mu.Unlock()
+	defer func() {
+		confVars.mu.Lock()
+		confVars.assetsDir, confVars.layoutFile = oldDir, oldFile
+		confVars.mu.Unlock()
+		loadLayout()
+	}()
+
+	if err := ioutil.WriteFile(dir+"/test.html", []byte("custom {{.Title}}|{{.Body}}"), 0644); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	loadLayout()
+	if out := applyLayout(newLayoutData("T", []byte("B"))); string(out) != "custom T|B" {
+		t.Errorf("loadLayout(): got %q\n", out)
+	}
+
+	if err := ioutil.WriteFile(dir+"/test.html", []byte("broken {{.Title"), 0644); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	loadLayout()
+	if out := applyLayout(newLayoutData("T", []byte("B"))); string(out) != "custom T|B" {
+		t.Errorf("loadLayout(): broken layout replaced the old one: got %q\n", out)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// Holds the regexp matching markdown links under the
+// view path, compiled again only when the view path
+// changes
+type linkPattern struct {
+	mu       *sync.RWMutex
+	viewPath string
+	regex    *regexp.Regexp
+}
+
+var mdLinkPattern = &linkPattern{
+	mu: &sync.RWMutex{},
+}
+
+// Returns the regexp for links under viewPath
+func (lp *linkPattern) get(viewPath string) *regexp.Regexp {
+	lp.mu.RLock()
+	if lp.regex != nil && lp.viewPath == viewPath {
+		defer lp.mu.RUnlock()
+		return lp.regex
+	}
+	lp.mu.RUnlock()
+
+	regex := regexp.MustCompile(`\]\(` + regexp.QuoteMeta(viewPath) + `(` + pageNamePattern + `)[)#?\s]`)
+	lp.mu.Lock()
+	lp.viewPath = viewPath
+	lp.regex = regex
+	lp.mu.Unlock()
+	return regex
+}
+
+// Pulls the names of the pages a page links to out of
+// its markdown, from both [[wiki links]] and regular
+// links under the view path. Returned names have the
+// .md suffix, matching the keys of the page cache.
+func findLinks(raw []byte, viewPath string) []string {
+	mdLinkRegex := mdLinkPattern.get(viewPath)
+
+	found := make(map[string]bool)
+	infence := false
+	for _, line := range bytes.Split(raw, []byte("\n")) {
+		trimmed := bytes.TrimSpace(line)
+		if bytes.HasPrefix(trimmed, []byte("```")) || bytes.HasPrefix(trimmed, []byte("~~~")) {
+			infence = !infence
+		}
+		if infence {
+			continue
+		}
+		for _, sub := range wikiLinkRegex.FindAllSubmatch(line, -1) {
+			found[string(sub[1])+".md"] = true
+		}
+		for _, sub := range mdLinkRegex.FindAllSubmatch(line, -1) {
+			found[string(sub[1])+".md"] = true
+		}
+	}
+
+	links := make([]string, 0, len(found))
+	for name := range found {
+		links = append(links, name)
+	}
+	sort.Strings(links)
+	return links
+}
+
+// Records the pages a page links to, replacing any
+// links recorded earlier. Returns the pages whose
+// backlinks changed as a result.
+func (graph *linkGraph) update(name string, links []string) []string {
+	newLinks := make(map[string]bool, len(links))
+	for _, target := range links {
+		if target != name {
+			newLinks[target] = true
+		}
+	}
+
+	graph.mu.Lock()
+	defer graph.mu.Unlock()
+
+	changed := make([]string, 0)
+	for target := range graph.out[name] {
+		if !newLinks[target] {
+			delete(graph.in[target], name)
+			changed = append(changed, target)
+		}
+	}
+	for target := range newLinks {
+		if graph.out[name][target] {
+			continue
+		}
+		if graph.in[target] == nil {
+			graph.in[target] = make(map[string]bool)
+		}
+		graph.in[target][name] = true
+		changed = append(changed, target)
+	}
+	graph.out[name] = newLinks
+
+	return changed
+}
+
+// Returns the sorted names of the pages linking to a page
+func (graph *linkGraph) backlinks(name string) []string {
+	graph.mu.RLock()
+	links := make([]string, 0, len(graph.in[name]))
+	for source := range graph.in[name] {
+		links = append(links, source)
+	}
+	graph.mu.RUnlock()
+
+	sort.Strings(links)
+	return links
+}
+
+// Returns the names of the pages a page links to
+func (graph *linkGraph) links(name string) []string {
+	graph.mu.RLock()
+	links := make([]string, 0, len(graph.out[name]))
+	for target := range graph.out[name] {
+		links = append(links, target)
+	}
+	graph.mu.RUnlock()
+
+	sort.Strings(links)
+	return links
+}
+
+// Flags cached pages for re-caching if the backlinks
+// they were rendered with are out of date.
+func refreshBacklinks(names []string) {
+	pageCache.mu.RLock()
+	for _, name := range names {
+		page, ok := pageCache.pool[name]
+		if !ok {
+			continue
+		}
+		if strings.Join(page.Backlinks, " ") != strings.Join(linkCache.backlinks(name), " ") {
+			page.setRecache()
+		}
+	}
+	pageCache.mu.RUnlock()
+}
+
+// Writes a markdown list of links to the given pages,
+// using their titles where they've been cached.
+func writeBacklinks(buf *bytes.Buffer, links []string, viewPath string) {
+	for _, name := range links {
+		title := strings.TrimSuffix(name, ".md")
+		if page, err := pullFromCache(name); err == nil && page.Title != "" {
+			title = page.Title
+		}
+		buf.WriteString("* " + pageLink(title, viewPath, name) + "\n")
+	}
+}
+
+// Markdown appended to a page listing the pages
+// that link to it. The page body is the same for
+// everyone, so private pages are left out.
+func backlinksSection(links []string) []byte {
+	links = publicNames(links)
+	if len(links) == 0 {
+		return nil
+	}
+	confVars.mu.RLock()
+	viewPath := confVars.viewPath
+	confVars.mu.RUnlock()
+
+	buf := bytes.NewBuffer(nil)
+	buf.WriteString("\n\n---\n\n**What links here**\n\n")
+	writeBacklinks(buf, links, viewPath)
+	return buf.Bytes()
+}
+
+// Lists the pages linking to the requested page
+func backlinksHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["pageReq"]
+
+	confVars.mu.RLock()
+	viewPath := confVars.viewPath
+	title := "Pages linking to " + name + " " + confVars.titleSep + " " + confVars.wikiName
+	confVars.mu.RUnlock()
+
+	buf := bytes.NewBuffer(nil)
+	buf.WriteString("# Pages linking to [" + name + "](" + viewPath + name + ")\n\n")
+	links := visibleNames(r, linkCache.backlinks(name+".md"))
+	if len(links) == 0 {
+		buf.WriteString("*No pages link here.*\n")
+	}
+	writeBacklinks(buf, links, viewPath)
+
+	w.Header().Set("Content-Type", htmlutf8)
+	if _, err := w.Write(render(buf.Bytes(), title)); err != nil {
+		log500(w, r, err)
+		return
+	}
+}
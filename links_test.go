@@ -0,0 +1,78 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+var findLinksCases = []struct {
+	name string
+	raw  string
+	want []string
+}{
+	{
+		name: "wiki and markdown links",
+		raw:  "see [[one]], [[two|Two]] and [three](/w/three) or [three again](/w/three#top)",
+		want: []string{"one.md", "three.md", "two.md"},
+	},
+	{
+		name: "ignores other paths and code",
+		raw:  "[home](/) [ext](https://example.com/w/nope)\n```\n[[nope]]\n```\n",
+		want: []string{},
+	},
+}
+
+func Test_findLinks(t *testing.T) {
+	for _, tt := range findLinksCases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := findLinks([]byte(tt.raw), "/w/"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("findLinks() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Make sure backlinks follow changes to
+// the pages linking in
+func Test_linkGraph(t *testing.T) {
+	graph := &linkGraph{
+		mu:  new(sync.RWMutex),
+		out: make(map[string]map[string]bool),
+		in:  make(map[string]map[string]bool),
+	}
+
+	graph.update("a.md", []string{"c.md", "a.md"})
+	changed := graph.update("b.md", []string{"c.md"})
+	if !reflect.DeepEqual(changed, []string{"c.md"}) {
+		t.Errorf("linkGraph.update() changed = %v", changed)
+	}
+	if got := graph.backlinks("c.md"); !reflect.DeepEqual(got, []string{"a.md", "b.md"}) {
+		t.Errorf("linkGraph.backlinks() = %v", got)
+	}
+	if got := graph.backlinks("a.md"); len(got) != 0 {
+		t.Errorf("linkGraph.backlinks() counted a self-link: %v", got)
+	}
+
+	changed = graph.update("a.md", []string{"b.md"})
+	if len(changed) != 2 {
+		t.Errorf("linkGraph.update() changed = %v, want b.md and c.md", changed)
+	}
+	if got := graph.backlinks("c.md"); !reflect.DeepEqual(got, []string{"b.md"}) {
+		t.Errorf("linkGraph.backlinks() after update = %v", got)
+	}
+}
+
+// Make sure the link regexp is only compiled
+// again when the view path changes
+func Test_linkPattern_get(t *testing.T) {
+	lp := &linkPattern{mu: &sync.RWMutex{}}
+	first := lp.get("/w/")
+	if lp.get("/w/") != first {
+		t.Errorf("get(): compiled again for the same view path\n")
+	}
+	other := lp.get("/wiki/")
+	if other == first || !other.MatchString("](/wiki/page)") || other.MatchString("](/w/page)") {
+		t.Errorf("get(): didn't follow the new view path\n")
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Suffix appended to rotated log files
+const rotateSuffix = "20060102-150405.000000"
+
+// Matches the suffix, so pruning leaves alone other
+// files sharing the log's name, such as access.log.gz
+var rotatedSuffix = regexp.MustCompile(`^\.[0-9]{8}-[0-9]{6}\.[0-9]{6}$`)
+
+// A log file that rotates itself once it grows past
+// maxSize bytes or has been open longer than maxAge.
+// Either limit is ignored when zero. Only the newest
+// keep rotated files are kept, or all of them if zero.
+type logFile struct {
+	mu      *sync.Mutex
+	path    string
+	file    *os.File
+	size    int64
+	opened  time.Time
+	maxSize int64
+	maxAge  time.Duration
+	keep    int
+}
+
+// Opens the log file at path for appending, with the
+// rotation limits set in the config
+func openLogFile(path string) (*logFile, error) {
+	l := &logFile{
+		mu:   new(sync.Mutex),
+		path: path,
+	}
+	l.setLimits()
+
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Picks up the rotation limits from the config.
+// Does nothing when the file isn't open.
+func (l *logFile) setLimits() {
+	if l == nil {
+		return
+	}
+	confVars.mu.RLock()
+	maxSize := confVars.logRotateSize
+	maxAge := confVars.logRotateAge
+	keep := confVars.logRotateKeep
+	confVars.mu.RUnlock()
+
+	l.mu.Lock()
+	l.maxSize = maxSize
+	l.maxAge = maxAge
+	l.keep = keep
+	l.mu.Unlock()
+}
+
+// Opens the file, picking up its current size.
+// Caller holds l.mu or has the only reference.
+func (l *logFile) open() error {
+	file, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	l.file = file
+	l.size = 0
+	if stat, err := file.Stat(); err == nil {
+		l.size = stat.Size()
+	}
+	l.opened = time.Now()
+	return nil
+}
+
+// Writes to the file, rotating it first when
+// the write would take it past its limits
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return 0, os.ErrClosed
+	}
+	if l.due(int64(len(p))) {
+		if err := l.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := l.file.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// Whether writing n more bytes calls for a rotation
+func (l *logFile) due(n int64) bool {
+	if l.maxSize > 0 && l.size > 0 && l.size+n > l.maxSize {
+		return true
+	}
+	return l.maxAge > 0 && time.Since(l.opened) > l.maxAge
+}
+
+// Moves the current file aside with a timestamp
+// suffix and starts a new one. Caller holds l.mu.
+func (l *logFile) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	l.file = nil
+
+	rotated := l.path + "." + time.Now().Format(rotateSuffix)
+	if err := os.Rename(l.path, rotated); err != nil && !os.IsNotExist(err) {
+		// keep writing to the old file rather than losing lines
+		if openErr := l.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	if err := l.open(); err != nil {
+		return err
+	}
+	l.prune()
+	return nil
+}
+
+// Removes the oldest rotated files beyond the
+// number to keep. Errors are ignored; a leftover
+// file is harmless.
+func (l *logFile) prune() {
+	if l.keep <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(l.path + ".*")
+	if err != nil {
+		return
+	}
+	old := make([]string, 0, len(matches))
+	for _, f := range matches {
+		if rotatedSuffix.MatchString(strings.TrimPrefix(f, l.path)) {
+			old = append(old, f)
+		}
+	}
+	if len(old) <= l.keep {
+		return
+	}
+	// the timestamp suffix sorts chronologically
+	sort.Strings(old)
+	for _, f := range old[:len(old)-l.keep] {
+		_ = os.Remove(f)
+	}
+}
+
+// Closes and reopens the file at the same path, for
+// when an external tool such as logrotate moved it
+func (l *logFile) reopen() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file != nil {
+		if err := l.file.Close(); err != nil {
+			return err
+		}
+		l.file = nil
+	}
+	return l.open()
+}
+
+// Closes the file. Later writes fail.
+func (l *logFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
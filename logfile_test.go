@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func Test_logFile_rotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tildewiki-logs")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "access.log")
+	// other files sharing the name aren't rotated ones
+	for _, other := range []string{".bak", ".gz"} {
+		if err := ioutil.WriteFile(path+other, nil, 0644); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+	}
+	l := &logFile{mu: new(sync.Mutex), path: path, maxSize: 10, keep: 2}
+	if err := l.open(); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer l.Close()
+
+	// every write after the first pushes
+	// the file past its limit
+	for i := 0; i < 4; i++ {
+		if _, err := l.Write([]byte("12345678\n")); err != nil {
+			t.Fatalf("logFile.Write(): %v\n", err)
+		}
+	}
+
+	old, _ := filepath.Glob(path + ".2*")
+	if len(old) != 2 {
+		t.Errorf("logFile.rotate(): kept %v rotated files, want 2: %v\n", len(old), old)
+	}
+	for _, other := range []string{".bak", ".gz"} {
+		if _, err := os.Stat(path + other); err != nil {
+			t.Errorf("logFile.prune(): removed %v\n", path+other)
+		}
+	}
+	data, _ := ioutil.ReadFile(path)
+	if string(data) != "12345678\n" {
+		t.Errorf("logFile.rotate(): current file holds %q\n", data)
+	}
+}
+
+func Test_logFile_reopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tildewiki-logs")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "tildewiki.log")
+	l := &logFile{mu: new(sync.Mutex), path: path}
+	if err := l.open(); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer l.Close()
+	l.Write([]byte("before\n"))
+
+	// what logrotate does before signalling
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if err := l.reopen(); err != nil {
+		t.Fatalf("logFile.reopen(): %v\n", err)
+	}
+	l.Write([]byte("after\n"))
+
+	if data, _ := ioutil.ReadFile(path); string(data) != "after\n" {
+		t.Errorf("logFile.reopen(): new file holds %q\n", data)
+	}
+	if data, _ := ioutil.ReadFile(path + ".1"); string(data) != "before\n" {
+		t.Errorf("logFile.reopen(): moved file holds %q\n", data)
+	}
+}
@@ -4,47 +4,41 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"os/signal"
 	"time"
 
-	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 )
 
 // TildeWiki version
 const twvers = "0.6.4"
 
-// Makes the deferred close functions for the log file
-// block until exit
-var closelog = make(chan struct{}, 1)
-
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		os.Exit(exportCmd(os.Args[2:]))
+	}
+	setUpServer()
+
 	confVars.mu.RLock()
-	filog := confVars.fileLogging
 	portnum := confVars.port
-	qlog := confVars.quietLogging
+	gopherPort := confVars.gopherPort
+	geminiPort := confVars.geminiPort
+	geminiCert := confVars.geminiCert
+	geminiKey := confVars.geminiKey
+	tlsCert := confVars.tlsCert
+	tlsKey := confVars.tlsKey
+	tlsRedirectPort := confVars.tlsRedirectPort
+	metricsPort := confVars.metricsPort
 	reversed := confVars.reverseTally
 	viewPath := confVars.viewPath
 	confVars.mu.RUnlock()
 
-	// watch for SIGINT aka ^C
-	// close the log file then exit
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	go func() {
-		for sigint := range c {
-			log.Printf("\n\nCaught %v. Cleaning up ...\n", sigint)
-
-			if filog {
-				// signal to close the log file
-				closelog <- struct{}{}
-				time.Sleep(50 * time.Millisecond)
-			}
+	// record the pages as they are before
+	// anyone edits them
+	initHistory()
 
-			close(closelog)
-			os.Exit(0)
-		}
-	}()
+	// keep the caches up to date as pages,
+	// the index and the layout change
+	watchFiles()
 
 	// fill the page cache
 	log.Println("**NOTICE** Building initial cache ...")
@@ -53,32 +47,118 @@ func main() {
 	serv := mux.NewRouter().StrictSlash(true)
 
 	serv.Path("/").HandlerFunc(indexHandler)
-	serv.Path(viewPath + "{pageReq:[a-zA-Z0-9_-]+}").HandlerFunc(pageHandler)
+	// page names may include subdirectories. the revision
+	// routes come first so the revision isn't taken as
+	// part of the page name.
+	pageReq := "{pageReq:" + pageNamePattern + "}"
+	rev := "{rev:[0-9a-f]{7,40}}"
+	serv.Path(viewPath + pageReq).HandlerFunc(pageHandler)
+	serv.Path("/raw/" + pageReq).HandlerFunc(rawHandler)
+	serv.Path("/api/page/" + pageReq).HandlerFunc(apiPageHandler)
+	serv.Path("/edit/" + pageReq).HandlerFunc(editHandler)
+	serv.Path("/history/" + pageReq + "/" + rev).HandlerFunc(revisionHandler)
+	serv.Path("/history/" + pageReq).HandlerFunc(historyHandler)
+	serv.Path("/revert/" + pageReq + "/" + rev).HandlerFunc(revertHandler)
+	serv.Path("/backlinks/" + pageReq).HandlerFunc(backlinksHandler)
+	serv.Path("/tags").HandlerFunc(tagsHandler)
+	serv.Path("/tag/{name:[a-zA-Z0-9_-]+}").HandlerFunc(tagHandler)
+	serv.Path("/search").HandlerFunc(searchHandler)
+	serv.Path("/feed.atom").HandlerFunc(atomHandler)
+	serv.Path("/feed.rss").HandlerFunc(rssHandler)
+	serv.Path("/sitemap.xml").HandlerFunc(sitemapHandler)
+	serv.Path("/robots.txt").HandlerFunc(robotsHandler)
 	serv.Path("/css").HandlerFunc(cssHandler)
+	serv.Path(highlightCSSPath).HandlerFunc(highlightCSSHandler)
 	serv.Path("/icon").HandlerFunc(iconHandler)
 	serv.Path("/500").HandlerFunc(error500)
 	serv.Path("/404").HandlerFunc(error404)
+	serv.Path("/~{user:" + userNamePattern + "}/").HandlerFunc(userIndexHandler)
+	serv.Path("/~{user:" + userNamePattern + "}/{page:" + userPagePattern + "}").HandlerFunc(userPageHandler)
+	serv.Path("/login").HandlerFunc(loginHandler)
+	serv.Path("/logout").HandlerFunc(logoutHandler)
+	serv.Use(privateMiddleware)
 
 	if reversed {
 		log.Printf("**NOTICE** Using reversed page listings on index ... \n")
 	}
 
-	log.Println("**NOTICE** Binding to " + portnum)
+	// the gopher server shares the caches
+	// with the HTTP server
+	if gopherPort != "" {
+		log.Println("**NOTICE** Gopher binding to " + gopherPort)
+		go func() {
+			if err := serveGopher(gopherPort); err != nil {
+				log.Printf("Gopher server stopped: %v\n", err.Error())
+			}
+		}()
+	}
+
+	// so does the gemini server
+	if geminiPort != "" {
+		log.Println("**NOTICE** Gemini binding to " + geminiPort)
+		go func() {
+			if err := serveGemini(geminiPort, geminiCert, geminiKey); err != nil {
+				log.Printf("Gemini server stopped: %v\n", err.Error())
+			}
+		}()
+	}
+
+	// metrics are kept off the public port
+	if metricsPort != "" {
+		log.Println("**NOTICE** Metrics binding to " + metricsPort)
+		go func() {
+			if err := serveMetrics(metricsPort); err != nil {
+				log.Printf("Metrics server stopped: %v\n", err.Error())
+			}
+		}()
+	}
+
 	server := &http.Server{
-		Handler:      handlers.CompressHandler(ipMiddleware(serv)),
+		Handler:      ipMiddleware(accessLogMiddleware(metricsMiddleware(serv, authMiddleware(compressMiddleware(serv))))),
 		Addr:         portnum,
 		WriteTimeout: 15 * time.Second,
 		ReadTimeout:  15 * time.Second,
 	}
 
-	err := server.ListenAndServe()
-	if err != nil {
-		log.Printf("%v\n", err.Error())
+	// serve HTTPS directly when there's a certificate,
+	// optionally redirecting plain HTTP to it
+	useTLS := tlsCert != "" && tlsKey != ""
+	if useTLS {
+		certs, err := newCertReloader(tlsCert, tlsKey)
+		if err != nil {
+			log.Fatalf("Couldn't load TLS certificate: %v\n", err.Error())
+		}
+		server.TLSConfig = certs.tlsConfig()
+
+		if tlsRedirectPort != "" {
+			log.Println("**NOTICE** HTTPS redirect binding to " + tlsRedirectPort)
+			go func() {
+				if err := serveRedirects(tlsRedirectPort, portnum); err != nil {
+					log.Printf("HTTPS redirect server stopped: %v\n", err.Error())
+				}
+			}()
+		}
 	}
 
-	// signal to close the log file
-	if filog || qlog {
-		closelog <- struct{}{}
-		close(closelog)
+	// SIGINT and SIGTERM shut the server down
+	// gracefully, SIGHUP reloads
+	done := make(chan struct{})
+	go handleSignals(server, done)
+
+	var err error
+	if useTLS {
+		log.Println("**NOTICE** Binding to " + portnum + " with TLS")
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		log.Println("**NOTICE** Binding to " + portnum)
+		err = server.ListenAndServe()
 	}
+	if err != nil && err != http.ErrServerClosed {
+		log.Printf("%v\n", err.Error())
+	} else {
+		// wait for in-flight requests to finish
+		<-done
+	}
+
+	closeLog()
 }
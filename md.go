@@ -1,37 +1,149 @@
 package main
 
 import (
+	"bytes"
+	"html"
+	"os"
+	"regexp"
+	"time"
+
 	bf "github.com/gbmor-forks/blackfriday.v2-patched"
 )
 
-// Sets parameters for the markdown->html renderer
-func setupMarkdown(css, title string) *bf.HTMLRenderer {
-	// if using local CSS file, use the virtually-served css
-	// path rather than the actual file name
-	confVars.mu.RLock()
-	if cssLocal([]byte(confVars.cssPath)) {
-		css = "/css"
-	}
-	confVars.mu.RUnlock()
+// Matches [[page]] and [[page|label]]
+var wikiLinkRegex = regexp.MustCompile(`\[\[(` + pageNamePattern + `)(?:\|([^\]|]+))?\]\]`)
 
+// Sets parameters for the markdown->html renderer.
+// The renderer only produces the HTML fragment for
+// the document; the rest comes from the layout.
+func setupMarkdown() *bf.HTMLRenderer {
 	var params = bf.HTMLRendererParameters{
-		CSS:   css,
-		Title: title,
-		Icon:  "/icon",
-		Meta: map[string]string{
-			"name=\"application-name\"": "TildeWiki " + twvers + " :: https://github.com/gbmor/tildewiki",
-			"name=\"viewport\"":         "width=device-width, initial-scale=1.0",
-		},
-		Flags: bf.CompletePage | bf.Safelink,
+		Flags: bf.Safelink,
 	}
 	return bf.NewHTMLRenderer(params)
 }
 
-// Wrapper function to generate the parameters above and
-// pass them to the blackfriday library's parsing function
+// Renders markdown to an HTML fragment
+func renderFragment(data []byte) []byte {
+	return renderMarkdown(data, false, false)
+}
+
+// Renders markdown to an HTML fragment, optionally
+// with a table of contents. Headings get anchor IDs
+// and permalinks either way, and fenced code is
+// highlighted if SyntaxHighlight is on. Markdown
+// from people who can't be trusted with scripts on
+// the wiki's origin, such as users' own wikis, is
+// rendered with skipHTML.
+func renderMarkdown(data []byte, toc, skipHTML bool) []byte {
+	start := time.Now()
+	renderer := &wikiRenderer{setupMarkdown(), highlightEnabled(), skipHTML}
+	ast := bf.New(bf.WithRenderer(renderer), bf.WithExtensions(bf.CommonExtensions)).Parse(wikiLinks(data))
+	assignHeadingIDs(ast)
+
+	buf := bytes.NewBuffer(nil)
+	renderer.RenderHeader(buf, ast)
+	ast.Walk(func(node *bf.Node, entering bool) bf.WalkStatus {
+		return renderer.RenderNode(buf, node, entering)
+	})
+	renderer.RenderFooter(buf, ast)
+
+	out := buf.Bytes()
+	if toc {
+		out = placeTOC(out, tableOfContents(ast, skipHTML))
+	}
+	metrics.rendered(time.Since(start))
+	return out
+}
+
+// Wrapper function to render markdown and wrap
+// the result in the layout. Used for documents
+// that aren't wiki pages.
 func render(data []byte, title string) []byte {
+	return applyLayout(newLayoutData(title, renderFragment(data)))
+}
+
+// Wraps a page's rendered content in the layout,
+// passing along the page's own fields.
+func renderPage(page *Page, title string) []byte {
+	data := newLayoutData(title, page.Content)
+	confVars.mu.RLock()
+	data.Desc, data.Author = plainMeta(page, confVars.descSep)
+	confVars.mu.RUnlock()
+	data.Page = page
+	data.Modtime = page.Modtime
+	return applyLayout(data)
+}
+
+// Replaces [[page]] and [[page|label]] with links
+// to the page under the view path. Links to pages
+// that don't exist get the "new" class so they
+// can be styled differently. Fenced code blocks
+// and code spans are left alone.
+func wikiLinks(data []byte) []byte {
+	if !bytes.Contains(data, []byte("[[")) {
+		return data
+	}
+
 	confVars.mu.RLock()
-	cssPath := confVars.cssPath
+	viewPath := confVars.viewPath
+	pageDir := confVars.pageDir
 	confVars.mu.RUnlock()
-	return bf.Run(data, bf.WithRenderer(setupMarkdown(cssPath, title)))
+
+	link := func(match []byte) []byte {
+		sub := wikiLinkRegex.FindSubmatch(match)
+		name := string(sub[1])
+		label := name
+		if len(sub[2]) > 0 {
+			label = string(bytes.TrimSpace(sub[2]))
+		}
+		class := "wikilink"
+		if !pageExists(pageDir, name) {
+			class += " new"
+		}
+		return []byte("<a href=\"" + viewPath + name + "\" class=\"" + class + "\">" + html.EscapeString(label) + "</a>")
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	infence := false
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		trimmed := bytes.TrimSpace(line)
+		if bytes.HasPrefix(trimmed, []byte("```")) || bytes.HasPrefix(trimmed, []byte("~~~")) {
+			infence = !infence
+		}
+		if infence {
+			out.Write(line)
+			continue
+		}
+
+		// odd-numbered pieces are inside code spans
+		for i, piece := range bytes.Split(line, []byte("`")) {
+			if i > 0 {
+				out.WriteByte('`')
+			}
+			if i%2 == 0 {
+				piece = wikiLinkRegex.ReplaceAllFunc(piece, link)
+			}
+			out.Write(piece)
+		}
+	}
+	return out.Bytes()
+}
+
+// Reports whether a page is in the cache or,
+// failing that, on disk. The disk check covers
+// pages that haven't been cached yet, such as
+// during the initial cache build, reading only
+// their header for privacy. Rendered pages
+// are shared by every reader, so private pages
+// count as missing; otherwise anyone could tell
+// which private pages exist from their links.
+func pageExists(pageDir, name string) bool {
+	if page, err := pullFromCache(name + ".md"); err == nil {
+		return !page.Private
+	}
+	if _, err := os.Stat(pageDir + "/" + name + ".md"); err != nil {
+		return false
+	}
+	return !isPrivate(name + ".md")
 }
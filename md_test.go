@@ -3,6 +3,7 @@ package main
 import (
 	"io/ioutil"
 	"reflect"
+	"strings"
 	"testing"
 
 	bf "github.com/gbmor-forks/blackfriday.v2-patched"
@@ -12,19 +13,16 @@ var mdTestData1, _ = ioutil.ReadFile("pages/example.md")
 var mdTestData2, _ = ioutil.ReadFile("pages/test1.md")
 var markdownTests = []struct {
 	name  string
-	css   string
 	title string
 	data  []byte
 }{
 	{
 		name:  "one",
-		css:   "assets/wiki.css",
 		title: "Example Page",
 		data:  mdTestData1,
 	},
 	{
 		name:  "two",
-		css:   "assets/wiki.css",
 		title: "No Description",
 		data:  mdTestData2,
 	},
@@ -35,7 +33,7 @@ var markdownTests = []struct {
 func Test_setupMarkdown(t *testing.T) {
 	for _, tt := range markdownTests {
 		t.Run(string(tt.name), func(t *testing.T) {
-			var got interface{} = setupMarkdown(tt.css, tt.title)
+			var got interface{} = setupMarkdown()
 			if _, ok := got.(*bf.HTMLRenderer); !ok {
 				t.Errorf("setupMarkdown() returned incorrect type: %v", reflect.TypeOf(got))
 			}
@@ -44,8 +42,8 @@ func Test_setupMarkdown(t *testing.T) {
 }
 func Benchmark_setupMarkdown(b *testing.B) {
 	for i := 0; i < b.N; i++ {
-		for _, c := range markdownTests {
-			setupMarkdown(c.css, c.title)
+		for range markdownTests {
+			setupMarkdown()
 		}
 	}
 }
@@ -71,3 +69,77 @@ func Benchmark_render(b *testing.B) {
 		}
 	}
 }
+
+var wikiLinksCases = []struct {
+	name string
+	data string
+	want string
+}{
+	{
+		name: "existing page",
+		data: "see [[example]] here",
+		want: "see <a href=\"/w/example\" class=\"wikilink\">example</a> here",
+	},
+	{
+		name: "label",
+		data: "[[example|the <example>]]",
+		want: "<a href=\"/w/example\" class=\"wikilink\">the &lt;example&gt;</a>",
+	},
+	{
+		name: "missing page",
+		data: "[[nope]]",
+		want: "<a href=\"/w/nope\" class=\"wikilink new\">nope</a>",
+	},
+	{
+		name: "code span",
+		data: "`[[example]]` and [[example]]",
+		want: "`[[example]]` and <a href=\"/w/example\" class=\"wikilink\">example</a>",
+	},
+	{
+		name: "fenced code",
+		data: "```\n[[example]]\n```\n",
+		want: "```\n[[example]]\n```\n",
+	},
+}
+
+// Make sure wiki links are turned into HTML links,
+// except inside code
+func Test_wikiLinks(t *testing.T) {
+	initConfigParams()
+	for _, tt := range wikiLinksCases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(wikiLinks([]byte(tt.data))); got != tt.want {
+				t.Errorf("wikiLinks() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+func Benchmark_wikiLinks(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		for _, c := range wikiLinksCases {
+			wikiLinks([]byte(c.data))
+		}
+	}
+}
+
+// Make sure raw HTML is dropped with skipHTML,
+// while the wiki's own links survive
+func Test_renderMarkdown_skipHTML(t *testing.T) {
+	initConfigParams()
+	doc := []byte("# Hi <img src=x onerror=alert(1)>\n\n<script>alert(1)</script>\n\n<!--toc-->\n\nText <img src=x onerror=alert(1)> and <a href=\"javascript:alert(1)\">this</a> and [[example]] and <a href=\"/w/~alice/page\">alice</a>\n")
+
+	out := string(renderMarkdown(doc, true, true))
+	for _, bad := range []string{"<script", "<img", "javascript:"} {
+		if strings.Contains(out, bad) {
+			t.Errorf("renderMarkdown(): kept %q in:\n%s\n", bad, out)
+		}
+	}
+	for _, want := range []string{`class="wikilink`, `<a href="/w/~alice/page">alice</a>`, `<nav class="toc">`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("renderMarkdown(): missing %q in:\n%s\n", want, out)
+		}
+	}
+	if !strings.Contains(string(renderMarkdown(doc, false, false)), "<script>") {
+		t.Errorf("renderMarkdown(): dropped HTML without skipHTML\n")
+	}
+}
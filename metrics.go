@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// content-type of the Prometheus text format
+const metricsutf8 = "text/plain; version=0.0.4; charset=utf-8"
+
+// Upper bounds of the duration histogram buckets, in seconds
+var durationBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// A Prometheus-style histogram. Not safe for
+// concurrent use; guarded by metricsBlk.mu.
+type histogram struct {
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+// Labels for the request metrics
+type requestKey struct {
+	route  string
+	status string
+}
+
+// Labels for the cache check counter
+type cacheKey struct {
+	cache  string
+	result string
+}
+
+func newHistogram() *histogram {
+	return &histogram{buckets: make([]uint64, len(durationBuckets))}
+}
+
+// Records a single observation
+func (h *histogram) observe(v float64) {
+	for i, bound := range durationBuckets {
+		if v <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// Records a request served by a route
+func (m *metricsBlk) request(route string, status int, took time.Duration) {
+	key := requestKey{route: route, status: strconv.Itoa(status)}
+	m.mu.Lock()
+	h, ok := m.requests[key]
+	if !ok {
+		h = newHistogram()
+		m.requests[key] = h
+	}
+	h.observe(took.Seconds())
+	m.mu.Unlock()
+}
+
+// Records the outcome of checking a cache
+func (m *metricsBlk) cacheCheck(cache, result string) {
+	m.mu.Lock()
+	m.checks[cacheKey{cache: cache, result: result}]++
+	m.mu.Unlock()
+}
+
+// Records how long rendering a document took
+func (m *metricsBlk) rendered(took time.Duration) {
+	m.mu.Lock()
+	m.render.observe(took.Seconds())
+	m.mu.Unlock()
+}
+
+// Names a cache for the cache check counter
+func cacheName(c cacher) string {
+	switch c.(type) {
+	case *Page:
+		return "page"
+	case *indexCacheBlk:
+		return "index"
+	case *feedCacheBlk:
+		return "feed"
+	}
+	return "other"
+}
+
+// Returns the template of a route, without the
+// variables' patterns, such as "/w/{pageReq}"
+func routeLabel(route *mux.Route) string {
+	if route == nil {
+		return "none"
+	}
+	tmpl, err := route.GetPathTemplate()
+	if err != nil {
+		return "none"
+	}
+
+	// the patterns may hold braces of their own,
+	// such as {rev:[0-9a-f]{7,40}}
+	out := make([]byte, 0, len(tmpl))
+	depth := 0
+	skipping := false
+	for i := 0; i < len(tmpl); i++ {
+		c := tmpl[i]
+		switch {
+		case c == '{':
+			depth++
+		case c == '}':
+			depth--
+			if depth == 0 {
+				skipping = false
+			}
+		case c == ':' && depth == 1:
+			skipping = true
+		}
+		if !skipping || (c == '}' && depth == 0) {
+			out = append(out, c)
+		}
+	}
+	return string(out)
+}
+
+// Counts and times the requests each route serves.
+// Wraps the router rather than being installed on it,
+// so requests no route matches are counted too, under
+// "none". The router is asked which route matches.
+func metricsMiddleware(serv *mux.Router, hop http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := newResponseRecorder(w)
+		hop.ServeHTTP(rec, r)
+
+		var match mux.RouteMatch
+		var route *mux.Route
+		if serv.Match(r, &match) {
+			route = match.Route
+		}
+		metrics.request(routeLabel(route), rec.status, time.Since(start))
+	})
+}
+
+// Escapes a label value for the text format
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// Formats a float the way Prometheus expects
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Writes a histogram's series with the given labels
+func writeHistogram(buf *bytes.Buffer, name, labels string, h *histogram) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	for i, bound := range durationBuckets {
+		fmt.Fprintf(buf, "%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, sep, formatFloat(bound), h.buckets[i])
+	}
+	fmt.Fprintf(buf, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(buf, "%s_sum%s %s\n", name, labels, formatFloat(h.sum))
+	fmt.Fprintf(buf, "%s_count%s %d\n", name, labels, h.count)
+}
+
+// Writes every metric in the Prometheus text format
+func (m *metricsBlk) write(buf *bytes.Buffer) {
+	stats := pageCache.stats()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	reqs := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		reqs = append(reqs, key)
+	}
+	sort.Slice(reqs, func(i, j int) bool {
+		if reqs[i].route == reqs[j].route {
+			return reqs[i].status < reqs[j].status
+		}
+		return reqs[i].route < reqs[j].route
+	})
+
+	buf.WriteString("# HELP tildewiki_http_requests_total HTTP requests served, by route and status.\n")
+	buf.WriteString("# TYPE tildewiki_http_requests_total counter\n")
+	for _, key := range reqs {
+		fmt.Fprintf(buf, "tildewiki_http_requests_total{route=\"%s\",status=\"%s\"} %d\n", escapeLabel(key.route), key.status, m.requests[key].count)
+	}
+
+	buf.WriteString("# HELP tildewiki_http_request_duration_seconds Time taken to serve HTTP requests, by route and status.\n")
+	buf.WriteString("# TYPE tildewiki_http_request_duration_seconds histogram\n")
+	for _, key := range reqs {
+		labels := fmt.Sprintf("route=\"%s\",status=\"%s\"", escapeLabel(key.route), key.status)
+		writeHistogram(buf, "tildewiki_http_request_duration_seconds", labels, m.requests[key])
+	}
+
+	checks := make([]cacheKey, 0, len(m.checks))
+	for key := range m.checks {
+		checks = append(checks, key)
+	}
+	sort.Slice(checks, func(i, j int) bool {
+		if checks[i].cache == checks[j].cache {
+			return checks[i].result < checks[j].result
+		}
+		return checks[i].cache < checks[j].cache
+	})
+
+	buf.WriteString("# HELP tildewiki_cache_checks_total Cache checks, by cache and whether it was fresh (hit) or rebuilt (recache).\n")
+	buf.WriteString("# TYPE tildewiki_cache_checks_total counter\n")
+	for _, key := range checks {
+		fmt.Fprintf(buf, "tildewiki_cache_checks_total{cache=\"%s\",result=\"%s\"} %d\n", key.cache, key.result, m.checks[key])
+	}
+
+	buf.WriteString("# HELP tildewiki_render_duration_seconds Time taken to render markdown to HTML.\n")
+	buf.WriteString("# TYPE tildewiki_render_duration_seconds histogram\n")
+	writeHistogram(buf, "tildewiki_render_duration_seconds", "", m.render)
+
+	buf.WriteString("# HELP tildewiki_cached_pages Pages in the page cache, rendered or not.\n")
+	buf.WriteString("# TYPE tildewiki_cached_pages gauge\n")
+	fmt.Fprintf(buf, "tildewiki_cached_pages %d\n", stats.Pages)
+	buf.WriteString("# HELP tildewiki_rendered_pages Rendered pages held in the page cache.\n")
+	buf.WriteString("# TYPE tildewiki_rendered_pages gauge\n")
+	fmt.Fprintf(buf, "tildewiki_rendered_pages %d\n", stats.Rendered)
+	buf.WriteString("# HELP tildewiki_cached_page_bytes Bytes taken up by the rendered pages in the page cache.\n")
+	buf.WriteString("# TYPE tildewiki_cached_page_bytes gauge\n")
+	fmt.Fprintf(buf, "tildewiki_cached_page_bytes %d\n", stats.Bytes)
+	buf.WriteString("# HELP tildewiki_page_cache_evictions_total Rendered pages dropped from the page cache to stay within its limits.\n")
+	buf.WriteString("# TYPE tildewiki_page_cache_evictions_total counter\n")
+	fmt.Fprintf(buf, "tildewiki_page_cache_evictions_total %d\n", stats.Evictions)
+}
+
+// Serves the metrics
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	buf := bytes.NewBuffer(nil)
+	metrics.write(buf)
+
+	w.Header().Set("Content-Type", metricsutf8)
+	if err := writeBody(w, r, buf.Bytes()); err != nil {
+		log.Printf("Couldn't write metrics: %v\n", err.Error())
+	}
+}
+
+// Routes of the admin port. These describe the
+// wiki's internals, including how many pages are
+// private, so they're kept off the public listener.
+func adminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/api/cache", cacheStatsHandler)
+	return mux
+}
+
+// Serves /metrics and /api/cache on the admin port.
+// The listener is closed along with the others on
+// shutdown.
+func serveMetrics(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	trackListener(ln)
+
+	server := &http.Server{
+		Handler:      adminMux(),
+		WriteTimeout: 15 * time.Second,
+		ReadTimeout:  15 * time.Second,
+	}
+	return server.Serve(ln)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func Test_histogram(t *testing.T) {
+	h := newHistogram()
+	h.observe(.003)
+	h.observe(.2)
+	h.observe(20)
+
+	if h.count != 3 {
+		t.Errorf("histogram.count: got %v, want 3\n", h.count)
+	}
+	// .005 holds the first, .25 the first two,
+	// and no bucket holds the last
+	if h.buckets[1] != 1 || h.buckets[6] != 2 || h.buckets[len(h.buckets)-1] != 2 {
+		t.Errorf("histogram.buckets: got %v\n", h.buckets)
+	}
+}
+
+func Test_routeLabel(t *testing.T) {
+	tests := []struct {
+		path string
+		url  string
+		want string
+	}{
+		{"/w/{pageReq:" + pageNamePattern + "}", "/w/howto/ssh", "/w/{pageReq}"},
+		{"/history/{pageReq:" + pageNamePattern + "}/{rev:[0-9a-f]{7,40}}", "/history/example/abcdef0", "/history/{pageReq}/{rev}"},
+		{"/tags", "/tags", "/tags"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			var got string
+			serv := mux.NewRouter()
+			serv.Path(tt.path).HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = routeLabel(mux.CurrentRoute(r))
+			})
+			serv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", tt.url, nil))
+			if got != tt.want {
+				t.Errorf("routeLabel(): got %v, want %v\n", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_metricsHandler(t *testing.T) {
+	initConfigParams()
+	log.SetOutput(hush)
+	genPageCache()
+
+	// start counting from zero
+	metrics.mu.Lock()
+	metrics.requests = make(map[requestKey]*histogram)
+	metrics.mu.Unlock()
+
+	serv := mux.NewRouter()
+	serv.Path("/teapot").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	serv.Path(confVars.viewPath + "{pageReq:" + pageNamePattern + "}").HandlerFunc(pageHandler)
+	serv.Path("/500").HandlerFunc(error500)
+	hop := metricsMiddleware(serv, serv)
+	hop.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/teapot", nil))
+	hop.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/nowhere", nil))
+	hop.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", confVars.viewPath+"no-such-page", nil))
+	hop.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/500", nil))
+
+	if _, err := freshPage("example.md"); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	renderFragment([]byte("# hello"))
+	metrics.request("/slow", 200, 2*time.Second)
+
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	if w.Header().Get("Content-Type") != metricsutf8 {
+		t.Errorf("metricsHandler(): got Content-Type %v\n", w.Header().Get("Content-Type"))
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		`tildewiki_http_requests_total{route="/teapot",status="418"} 1`,
+		`tildewiki_http_requests_total{route="none",status="404"} 1`,
+		`tildewiki_http_requests_total{route="` + confVars.viewPath + `{pageReq}",status="404"} 1`,
+		`tildewiki_http_requests_total{route="/500",status="500"} 1`,
+		`tildewiki_http_request_duration_seconds_bucket{route="/slow",status="200",le="1"} 0`,
+		`tildewiki_http_request_duration_seconds_bucket{route="/slow",status="200",le="2.5"} 1`,
+		`tildewiki_cache_checks_total{cache="page",result="hit"}`,
+		`tildewiki_render_duration_seconds_count`,
+		`tildewiki_cached_pages`,
+		`tildewiki_cached_page_bytes`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metricsHandler(): missing %v\n", want)
+		}
+	}
+}
+
+func Benchmark_metricsWrite(b *testing.B) {
+	initConfigParams()
+	log.SetOutput(hush)
+	genPageCache()
+	metrics.request("/w/{pageReq}", 200, time.Millisecond)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		metrics.write(bytes.NewBuffer(nil))
+	}
+}
+
+// The cache stats are served on the admin port
+func Test_adminMux(t *testing.T) {
+	initConfigParams()
+	log.SetOutput(hush)
+
+	w := httptest.NewRecorder()
+	adminMux().ServeHTTP(w, httptest.NewRequest("GET", "/api/cache", nil))
+	if w.Code != 200 || w.Header().Get("Content-Type") != jsonutf8 {
+		t.Errorf("adminMux(): /api/cache got %v\n", w.Code)
+	}
+}
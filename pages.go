@@ -5,20 +5,71 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"html"
 	"io/ioutil"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/spf13/viper"
 )
 
+// Matches a page name: the page's path under PageDir,
+// without the .md suffix, such as "howto/ssh"
+const pageNamePattern = `[a-zA-Z0-9_-]+(?:/[a-zA-Z0-9_-]+)*`
+
 // Loads a given wiki page and returns a page object.
 // Used for building the initial cache and re-caching.
 func buildPage(filename string) (*Page, error) {
-	file, err := os.Open(filename)
+	page, err := loadPage(filename)
+	if err != nil {
+		return nil, err
+	}
+	body := page.Raw
+	shortname := page.Shortname
+
+	// longtitle is used in the <title> tags of the output html
+	confVars.mu.RLock()
+	longtitle := page.Title + " " + confVars.titleSep + " " + confVars.wikiName
+	confVars.mu.RUnlock()
+
+	page.Gemtext = toGemtext(body)
+
+	// list the page's tags and the pages linking
+	// here below the page body
+	mdbody := append(pagedata{}, body...)
+	mdbody = append(mdbody, tagsLine(page.Tags)...)
+	page.Backlinks = linkCache.backlinks(shortname)
+	mdbody = append(mdbody, backlinksSection(page.Backlinks)...)
+
+	// when the page directory is under version control,
+	// record the current revision as well
+	if historyEnabled() && !isUserPage(shortname) {
+		page.setRevision()
+		mdbody = append(mdbody, revisionFooter(string(bytes.TrimSuffix([]byte(shortname), []byte(".md"))), page.Revision, page.RevAuthor, page.RevTime)...)
+	}
+
+	// store the raw bytes of the document after parsing
+	// from markdown to HTML.
+	// keep the unparsed markdown for the gopher server.
+	// users' pages are served from the wiki's origin,
+	// so they don't get to run scripts there
+	page.Content = renderMarkdown(mdbody, tocWanted(page.TOC), isUserPage(shortname))
+	page.Body = renderPage(page, longtitle)
+	page.ETag = contentETag(page.Body)
+	return page, nil
+}
+
+// Reads a page file and fills in the fields taken from
+// its header comment, without rendering it. Used by
+// buildPage() and for the lazily loaded cache.
+func loadPage(filename string) (*Page, error) {
+	file, err := openPageFile(filename)
 	if err != nil {
 		log.Printf("%v\n", err.Error())
 		return nil, err
@@ -42,10 +93,11 @@ func buildPage(filename string) (*Page, error) {
 		log.Printf("%v\n", err.Error())
 	}
 
-	_, shortname := filepath.Split(filename)
+	shortname := pageKey(filename)
 
 	// get meta info on file from the header comment
-	title, desc, author := body.getMeta()
+	fields := body.header()
+	title, desc, author := fields["title"], fields["description"], fields["author"]
 	if title == "" {
 		title = shortname
 	}
@@ -54,53 +106,180 @@ func buildPage(filename string) (*Page, error) {
 		desc = confVars.descSep + " " + desc
 		confVars.mu.RUnlock()
 	}
+	// pages in users' wikis are always credited
+	// to the account owning the wiki
+	if name, _, ok := userPageOf(filename); ok {
+		author = name
+	}
 	if author != "" {
 		author = "`by " + author + "`"
 	}
 
-	// longtitle is used in the <title> tags of the output html
-	confVars.mu.RLock()
-	longtitle := title + " " + confVars.titleSep + " " + confVars.wikiName
-	confVars.mu.RUnlock()
+	page := newPage(filename, shortname, title, author, desc, stat.ModTime(), nil, body, false)
+	page.Tags = parseTags(fields["tags"])
+	page.Private = fields.private()
+	page.Draft, _ = headerBool(fields["draft"])
+	page.TOC = fields["toc"]
+	return page, nil
+}
 
-	// store the raw bytes of the document after parsing
-	// from markdown to HTML.
-	// keep the unparsed markdown for future use (maybe gopher?)
-	bodydata := render(body, longtitle)
-	return newPage(filename, shortname, title, author, desc, stat.ModTime(), bodydata, body, false), nil
+// Returns true if a directory entry should be
+// treated as a wiki page or a directory of them.
+// Skips hidden files and directories, such as
+// the history repository.
+func isPageFile(f os.FileInfo) bool {
+	return !strings.HasPrefix(f.Name(), ".")
 }
 
-// Scan the page until reaching following fields in the
-// header comment:
-//		title:
-//		author:
-//		description:
-func (body pagedata) getMeta() (string, string, string) {
-	// a bit redundant, but scanner is simpler to use
-	bytereader := bytes.NewReader(body)
-	metafinder := bufio.NewScanner(bytereader)
-	var title, desc, author string
-
-	for metafinder.Scan() {
-		splitter := bytes.Split(metafinder.Bytes(), []byte(":"))
-
-		switch string(bytes.ToLower(splitter[0])) {
-		case "title":
-			title = string(bytes.TrimSpace(splitter[1]))
-		case "description":
-			desc = string(bytes.TrimSpace(splitter[1]))
-		case "author":
-			author = string(bytes.TrimSpace(splitter[1]))
-		default:
+// Returns the name of a page file relative to the
+// page directory, always using forward slashes.
+// This is the key the page is cached under.
+func pageName(pageDir, longname string) string {
+	if rel, err := filepath.Rel(pageDir, longname); err == nil && !strings.HasPrefix(rel, "..") {
+		return filepath.ToSlash(rel)
+	}
+	return filepath.Base(longname)
+}
+
+// Lists every page under the page directory,
+// including those in subdirectories, by name
+// relative to it. Names are sorted by path.
+// Subdirectories and files that can't be read
+// are logged and skipped.
+func walkPages(pageDir string) ([]string, error) {
+	names := make([]string, 0)
+	err := filepath.Walk(pageDir, func(longname string, f os.FileInfo, err error) error {
+		if err != nil && longname == pageDir {
+			return err
+		}
+		if err != nil {
+			log.Printf("Skipping %v: %v\n", longname, err.Error())
+			if f != nil && f.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if longname == pageDir {
+			return nil
+		}
+		if !isPageFile(f) {
+			if f.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !f.IsDir() {
+			names = append(names, pageName(pageDir, longname))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// Returns the directory part of a page name,
+// or "" for pages at the top of PageDir
+func pageDirOf(name string) string {
+	dir := path.Dir(name)
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
+
+// Fields of the header comment at the top of a
+// page, keyed by their lowercased names
+type pageHeader map[string]string
+
+// Parses the header comment at the top of the page.
+// Field names are case-insensitive and values may
+// contain colons. Lines outside the comment are
+// not part of the header.
+func (body pagedata) header() pageHeader {
+	fields := make(pageHeader)
+	trimmed := bytes.TrimSpace(body)
+	if !bytes.HasPrefix(trimmed, []byte("<!--")) {
+		return fields
+	}
+	end := bytes.Index(trimmed, []byte("-->"))
+	if end < 0 {
+		return fields
+	}
+
+	headerfinder := bufio.NewScanner(bytes.NewReader(trimmed[4:end]))
+	for headerfinder.Scan() {
+		splitter := bytes.SplitN(headerfinder.Bytes(), []byte(":"), 2)
+		if len(splitter) < 2 {
 			continue
 		}
+		field := string(bytes.ToLower(bytes.TrimSpace(splitter[0])))
+		if _, ok := fields[field]; !ok {
+			fields[field] = string(bytes.TrimSpace(splitter[1]))
+		}
+	}
+
+	return fields
+}
 
-		if title != "" && desc != "" && author != "" {
+// Reads only the header comment at the top of a
+// page file, stopping at its end rather than
+// loading the whole page
+func readHeader(filename string) (pageHeader, error) {
+	file, err := openPageFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	opener := []byte("<!--")
+	reader := bufio.NewReader(file)
+	var head pagedata
+	for {
+		line, err := reader.ReadBytes('\n')
+		head = append(head, line...)
+		if bytes.Contains(line, []byte("-->")) || err != nil {
+			break
+		}
+		// stop as soon as the page turns out
+		// not to start with a comment
+		trimmed := bytes.TrimSpace(head)
+		if len(trimmed) > len(opener) {
+			trimmed = trimmed[:len(opener)]
+		}
+		if !bytes.HasPrefix(opener, trimmed) {
 			break
 		}
 	}
+	return head.header(), nil
+}
 
-	return title, desc, author
+// Returns true if the header marks the page private
+func (fields pageHeader) private() bool {
+	return strings.EqualFold(fields["access"], "private")
+}
+
+// Returns the following fields from the header
+// comment:
+//		title:
+//		author:
+//		description:
+func (body pagedata) getMeta() (string, string, string) {
+	fields := body.header()
+	return fields["title"], fields["description"], fields["author"]
+}
+
+// Reads a yes/no header field. The second value
+// is false if the field is missing or unclear.
+func headerBool(field string) (bool, bool) {
+	switch strings.ToLower(field) {
+	case "true", "yes", "on":
+		return true, true
+	case "false", "no", "off":
+		return false, true
+	}
+	return false, false
 }
 
 // Checks the index page's cache. Returns true if the
@@ -121,20 +300,24 @@ func (indexCache *indexCacheBlk) checkCache() bool {
 	}
 
 	// if the stored mod time is different
-	// from the file's modtime, re-cache
-	confVars.mu.RLock()
-	if stat, err := os.Stat(confVars.assetsDir + "/" + confVars.indexFile); err == nil {
-		indexCache.mu.RLock()
-		if stat.ModTime() != indexCache.page.Modtime {
+	// from the file's modtime, re-cache.
+	// the file watcher takes care of this
+	// when it's running.
+	if !watchingFiles() {
+		confVars.mu.RLock()
+		if stat, err := os.Stat(confVars.assetsDir + "/" + confVars.indexFile); err == nil {
+			indexCache.mu.RLock()
+			if stat.ModTime() != indexCache.page.Modtime {
+				indexCache.mu.RUnlock()
+				confVars.mu.RUnlock()
+				return true
+			}
 			indexCache.mu.RUnlock()
-			confVars.mu.RUnlock()
-			return true
+		} else {
+			log.Printf("Couldn't stat index page: %v\n", err.Error())
 		}
-		indexCache.mu.RUnlock()
-	} else {
-		log.Printf("Couldn't stat index page: %v\n", err.Error())
+		confVars.mu.RUnlock()
 	}
-	confVars.mu.RUnlock()
 
 	// if the last tally time or stored mod time is zero, signal
 	// to re-cache the index
@@ -151,20 +334,48 @@ func (indexCache *indexCacheBlk) checkCache() bool {
 // Re-caches the index page.
 // This method helps satisfy the cacher interface.
 func (indexCache *indexCacheBlk) cache() error {
+	index := genIndex(false)
 	confVars.mu.RLock()
-	body := render(genIndex(), confVars.wikiName+" "+confVars.titleSep+" "+confVars.wikiDesc)
+	title := confVars.wikiName + " " + confVars.titleSep + " " + confVars.wikiDesc
 	confVars.mu.RUnlock()
+	body := render(index, title)
 	if body == nil {
 		return errors.New("indexPage.cache(): getting nil bytes")
 	}
+	gemtext := toGemtext(index)
+	etag := contentETag(body)
+
+	// signed-in users also see the private pages
+	var memberBody []byte
+	var memberETag string
+	if authEnabled() {
+		memberBody = render(genIndex(true), title)
+		memberETag = contentETag(memberBody)
+	}
+
 	indexCache.mu.Lock()
+	if etag != indexCache.page.ETag || memberETag != indexCache.page.MemberETag {
+		indexCache.page.ETag = etag
+		indexCache.page.MemberETag = memberETag
+		indexCache.page.LastMod = time.Now()
+	}
 	indexCache.page.Body = body
+	indexCache.page.MemberBody = memberBody
+	indexCache.page.Gemtext = gemtext
 	indexCache.mu.Unlock()
 	return nil
 }
 
-// Generate the front page of the wiki
-func genIndex() []byte {
+// Generate the front page of the wiki. Private
+// pages are only listed for members.
+func genIndex(members bool) []byte {
+	return genFilteredIndex(members, nil)
+}
+
+// Like genIndex(), but only lists the pages keep
+// returns true for, when it isn't nil. Used by the
+// export, which leaves some pages out.
+func genFilteredIndex(members bool, keep func(name string) bool) []byte {
 	var err error
 	confVars.mu.RLock()
 	indexpath := confVars.assetsDir + "/" + confVars.indexFile
@@ -180,6 +391,9 @@ func genIndex() []byte {
 		indexCache.mu.RUnlock()
 		indexCache.mu.Lock()
 		indexCache.page.Raw, err = ioutil.ReadFile(indexpath)
+		if err == nil {
+			indexCache.page.Modtime = stat.ModTime()
+		}
 		indexCache.mu.Unlock()
 		if err != nil {
 			return []byte("Could not open \"" + indexpath + "\"")
@@ -201,7 +415,7 @@ func genIndex() []byte {
 
 	for builder.Scan() {
 		if bytes.Equal(builder.Bytes(), []byte("<!--pagelist-->")) {
-			tallyPages(buf)
+			tallyFilteredPages(buf, members, keep)
 		} else {
 			n, err := buf.Write(append(builder.Bytes(), byte('\n')))
 			if err != nil || n == 0 {
@@ -223,11 +437,29 @@ func genIndex() []byte {
 // Generate a list of pages for the index.
 // Called by genIndex() when the anchor
 // comment has been found.
-func tallyPages(buf *bytes.Buffer) {
+func tallyPages(buf *bytes.Buffer, members bool) {
+	tallyFilteredPages(buf, members, nil)
+}
+
+// Does the work of tallyPages(), leaving out the
+// pages keep returns false for when it isn't nil
+func tallyFilteredPages(buf *bytes.Buffer, members bool, keep func(name string) bool) {
 	// get a list of files in the directory specified
 	// in the config file parameter "PageDir"
-	confVars.mu.RLock()
-	if files, err := ioutil.ReadDir(confVars.pageDir); err == nil {
+	if files, err := indexFiles(); err == nil {
+		if !members {
+			files = publicNames(files)
+		}
+		files = withoutDrafts(files)
+		if keep != nil {
+			kept := make([]string, 0, len(files))
+			for _, f := range files {
+				if keep(f) {
+					kept = append(kept, f)
+				}
+			}
+			files = kept
+		}
 		// entry is used in the loop to construct the markdown
 		// link to the given page
 		if len(files) == 0 {
@@ -235,14 +467,15 @@ func tallyPages(buf *bytes.Buffer) {
 			if err != nil || n == 0 {
 				log.Printf("Error writing to buffer: %v\n", err.Error())
 			}
-			confVars.mu.RUnlock()
 			return
 		}
 
-		if confVars.reverseTally {
-			for i := len(files) - 1; i >= 0; i-- {
-				writeIndexLinks(files[i], buf)
-			}
+		confVars.mu.RLock()
+		grouped := confVars.groupIndex
+		confVars.mu.RUnlock()
+
+		if grouped {
+			writeGroupedLinks(files, buf)
 		} else {
 			for _, f := range files {
 				writeIndexLinks(f, buf)
@@ -259,55 +492,151 @@ func tallyPages(buf *bytes.Buffer) {
 	if err != nil {
 		log.Printf("Error writing to buffer: %v\n", err.Error())
 	}
-	confVars.mu.RUnlock()
 }
 
-// Takes in a file and outputs a markdown link to it.
-// Called by tallyPages() for each file in the pages
-// directory.
-func writeIndexLinks(f os.FileInfo, buf *bytes.Buffer) {
-	var page *Page
-	var err error
-	if _, exists := pageCache.pool[f.Name()]; exists {
-		page, err = pullFromCache(f.Name())
-		if err != nil {
-			log.Printf("%v\n", err.Error())
+// Lists the pages in PageDir and its subdirectories
+// in the order they appear on the index. Used by
+// tallyPages() and the gopher menu.
+func indexFiles() ([]string, error) {
+	confVars.mu.RLock()
+	pageDir := confVars.pageDir
+	reversed := confVars.reverseTally
+	confVars.mu.RUnlock()
+
+	files, err := walkPages(pageDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if reversed {
+		for i, j := 0, len(files)-1; i < j; i, j = i+1, j-1 {
+			files[i], files[j] = files[j], files[i]
 		}
-	} else {
-		// if it hasn't been cached, cache it.
-		// usually means the page is new.
-		confVars.mu.RLock()
-		newpage := newBarePage(confVars.pageDir+"/"+f.Name(), f.Name())
-		confVars.mu.RUnlock()
-		if err := newpage.cache(); err != nil {
-			log.Printf("While caching page %v during the index generation, caught an error: %v\n", f.Name(), err.Error())
+	}
+	return files, nil
+}
+
+// Writes the index links grouped by directory.
+// Top-level pages come first, followed by a
+// heading linking to each directory's listing
+// and the pages inside it.
+func writeGroupedLinks(files []string, buf *bytes.Buffer) {
+	groups := make(map[string][]string)
+	dirs := make([]string, 0)
+	for _, f := range files {
+		dir := pageDirOf(f)
+		if _, ok := groups[dir]; !ok && dir != "" {
+			dirs = append(dirs, dir)
 		}
-		page, err = pullFromCache(f.Name())
-		if err != nil {
-			log.Printf("%v\n", err.Error())
+		groups[dir] = append(groups[dir], f)
+	}
+	sort.Strings(dirs)
+
+	for _, f := range groups[""] {
+		writeIndexLinks(f, buf)
+	}
+
+	confVars.mu.RLock()
+	viewPath := confVars.viewPath
+	confVars.mu.RUnlock()
+
+	for _, dir := range dirs {
+		buf.WriteString("\n### [" + dir + "](" + viewPath + dir + ")\n\n")
+		for _, f := range groups[dir] {
+			writeIndexLinks(f, buf)
 		}
 	}
-	// get the URI path from the file name
-	// and write the formatted link to the
-	// bytes.Buffer
-	linkname := bytes.TrimSuffix([]byte(page.Shortname), []byte(".md"))
+}
+
+// Takes in a page name and outputs a markdown link
+// to it. Called by tallyPages() for each file in
+// the pages directory.
+func writeIndexLinks(f string, buf *bytes.Buffer) {
+	page := loadIndexPage(f)
+	if page == nil {
+		return
+	}
 	confVars.mu.RLock()
-	n, err := buf.WriteString("* [" + page.Title + "](" + confVars.viewPath + string(linkname) + ") " + page.Desc + " " + page.Author + "\n")
+	n, err := buf.WriteString(indexLink(page, confVars.viewPath))
 	confVars.mu.RUnlock()
 	if err != nil || n == 0 {
 		log.Printf("Error writing to buffer: %v\n", err.Error())
 	}
 }
 
+// Pulls the page for a file in PageDir from the
+// cache, caching it first if necessary. Returns
+// nil if the page couldn't be cached.
+func loadIndexPage(f string) *Page {
+	if page, err := pullFromCache(f); err == nil {
+		return page
+	}
+
+	// if it hasn't been cached, cache it.
+	// usually means the page is new.
+	newpage := newBarePage(keyFile(f), f)
+	if err := newpage.load(); err != nil {
+		log.Printf("While caching page %v during the index generation, caught an error: %v\n", f, err.Error())
+	}
+	page, err := pullFromCache(f)
+	if err != nil {
+		log.Printf("%v\n", err.Error())
+		return nil
+	}
+	return page
+}
+
+// Formats the markdown list entry linking to a page,
+// as used on the index and other page listings. The
+// header fields are escaped, as listings include pages
+// from users' wikis and are rendered with raw HTML.
+func indexLink(page *Page, viewPath string) string {
+	return "* " + pageLink(page.Title, viewPath, page.Shortname) + " " + html.EscapeString(page.Desc) + " " + html.EscapeString(page.Author) + "\n"
+}
+
+// Formats a markdown link to a page. Links to users'
+// pages are written as HTML, as blackfriday's Safelink
+// refuses relative links starting with /~.
+func pageLink(title, viewPath, name string) string {
+	if isUserPage(name) {
+		return "<a href=\"" + html.EscapeString(pageURL(viewPath, name)) + "\">" + html.EscapeString(title) + "</a>"
+	}
+	return "[" + title + "](" + pageURL(viewPath, name) + ")"
+}
+
+// Returns the URL path of a page from its cache
+// key. Pages from users' wikis live under /~user/.
+func pageURL(viewPath, name string) string {
+	name = strings.TrimSuffix(name, ".md")
+	if isUserPage(name) {
+		return "/" + name
+	}
+	return viewPath + name
+}
+
 // Caches a page.
 // This method helps satisfy the cacher interface.
 func (page *Page) cache() error {
 	// If buildPage() successfully returns a page
 	// object ptr, then push it into the cache
 	if newpage, err := buildPage(page.Longname); err == nil {
-		pageCache.mu.Lock()
-		pageCache.pool[newpage.Shortname] = newpage
-		pageCache.mu.Unlock()
+		newpage.LastMod = newpage.Modtime
+		privacyChanged := false
+		if old, err := pullFromCache(newpage.Shortname); err == nil {
+			newpage.LastMod = lastModified(old, newpage)
+			privacyChanged = old.Private != newpage.Private
+		}
+		pageCache.store(newpage)
+		recordPage(newpage)
+
+		// the pages this one links to only list
+		// it as a backlink while it's public, and
+		// the pages linking to it mark the link
+		// as missing while it's private
+		if privacyChanged {
+			markRecache(linkCache.links(newpage.Shortname))
+			markRecache(linkCache.backlinks(newpage.Shortname))
+		}
 	} else {
 		log.Printf("Couldn't cache %v: %v", page.Longname, err.Error())
 		return err
@@ -315,19 +644,52 @@ func (page *Page) cache() error {
 	return nil
 }
 
+// Returns the Last-Modified time for a re-rendered page.
+// A page can change without its file changing, such as
+// when its backlinks do, so it's only as old as its file
+// if nothing else has changed it since.
+func lastModified(old, page *Page) time.Time {
+	if old.ETag == "" || old.LastMod.Before(page.Modtime) {
+		return page.Modtime
+	}
+	if old.ETag == page.ETag {
+		return old.LastMod
+	}
+	return time.Now()
+}
+
+// Adds a page's words to the search index and
+// its links to the link graph
+func recordPage(page *Page) {
+	searchCache.add(page)
+
+	// pages this one started or stopped linking
+	// to need their backlinks re-rendered
+	confVars.mu.RLock()
+	viewPath := confVars.viewPath
+	confVars.mu.RUnlock()
+	refreshBacklinks(linkCache.update(page.Shortname, findLinks(page.Raw, viewPath)))
+}
+
 // Compare the recorded modtime of a cached page to the
 // modtime of the file on disk. If they're different,
 // return `true`, indicating the cache needs
 // to be refreshed. Also returns `true` if the
-// page.Recache field is set to `true`.
+// page was flagged with setRecache().
+// While the file watcher is running, only the
+// flag is checked.
 // This method helps satisfy the cacher interface.
 func (page *Page) checkCache() bool {
 	if page == nil {
 		return true
 	}
+	// users' wikis aren't watched
+	if watchingFiles() && !isUserPage(page.Shortname) {
+		return page.needsRecache()
+	}
 
 	if newpage, err := os.Stat(page.Longname); err == nil {
-		if newpage.ModTime() != page.Modtime || page.Recache {
+		if newpage.ModTime() != page.Modtime || page.needsRecache() {
 			return true
 		}
 	} else {
@@ -342,18 +704,20 @@ func (page *Page) checkCache() bool {
 // detect changes to a page.
 func genPageCache() {
 	// spawn a new goroutine for each entry, to cache
-	// everything as quickly as possible
+	// everything as quickly as possible. the config
+	// isn't held while rendering, as a reload waiting
+	// to write it would block the renders reading it
 	confVars.mu.RLock()
-	if wikipages, err := ioutil.ReadDir(confVars.pageDir); err == nil {
+	pageDir := confVars.pageDir
+	confVars.mu.RUnlock()
+	if wikipages, err := walkPages(pageDir); err == nil {
 		var wg sync.WaitGroup
 		for _, f := range wikipages {
 			wg.Add(1)
-			go func(f os.FileInfo) {
-				confVars.mu.RLock()
-				page := newBarePage(confVars.pageDir+"/"+f.Name(), f.Name())
-				confVars.mu.RUnlock()
-				if err := page.cache(); err != nil {
-					log.Printf("While generating initial cache, caught error for %v: %v\n", f.Name(), err.Error())
+			go func(f string) {
+				page := newBarePage(pageDir+"/"+f, f)
+				if err := page.load(); err != nil {
+					log.Printf("While generating initial cache, caught error for %v: %v\n", f, err.Error())
 				}
 				log.Printf("Cached page %v\n", page.Shortname)
 
@@ -361,23 +725,69 @@ func genPageCache() {
 			}(f)
 		}
 		wg.Wait()
+
+		// pages are cached concurrently, so some may have
+		// been rendered before the pages linking to them
+		refreshBacklinks(wikipages)
 	} else {
 		log.Printf("Initial cache build :: Can't read directory: %s\n", err.Error())
 		log.Printf("**NOTICE** TildeWiki's cache may not function correctly until this is resolved.\n")
 		log.Printf("\tPlease verify the directory in tildewiki.yml is correct and restart TildeWiki\n")
 	}
-	confVars.mu.RUnlock()
+
+	if userPagesEnabled() {
+		refreshBacklinks(genUserPageCache())
+	}
 }
 
 // Wrapper function to check the cache
 // of any cacher type, and if true,
 // re-cache the data
 func pingCache(c cacher) {
-	if c.checkCache() {
-		if err := c.cache(); err != nil {
+	if !c.checkCache() {
+		metrics.cacheCheck(cacheName(c), "hit")
+		return
+	}
+	metrics.cacheCheck(cacheName(c), "recache")
+	if err := c.cache(); err != nil {
+		log.Printf("Pinged cache, received error while caching: %v\n", err.Error())
+	}
+}
+
+// Pulls a page from the cache, re-caching it
+// first if it has changed. Re-caching swaps in
+// a new page object, so it's pulled again after.
+func freshPage(filename string) (*Page, error) {
+	page, err := pullFromCache(filename)
+	if err != nil {
+		return nil, err
+	}
+	if page.checkCache() {
+		pageCache.miss()
+		if err := page.cache(); err != nil {
 			log.Printf("Pinged cache, received error while caching: %v\n", err.Error())
 		}
+		return pullFromCache(filename)
 	}
+	pageCache.hit(filename)
+	return page, nil
+}
+
+// Returns a page with its contents rendered, for
+// building the feeds. Unlike freshPage(), it isn't
+// counted as a hit or miss and doesn't move the page
+// in the LRU list. Pages that need rendering are
+// rendered without being stored, so the feeds don't
+// evict the pages readers are viewing.
+func peekPage(filename string) (*Page, error) {
+	page, err := pullFromCache(filename)
+	if err != nil {
+		return nil, err
+	}
+	if page.Content != nil && !page.checkCache() {
+		return page, nil
+	}
+	return buildPage(page.Longname)
 }
 
 // Pulling from cache is its own function.
@@ -397,7 +807,9 @@ func pullFromCache(filename string) (*Page, error) {
 // Used to trigger a forced re-cache on the
 // next page load.
 func triggerRecache() {
+	pageCache.mu.RLock()
 	for _, v := range pageCache.pool {
-		v.Recache = true
+		v.setRecache()
 	}
+	pageCache.mu.RUnlock()
 }
@@ -97,13 +97,76 @@ func Benchmark_getMeta(b *testing.B) {
 	}
 }
 
+var headerCases = []struct {
+	name  string
+	data  pagedata
+	field string
+	want  string
+}{
+	{
+		name:  "example tags",
+		data:  metaTestBytes,
+		field: "tags",
+		want:  "example, meta",
+	},
+	{
+		name:  "missing field",
+		data:  metaTestBytes,
+		field: "access",
+		want:  "",
+	},
+	{
+		name:  "outside header",
+		data:  pagedata("# heading\n\ntags: nope\n"),
+		field: "tags",
+		want:  "",
+	},
+	{
+		name:  "colon in value",
+		data:  pagedata("<!--\n Title : Part 1: Setup\n-->\n"),
+		field: "title",
+		want:  "Part 1: Setup",
+	},
+}
+
+func Test_header(t *testing.T) {
+	for _, tt := range headerCases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.data.header()[tt.field]; got != tt.want {
+				t.Errorf("header()[%q] = %v, want %v", tt.field, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_readHeader(t *testing.T) {
+	fields, err := readHeader("pages/example.md")
+	if err != nil {
+		t.Fatalf("readHeader(): %v\n", err)
+	}
+	if fields["tags"] != "example, meta" || fields["title"] != "Example Page" {
+		t.Errorf("readHeader(): got %v\n", fields)
+	}
+	if _, err := readHeader("pages/nowhere.md"); err == nil {
+		t.Errorf("readHeader(): no error for a missing page\n")
+	}
+}
+
+func Test_getMeta_header(t *testing.T) {
+	// getMeta reads the same header as the other fields
+	data := pagedata("<!--\nTITLE: Part 1: Setup\n-->\n\ntitle: not the header\n")
+	if title, _, _ := data.getMeta(); title != "Part 1: Setup" {
+		t.Errorf("getMeta() title = %q, want %q", title, "Part 1: Setup")
+	}
+}
+
 func Test_genIndex(t *testing.T) {
 	initConfigParams()
 	log.SetOutput(hush)
 	genPageCache()
-	t.Run("genIndex() test", func(t *testing.T) {
-		if got := genIndex(); got == nil {
-			t.Errorf("genIndex(), got %v bytes.", got)
+	t.Run("genIndex(false) test", func(t *testing.T) {
+		if got := genIndex(false); got == nil {
+			t.Errorf("genIndex(false), got %v bytes.", got)
 		}
 	})
 }
@@ -114,7 +177,7 @@ func Benchmark_genIndex(b *testing.B) {
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		indexCache.page.Modtime = time.Time{}
-		genIndex()
+		genIndex(false)
 	}
 }
 
@@ -125,7 +188,7 @@ var tallyPagesBuf = bytes.NewBuffer(tallyPagesPagelist)
 // Also checks if the anchor tag was replaced in the buffer.
 func Test_tallyPages(t *testing.T) {
 	t.Run("tallyPages test", func(t *testing.T) {
-		if tallyPages(tallyPagesBuf); tallyPagesBuf == nil {
+		if tallyPages(tallyPagesBuf, false); tallyPagesBuf == nil {
 			t.Errorf("tallyPages() wrote nil to buffer\n")
 		}
 		bufscan := bufio.NewScanner(tallyPagesBuf)
@@ -143,7 +206,7 @@ func Benchmark_tallyPages(b *testing.B) {
 		// because the likelihood of
 		// tallyPages calling page.cache() for
 		// every page is near-zero
-		if tallyPages(tallyPagesBuf); tallyPagesBuf == nil {
+		if tallyPages(tallyPagesBuf, false); tallyPagesBuf == nil {
 			b.Errorf("tallyPages() benchmark failed, got nil bytes\n")
 		}
 	}
@@ -418,9 +481,33 @@ func Test_triggerRecache(t *testing.T) {
 	t.Run("triggerRecache", func(t *testing.T) {
 		triggerRecache()
 		for k, v := range pageCache.pool {
-			if !v.Recache {
+			if !v.needsRecache() {
 				t.Errorf("Recache didn't trip for %v\n", k)
 			}
 		}
 	})
 }
+
+// Flagging pages while requests check them
+// shouldn't race; run with -race
+func Test_Page_recacheConcurrent(t *testing.T) {
+	initConfigParams()
+	log.SetOutput(hush)
+	genPageCache()
+	page, err := pullFromCache("example.md")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		triggerRecache()
+		markRecache([]string{"example.md"})
+		refreshBacklinks([]string{"example.md"})
+		close(done)
+	}()
+	page.checkCache()
+	<-done
+	if !page.needsRecache() {
+		t.Errorf("needsRecache(): page wasn't flagged\n")
+	}
+}
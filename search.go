@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Number of results shown by /search
+const maxSearchResults = 50
+
+// Approximate length of a result snippet, in bytes
+const snippetLen = 200
+
+// Characters with meaning in markdown that
+// need escaping when echoing user input or
+// page text into a generated document
+var mdEscaper = strings.NewReplacer(
+	"\\", "\\\\", "`", "\\`", "*", "\\*", "_", "\\_",
+	"{", "\\{", "}", "\\}", "[", "\\[", "]", "\\]",
+	"(", "\\(", ")", "\\)", "#", "\\#", "+", "\\+",
+	"-", "\\-", ".", "\\.", "!", "\\!", "|", "\\|",
+	"<", "\\<", ">", "\\>", "&", "\\&", "~", "\\~", ":", "\\:",
+)
+
+// Splits text into lowercase words
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// Adds a page to the index, replacing whatever
+// was previously indexed under its name.
+func (idx *searchIndex) add(page *Page) {
+	counts := make(map[string]int)
+	for _, term := range tokenize(page.Title + " " + string(page.Raw)) {
+		counts[term]++
+	}
+
+	idx.mu.Lock()
+	idx.removeLocked(page.Shortname)
+	for term, n := range counts {
+		if idx.terms[term] == nil {
+			idx.terms[term] = make(map[string]int)
+		}
+		idx.terms[term][page.Shortname] = n
+	}
+	idx.docs[page.Shortname] = counts
+	idx.mu.Unlock()
+}
+
+// Removes a page from the index
+func (idx *searchIndex) remove(shortname string) {
+	idx.mu.Lock()
+	idx.removeLocked(shortname)
+	idx.mu.Unlock()
+}
+
+// Removes a page from the index. Called with idx.mu held.
+func (idx *searchIndex) removeLocked(shortname string) {
+	for term := range idx.docs[shortname] {
+		delete(idx.terms[term], shortname)
+		if len(idx.terms[term]) == 0 {
+			delete(idx.terms, term)
+		}
+	}
+	delete(idx.docs, shortname)
+}
+
+// Returns the names of the pages containing every
+// word in the query, best match first. Pages are
+// scored by term frequency weighted by how rare
+// each term is across the wiki.
+func (idx *searchIndex) query(q string) []string {
+	terms := tokenize(q)
+	if len(terms) == 0 {
+		return nil
+	}
+
+	idx.mu.RLock()
+	total := float64(len(idx.docs))
+	scores := make(map[string]float64)
+	for i, term := range terms {
+		postings := idx.terms[term]
+		idf := math.Log(1 + total/float64(len(postings)+1))
+		next := make(map[string]float64)
+		for name, n := range postings {
+			if _, ok := scores[name]; ok || i == 0 {
+				next[name] = scores[name] + float64(n)*idf
+			}
+		}
+		scores = next
+	}
+	idx.mu.RUnlock()
+
+	names := make([]string, 0, len(scores))
+	for name := range scores {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if scores[names[i]] == scores[names[j]] {
+			return names[i] < names[j]
+		}
+		return scores[names[i]] > scores[names[j]]
+	})
+	return names
+}
+
+// Removes the leading metadata comment from a page
+func stripHeader(raw []byte) []byte {
+	trimmed := bytes.TrimSpace(raw)
+	if !bytes.HasPrefix(trimmed, []byte("<!--")) {
+		return raw
+	}
+	if end := bytes.Index(trimmed, []byte("-->")); end >= 0 {
+		return trimmed[end+3:]
+	}
+	return raw
+}
+
+// Builds a short markdown excerpt of a page around
+// the first word matching the query, with matching
+// words wrapped in <mark> tags.
+func snippet(raw []byte, q string) string {
+	text := string(bytes.Join(bytes.Fields(stripHeader(raw)), []byte(" ")))
+	want := make(map[string]bool)
+	for _, term := range tokenize(q) {
+		want[term] = true
+	}
+
+	// find the byte offsets of each matching word
+	var spans [][2]int
+	start := -1
+	for i, r := range text + " " {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 && want[strings.ToLower(text[start:i])] {
+			spans = append(spans, [2]int{start, i})
+		}
+		start = -1
+	}
+
+	from := 0
+	if len(spans) > 0 && spans[0][0] > snippetLen/3 {
+		from = spans[0][0] - snippetLen/3
+	}
+	to := from + snippetLen
+	if to > len(text) {
+		to = len(text)
+	}
+	for from > 0 && !utf8.RuneStart(text[from]) {
+		from--
+	}
+	for to < len(text) && !utf8.RuneStart(text[to]) {
+		to++
+	}
+
+	out := new(strings.Builder)
+	if from > 0 {
+		out.WriteString("... ")
+	}
+	pos := from
+	for _, span := range spans {
+		if span[0] < from || span[1] > to {
+			continue
+		}
+		out.WriteString(escapeMarkdown(text[pos:span[0]]))
+		out.WriteString("<mark>" + escapeMarkdown(text[span[0]:span[1]]) + "</mark>")
+		pos = span[1]
+	}
+	out.WriteString(escapeMarkdown(text[pos:to]))
+	if to < len(text) {
+		out.WriteString(" ...")
+	}
+	return out.String()
+}
+
+// Escapes text so it displays literally when
+// placed in a markdown document
+func escapeMarkdown(text string) string {
+	return mdEscaper.Replace(text)
+}
+
+// Handler for /search?q=
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+
+	confVars.mu.RLock()
+	viewPath := confVars.viewPath
+	title := "Search " + confVars.titleSep + " " + confVars.wikiName
+	confVars.mu.RUnlock()
+
+	buf := bytes.NewBuffer(nil)
+	buf.WriteString("# Search\n\n")
+	buf.WriteString("<form method=\"get\" action=\"/search\"><input type=\"search\" name=\"q\" value=\"" + html.EscapeString(q) + "\"> <input type=\"submit\" value=\"Search\"></form>\n\n")
+
+	if q != "" {
+		names := visibleNames(r, searchCache.query(q))
+		results := make([]*Page, 0, len(names))
+		for _, name := range names {
+			page, err := pullFromCache(name)
+			if err != nil {
+				log.Printf("Search index refers to uncached page: %v\n", err.Error())
+				continue
+			}
+			results = append(results, page)
+			if len(results) == maxSearchResults {
+				break
+			}
+		}
+
+		if len(results) == 0 {
+			buf.WriteString("*No pages found for* " + escapeMarkdown(q) + "\n")
+		}
+		for _, page := range results {
+			buf.WriteString("* " + pageLink(page.Title, viewPath, page.Shortname) + " " + html.EscapeString(page.Desc) + "  \n")
+			raw := page.Raw
+			if raw == nil {
+				// pages dropped from the lazily loaded
+				// cache are only kept as metadata
+				if data, err := readPageFile(page.Longname); err == nil {
+					raw = data
+				}
+			}
+			buf.WriteString("  " + snippet(raw, q) + "\n")
+		}
+	}
+
+	w.Header().Set("Content-Type", htmlutf8)
+	if _, err := w.Write(render(buf.Bytes(), title)); err != nil {
+		log500(w, r, err)
+		return
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var tokenizeCases = []struct {
+	name string
+	text string
+	want []string
+}{
+	{
+		name: "punctuation",
+		text: "Hello, World! It's [a](/w/link)",
+		want: []string{"hello", "world", "it", "s", "a", "w", "link"},
+	},
+	{
+		name: "empty",
+		text: "  --  ",
+		want: []string{},
+	},
+}
+
+func Test_tokenize(t *testing.T) {
+	for _, tt := range tokenizeCases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tokenize(tt.text); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("tokenize() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Index a few pages and make sure only pages
+// containing every word are returned, in
+// order of relevance
+func Test_searchIndex_query(t *testing.T) {
+	idx := &searchIndex{
+		mu:    new(sync.RWMutex),
+		terms: make(map[string]map[string]int),
+		docs:  make(map[string]map[string]int),
+	}
+	idx.add(&Page{Shortname: "one.md", Raw: pagedata("gopher gopher gopher wiki")})
+	idx.add(&Page{Shortname: "two.md", Raw: pagedata("gopher wiki")})
+	idx.add(&Page{Shortname: "three.md", Raw: pagedata("just a wiki")})
+
+	if got := idx.query("gopher wiki"); !reflect.DeepEqual(got, []string{"one.md", "two.md"}) {
+		t.Errorf("searchIndex.query() = %v", got)
+	}
+	if got := idx.query("nothing"); len(got) != 0 {
+		t.Errorf("searchIndex.query() = %v, want no results", got)
+	}
+
+	// re-indexing a page should drop its old words
+	idx.add(&Page{Shortname: "one.md", Raw: pagedata("something else")})
+	if got := idx.query("gopher"); !reflect.DeepEqual(got, []string{"two.md"}) {
+		t.Errorf("searchIndex.query() after re-index = %v", got)
+	}
+}
+
+func Test_snippet(t *testing.T) {
+	raw := []byte("<!--\ntitle: Snip\n-->\n\n# Heading\n\nSome *text* about gophers and a Gopher.")
+	got := snippet(raw, "gopher")
+	if !strings.Contains(got, "<mark>Gopher</mark>") {
+		t.Errorf("snippet() didn't highlight the match: %v", got)
+	}
+	if strings.Contains(got, "title") {
+		t.Errorf("snippet() included the header comment: %v", got)
+	}
+	if !strings.Contains(got, "\\*text\\*") {
+		t.Errorf("snippet() didn't escape markdown: %v", got)
+	}
+}
+
+// Make sure pages in the cache are searchable
+// after genPageCache() runs
+func Test_searchCache(t *testing.T) {
+	initConfigParams()
+	log.SetOutput(hush)
+	genPageCache()
+	if got := searchCache.query("example"); len(got) == 0 || got[0] != "example.md" {
+		t.Errorf("searchCache.query() = %v, want example.md first", got)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Used when ShutdownTimeout isn't set or can't be parsed
+const defaultDrainTimeout = 10 * time.Second
+
+// The error log file opened at startup, if any.
+// Closed by closeLog() once the servers have stopped.
+var errorLog *logFile
+
+// Records a listener to be closed on shutdown
+func trackListener(ln net.Listener) {
+	openListeners.mu.Lock()
+	openListeners.all = append(openListeners.all, ln)
+	openListeners.mu.Unlock()
+}
+
+// Handles signals for the life of the process.
+// SIGINT and SIGTERM shut the servers down, letting
+// in-flight requests finish, then close done.
+// SIGHUP re-reads the config and rebuilds the caches.
+func handleSignals(server *http.Server, done chan<- struct{}) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1)
+
+	for sig := range c {
+		switch sig {
+		case syscall.SIGHUP:
+			log.Printf("**NOTICE** Caught %v. Reloading config and rebuilding caches ...\n", sig)
+			reloadAll()
+			continue
+		case syscall.SIGUSR1:
+			log.Printf("**NOTICE** Caught %v. Reopening log files ...\n", sig)
+			reopenLogs()
+			continue
+		}
+
+		log.Printf("**NOTICE** Caught %v. Shutting down ...\n", sig)
+		signal.Stop(c)
+		shutdown(server)
+		close(done)
+		return
+	}
+}
+
+// Stops accepting connections, then waits for
+// in-flight requests until the drain timeout
+// runs out, and closes the other listeners
+func shutdown(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout())
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Couldn't drain connections, closing them: %v\n", err.Error())
+		if err := server.Close(); err != nil {
+			log.Printf("Couldn't close HTTP server: %v\n", err.Error())
+		}
+	}
+
+	openListeners.mu.Lock()
+	for _, ln := range openListeners.all {
+		if err := ln.Close(); err != nil {
+			log.Printf("Couldn't close listener on %v: %v\n", ln.Addr(), err.Error())
+		}
+	}
+	openListeners.all = nil
+	openListeners.mu.Unlock()
+
+	stopWatchingFiles()
+}
+
+// Returns how long shutdown waits for requests to finish
+func drainTimeout() time.Duration {
+	timeout, err := time.ParseDuration(viper.GetString("ShutdownTimeout"))
+	if err != nil || timeout <= 0 {
+		return defaultDrainTimeout
+	}
+	return timeout
+}
+
+// Re-reads the config file and rebuilds every cache
+// from scratch. The old pages keep being served until
+// their replacements are ready.
+func reloadAll() {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	if err := viper.ReadInConfig(); err != nil {
+		log.Printf("Couldn't re-read config, keeping the current one: %v\n", err.Error())
+		return
+	}
+	setConfVars()
+	initHistory()
+	loadLayout()
+	errorLog.setLimits()
+	accessLog.mu.RLock()
+	accessLog.file.setLimits()
+	accessLog.mu.RUnlock()
+
+	// the page directory may have moved
+	stopWatchingFiles()
+	watchFiles()
+
+	pageCache.mu.RLock()
+	old := make([]string, 0, len(pageCache.pool))
+	for name := range pageCache.pool {
+		old = append(old, name)
+	}
+	pageCache.mu.RUnlock()
+
+	triggerRecache()
+	genPageCache()
+
+	// drop the pages that aren't there anymore
+	confVars.mu.RLock()
+	pageDir := confVars.pageDir
+	confVars.mu.RUnlock()
+	if names, err := walkPages(pageDir); err == nil {
+		current := make(map[string]bool, len(names))
+		for _, name := range names {
+			current[name] = true
+		}
+		for _, name := range old {
+			if isUserPage(name) && userPagesEnabled() {
+				if _, err := os.Stat(keyFile(name)); err == nil {
+					current[name] = true
+				}
+			}
+		}
+		for _, name := range old {
+			if !current[name] {
+				evictPages(name)
+			}
+		}
+	}
+
+	staleListings()
+	log.Printf("**NOTICE** Reload complete\n")
+}
+
+// Closes the log file, if one was opened
+func closeLog() {
+	accessLog.mu.Lock()
+	if accessLog.file != nil {
+		accessLog.out = ioutil.Discard
+		if err := accessLog.file.Close(); err != nil {
+			log.Printf("Couldn't close access log: %v\n", err.Error())
+		}
+		accessLog.file = nil
+	}
+	accessLog.mu.Unlock()
+
+	if errorLog == nil {
+		return
+	}
+	log.Printf("Closing log file ...\n")
+	log.SetOutput(ioutil.Discard)
+	if err := errorLog.Close(); err != nil {
+		log.SetOutput(os.Stderr)
+		log.Printf("Couldn't close log file: %v\n", err.Error())
+	}
+	errorLog = nil
+}
+
+// Reopens the log files at their configured paths,
+// for use after an external tool has rotated them
+func reopenLogs() {
+	if errorLog != nil {
+		if err := errorLog.reopen(); err != nil {
+			log.SetOutput(os.Stderr)
+			log.Printf("Couldn't reopen log file: %v\n", err.Error())
+		}
+	}
+
+	accessLog.mu.RLock()
+	file := accessLog.file
+	accessLog.mu.RUnlock()
+	if file != nil {
+		if err := file.reopen(); err != nil {
+			log.Printf("Couldn't reopen access log: %v\n", err.Error())
+		}
+	}
+}
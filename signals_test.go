@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Shuts the server down while a request is in
+// flight, checking the request still completes
+// and the tracked listeners are closed
+func Test_shutdown(t *testing.T) {
+	initConfigParams()
+	log.SetOutput(hush)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	extra, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	trackListener(extra)
+
+	started := make(chan struct{})
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		_, _ = w.Write([]byte("finished"))
+	})}
+	go func() {
+		_ = server.Serve(ln)
+	}()
+
+	result := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/")
+		if err != nil {
+			result <- err.Error()
+			return
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		result <- string(body)
+	}()
+
+	<-started
+	shutdown(server)
+
+	if got := <-result; got != "finished" {
+		t.Errorf("shutdown(): in-flight request got %q\n", got)
+	}
+	if _, err := extra.Accept(); err == nil {
+		t.Errorf("shutdown(): tracked listener is still open\n")
+	}
+}
+
+// Make sure a reload drops pages that
+// aren't on disk anymore and keeps the rest
+func Test_reloadAll(t *testing.T) {
+	initConfigParams()
+	log.SetOutput(hush)
+	genPageCache()
+	defer stopWatchingFiles()
+
+	pageCache.mu.Lock()
+	pageCache.pool["ghost.md"] = newBarePage("pages/ghost.md", "ghost.md")
+	pageCache.mu.Unlock()
+
+	reloadAll()
+
+	if _, err := pullFromCache("ghost.md"); err == nil {
+		t.Errorf("reloadAll(): kept a page that doesn't exist\n")
+	}
+	page, err := pullFromCache("example.md")
+	if err != nil || page.needsRecache() {
+		t.Errorf("reloadAll(): example.md wasn't rebuilt: %v\n", err)
+	}
+}
+
+// Runs a SIGHUP reload, a config file reload and
+// page renders at once. Run with -race to check
+// the config is only written under its lock.
+func Test_reloadAll_concurrent(t *testing.T) {
+	initConfigParams()
+	log.SetOutput(hush)
+	genPageCache()
+	defer stopWatchingFiles()
+
+	done := make(chan struct{})
+	reloaded := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			reloadAll()
+			wg.Done()
+		}()
+		go func() {
+			reloadConf()
+			wg.Done()
+		}()
+		wg.Wait()
+		close(reloaded)
+	}()
+	go func() {
+		// render until both reloads are done
+		for {
+			if _, err := buildPage("pages/example.md"); err != nil {
+				t.Errorf("buildPage(): %v\n", err)
+			}
+			select {
+			case <-reloaded:
+				close(done)
+				return
+			default:
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("reloadAll(): deadlocked with reloadConf() and renders\n")
+	}
+}
+
+func Test_drainTimeout(t *testing.T) {
+	initConfigParams()
+	if got := drainTimeout(); got <= 0 {
+		t.Errorf("drainTimeout(): got %v\n", got)
+	}
+}
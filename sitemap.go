@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+)
+
+// content-type constants for the crawler files
+const xmlutf8 = "application/xml; charset=utf-8"
+const textutf8 = "text/plain; charset=utf-8"
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+// Paths crawlers are asked to skip when there's no
+// robots.txt in AssetsDir. They're either duplicates
+// of the pages or need signing in.
+var robotsDisallow = []string{
+	"/raw/",
+	"/api/",
+	"/edit/",
+	"/history/",
+	"/revert/",
+	"/backlinks/",
+	"/search",
+	"/login",
+	"/logout",
+}
+
+// Returns the pages search engines should know
+// about, sorted by name. Private pages and drafts
+// are left out.
+func listedPages() []*Page {
+	pageCache.mu.RLock()
+	pages := make([]*Page, 0, len(pageCache.pool))
+	for _, page := range pageCache.pool {
+		if !page.Private && !page.Draft {
+			pages = append(pages, page)
+		}
+	}
+	pageCache.mu.RUnlock()
+
+	sort.Slice(pages, func(i, j int) bool {
+		return pages[i].Shortname < pages[j].Shortname
+	})
+	return pages
+}
+
+// Returns true if a page is marked as a draft.
+// Like isPrivate(), only the header is read when
+// the page isn't cached.
+func isDraft(name string) bool {
+	if page, err := pullFromCache(name); err == nil {
+		return page.Draft
+	}
+	fields, err := readHeader(keyFile(name))
+	if err != nil {
+		return false
+	}
+	draft, _ := headerBool(fields["draft"])
+	return draft
+}
+
+// Drops the drafts from a list of page names.
+// Drafts can be viewed, but aren't listed.
+func withoutDrafts(names []string) []string {
+	out := make([]string, 0, len(names))
+	for _, name := range names {
+		if !isDraft(name) {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// The public address of the wiki. Sitemaps need
+// absolute URLs, and the Host header can't be
+// trusted to build them, so without BaseURL
+// there's no sitemap.
+func siteURL() string {
+	confVars.mu.RLock()
+	defer confVars.mu.RUnlock()
+	return confVars.baseURL
+}
+
+// Builds the sitemap from the page cache, with
+// the front page first
+func genSitemap(baseURL string) ([]byte, error) {
+	confVars.mu.RLock()
+	viewPath := confVars.viewPath
+	confVars.mu.RUnlock()
+
+	pages := listedPages()
+	set := sitemapURLSet{
+		URLs: make([]sitemapURL, 0, len(pages)+1),
+	}
+
+	var newest time.Time
+	for _, page := range pages {
+		if page.Modtime.After(newest) {
+			newest = page.Modtime
+		}
+	}
+	set.URLs = append(set.URLs, sitemapURL{Loc: baseURL + "/", LastMod: sitemapTime(newest)})
+
+	for _, page := range pages {
+		set.URLs = append(set.URLs, sitemapURL{
+			Loc:     baseURL + pageURL(viewPath, page.Shortname),
+			LastMod: sitemapTime(page.Modtime),
+		})
+	}
+
+	out, err := xml.MarshalIndent(set, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), out...), nil
+}
+
+// Formats a lastmod date, leaving out unknown ones
+func sitemapTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// Builds a robots.txt allowing the pages and
+// pointing crawlers at the sitemap, if there is one
+func genRobots(baseURL string) []byte {
+	buf := bytes.NewBuffer(nil)
+	buf.WriteString("User-agent: *\n")
+	for _, path := range robotsDisallow {
+		buf.WriteString("Disallow: " + path + "\n")
+	}
+	if baseURL != "" {
+		buf.WriteString("\nSitemap: " + baseURL + "/sitemap.xml\n")
+	}
+	return buf.Bytes()
+}
+
+// Serves the sitemap of public pages
+func sitemapHandler(w http.ResponseWriter, r *http.Request) {
+	baseURL := siteURL()
+	if baseURL == "" {
+		log.Printf("**NOTICE** /sitemap.xml requested, but BaseURL isn't set in the config\n")
+		error404(w, r)
+		return
+	}
+
+	sitemap, err := genSitemap(baseURL)
+	if err != nil {
+		log500(w, r, err)
+		return
+	}
+
+	if notModified(w, r, contentETag(sitemap), time.Time{}) {
+		return
+	}
+	w.Header().Set("Content-Type", xmlutf8)
+	if err := writeBody(w, r, sitemap); err != nil {
+		log500(w, r, err)
+		return
+	}
+}
+
+// Serves robots.txt from AssetsDir, or
+// generates one if there isn't a file
+func robotsHandler(w http.ResponseWriter, r *http.Request) {
+	confVars.mu.RLock()
+	longname := confVars.assetsDir + "/robots.txt"
+	confVars.mu.RUnlock()
+
+	var modtime time.Time
+	robots, err := ioutil.ReadFile(longname)
+	switch {
+	case err == nil:
+		if stat, err := os.Stat(longname); err == nil {
+			modtime = stat.ModTime()
+		}
+	case os.IsNotExist(err):
+		robots = genRobots(siteURL())
+	default:
+		log500(w, r, err)
+		return
+	}
+
+	if notModified(w, r, contentETag(robots), modtime) {
+		return
+	}
+	w.Header().Set("Content-Type", textutf8)
+	if err := writeBody(w, r, robots); err != nil {
+		log500(w, r, err)
+		return
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func Test_sitemapHandler(t *testing.T) {
+	defer privatePageDir(t)()
+
+	confVars.mu.RLock()
+	draft := confVars.pageDir + "/unfinished.md"
+	confVars.mu.RUnlock()
+	if err := ioutil.WriteFile(draft, []byte("<!--\ntitle: Unfinished\ndraft: yes\n-->\n# Soon\n"), 0644); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	page := newBarePage(draft, "unfinished.md")
+	if err := page.load(); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer evictPages("unfinished.md")
+
+	confVars.mu.Lock()
+	oldBase := confVars.baseURL
+	confVars.baseURL = "https://wiki.example.com"
+	confVars.mu.Unlock()
+	defer func() {
+		confVars.mu.Lock()
+		confVars.baseURL = oldBase
+		confVars.mu.Unlock()
+	}()
+
+	w := httptest.NewRecorder()
+	sitemapHandler(w, httptest.NewRequest("GET", "/sitemap.xml", nil))
+	body := w.Body.String()
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != xmlutf8 {
+		t.Fatalf("sitemapHandler(): got %v %v\n", w.Code, w.Header().Get("Content-Type"))
+	}
+	for _, want := range []string{
+		"<loc>https://wiki.example.com/</loc>",
+		"<loc>https://wiki.example.com/w/open</loc>",
+		"<lastmod>",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("sitemapHandler(): missing %q in:\n%s\n", want, body)
+		}
+	}
+	for _, hidden := range []string{"secret", "unfinished"} {
+		if strings.Contains(body, hidden) {
+			t.Errorf("sitemapHandler(): listed %v:\n%s\n", hidden, body)
+		}
+	}
+}
+
+func Test_robotsHandler(t *testing.T) {
+	initConfigParams()
+
+	confVars.mu.Lock()
+	oldBase := confVars.baseURL
+	confVars.baseURL = ""
+	confVars.mu.Unlock()
+	defer func() {
+		confVars.mu.Lock()
+		confVars.baseURL = oldBase
+		confVars.mu.Unlock()
+	}()
+
+	w := httptest.NewRecorder()
+	robotsHandler(w, httptest.NewRequest("GET", "http://wiki.test/robots.txt", nil))
+	body := w.Body.String()
+	if !strings.Contains(body, "Disallow: /edit/\n") || strings.Contains(body, "Sitemap:") {
+		t.Errorf("robotsHandler(): generated without BaseURL:\n%s\n", body)
+	}
+	w = httptest.NewRecorder()
+	sitemapHandler(w, httptest.NewRequest("GET", "http://wiki.test/sitemap.xml", nil))
+	if strings.Contains(w.Body.String(), "wiki.test") {
+		t.Errorf("sitemapHandler(): built from the Host header:\n%s\n", w.Body.String())
+	}
+
+	confVars.mu.Lock()
+	confVars.baseURL = "https://wiki.example.com"
+	confVars.mu.Unlock()
+	w = httptest.NewRecorder()
+	robotsHandler(w, httptest.NewRequest("GET", "http://wiki.test/robots.txt", nil))
+	if !strings.Contains(w.Body.String(), "\nSitemap: https://wiki.example.com/sitemap.xml\n") {
+		t.Errorf("robotsHandler(): generated:\n%s\n", w.Body.String())
+	}
+
+	// a file in AssetsDir wins
+	dir, err := ioutil.TempDir("", "tildewiki-robots")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(dir+"/robots.txt", []byte("User-agent: *\nDisallow: /\n"), 0644); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	confVars.mu.Lock()
+	oldAssets := confVars.assetsDir
+	confVars.assetsDir = dir
+	confVars.mu.Unlock()
+	defer func() {
+		confVars.mu.Lock()
+		confVars.assetsDir = oldAssets
+		confVars.mu.Unlock()
+	}()
+
+	w = httptest.NewRecorder()
+	robotsHandler(w, httptest.NewRequest("GET", "/robots.txt", nil))
+	if w.Body.String() != "User-agent: *\nDisallow: /\n" {
+		t.Errorf("robotsHandler(): served %q instead of the file\n", w.Body.String())
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Tags are limited to the characters allowed in URLs
+var validTag = regexp.MustCompile("^[a-z0-9_-]+$")
+
+// Splits the tags: header field into lowercase tags.
+// Tags may be separated by commas, spaces, or both.
+// Invalid and duplicate tags are dropped.
+func parseTags(field string) []string {
+	seen := make(map[string]bool)
+	tags := make([]string, 0)
+	for _, tag := range strings.FieldsFunc(strings.ToLower(field), func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	}) {
+		if validTag.MatchString(tag) && !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// Markdown appended to a page linking to
+// the listing of each of its tags
+func tagsLine(tags []string) []byte {
+	if len(tags) == 0 {
+		return nil
+	}
+	links := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		links = append(links, "["+tag+"](/tag/"+tag+")")
+	}
+	return []byte("\n\n---\n\n**Tags:** " + strings.Join(links, ", ") + "\n")
+}
+
+// Returns the cached pages carrying a tag, in the
+// same order as the index page listing. Private
+// pages are only included for members.
+func taggedPages(tag string, members bool) []*Page {
+	pageCache.mu.RLock()
+	pages := make([]*Page, 0)
+	for _, page := range pageCache.pool {
+		if page.Private && !members {
+			continue
+		}
+		for _, t := range page.Tags {
+			if t == tag {
+				pages = append(pages, page)
+				break
+			}
+		}
+	}
+	pageCache.mu.RUnlock()
+
+	confVars.mu.RLock()
+	reversed := confVars.reverseTally
+	confVars.mu.RUnlock()
+	sort.Slice(pages, func(i, j int) bool {
+		if reversed {
+			return pages[i].Shortname > pages[j].Shortname
+		}
+		return pages[i].Shortname < pages[j].Shortname
+	})
+	return pages
+}
+
+// Counts the cached pages carrying each tag,
+// leaving out private pages unless for members
+func tagCounts(members bool) map[string]int {
+	counts := make(map[string]int)
+	pageCache.mu.RLock()
+	for _, page := range pageCache.pool {
+		if page.Private && !members {
+			continue
+		}
+		for _, tag := range page.Tags {
+			counts[tag]++
+		}
+	}
+	pageCache.mu.RUnlock()
+	return counts
+}
+
+// Lists every page with the requested tag
+func tagHandler(w http.ResponseWriter, r *http.Request) {
+	tag := strings.ToLower(mux.Vars(r)["name"])
+
+	confVars.mu.RLock()
+	viewPath := confVars.viewPath
+	title := "Pages tagged " + tag + " " + confVars.titleSep + " " + confVars.wikiName
+	confVars.mu.RUnlock()
+
+	pages := taggedPages(tag, requestUser(r) != "")
+	if len(pages) == 0 {
+		error404(w, r)
+		return
+	}
+
+	buf := bytes.NewBuffer(nil)
+	buf.WriteString("# Pages tagged " + tag + "\n\n")
+	for _, page := range pages {
+		buf.WriteString(indexLink(page, viewPath))
+	}
+	buf.WriteString("\n[All tags](/tags)\n")
+
+	w.Header().Set("Content-Type", htmlutf8)
+	if _, err := w.Write(render(buf.Bytes(), title)); err != nil {
+		log500(w, r, err)
+		return
+	}
+}
+
+// Lists every tag in use, with the number of
+// pages carrying it
+func tagsHandler(w http.ResponseWriter, r *http.Request) {
+	confVars.mu.RLock()
+	title := "Tags " + confVars.titleSep + " " + confVars.wikiName
+	confVars.mu.RUnlock()
+
+	counts := tagCounts(requestUser(r) != "")
+	tags := make([]string, 0, len(counts))
+	for tag := range counts {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	buf := bytes.NewBuffer(nil)
+	buf.WriteString("# Tags\n\n")
+	if len(tags) == 0 {
+		buf.WriteString("*No pages have been tagged.*\n")
+	}
+	for _, tag := range tags {
+		buf.WriteString("* [" + tag + "](/tag/" + tag + ") (" + strconv.Itoa(counts[tag]) + ")\n")
+	}
+
+	w.Header().Set("Content-Type", htmlutf8)
+	if _, err := w.Write(render(buf.Bytes(), title)); err != nil {
+		log500(w, r, err)
+		return
+	}
+}
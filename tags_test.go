@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log"
+	"reflect"
+	"testing"
+)
+
+var parseTagsCases = []struct {
+	name  string
+	field string
+	want  []string
+}{
+	{
+		name:  "commas and spaces",
+		field: "Linux, ssh howto,ssh",
+		want:  []string{"howto", "linux", "ssh"},
+	},
+	{
+		name:  "invalid",
+		field: "ok, not/ok, <script>",
+		want:  []string{"ok"},
+	},
+	{
+		name:  "empty",
+		field: "",
+		want:  []string{},
+	},
+}
+
+func Test_parseTags(t *testing.T) {
+	for _, tt := range parseTagsCases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseTags(tt.field); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseTags() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// The example page is tagged, so it should
+// show up in the tag listing and counts
+func Test_taggedPages(t *testing.T) {
+	initConfigParams()
+	log.SetOutput(hush)
+	genPageCache()
+
+	pages := taggedPages("example", false)
+	if len(pages) != 1 || pages[0].Shortname != "example.md" {
+		t.Errorf("taggedPages() returned %v pages", len(pages))
+	}
+	if got := tagCounts(false)["meta"]; got != 1 {
+		t.Errorf("tagCounts() = %v for meta, want 1", got)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimum time between checks for a renewed certificate
+const certCheckInterval = 10 * time.Second
+
+// Holds a certificate loaded from disk, reloading it
+// when either file changes so a renewed certificate
+// is picked up without a restart
+type certReloader struct {
+	mu       *sync.RWMutex
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	modtime  time.Time
+	checked  time.Time
+}
+
+// Loads the certificate and key, failing if
+// they can't be used
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &certReloader{
+		mu:       new(sync.RWMutex),
+		certFile: certFile,
+		keyFile:  keyFile,
+		cert:     &cert,
+		modtime:  certModtime(certFile, keyFile),
+		checked:  time.Now(),
+	}, nil
+}
+
+// Returns the newer of the certificate
+// and key files' modification times
+func certModtime(certFile, keyFile string) time.Time {
+	var modtime time.Time
+	for _, file := range []string{certFile, keyFile} {
+		if stat, err := os.Stat(file); err == nil && stat.ModTime().After(modtime) {
+			modtime = stat.ModTime()
+		}
+	}
+	return modtime
+}
+
+// Reloads the certificate if either file has
+// changed since it was last loaded. A pair that
+// doesn't load, such as when only one of the
+// files has been replaced so far, leaves the
+// current certificate in use.
+func (cr *certReloader) reload() {
+	modtime := certModtime(cr.certFile, cr.keyFile)
+
+	cr.mu.RLock()
+	unchanged := modtime.Equal(cr.modtime)
+	cr.mu.RUnlock()
+	if unchanged {
+		return
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		log.Printf("Couldn't reload certificate %v, keeping the current one: %v\n", cr.certFile, err.Error())
+		return
+	}
+
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.modtime = modtime
+	cr.mu.Unlock()
+	log.Printf("**NOTICE** Reloaded certificate %v\n", cr.certFile)
+}
+
+// Hands out the current certificate, checking
+// for a renewed one every so often.
+// Used as tls.Config.GetCertificate.
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	due := time.Since(cr.checked) >= certCheckInterval
+	if due {
+		cr.checked = time.Now()
+	}
+	cr.mu.Unlock()
+
+	if due {
+		cr.reload()
+	}
+
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// TLS settings shared by the HTTPS and gemini servers
+func (cr *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: cr.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// Redirects plain HTTP requests to the same
+// URL on the HTTPS port
+func redirectHandler(httpsPort string) http.Handler {
+	port := strings.TrimPrefix(httpsPort, ":")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// Listens for plain HTTP requests on the given
+// address and redirects them to HTTPS. The listener
+// is closed along with the others on shutdown.
+func serveRedirects(addr, httpsPort string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	trackListener(ln)
+
+	server := &http.Server{
+		Handler:      redirectHandler(httpsPort),
+		WriteTimeout: 15 * time.Second,
+		ReadTimeout:  15 * time.Second,
+	}
+	return server.Serve(ln)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// Writes a self-signed certificate and its key
+// with the given serial number
+func writeTestCert(t *testing.T, certFile, keyFile string, serial int64) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+}
+
+// Returns the serial number of the certificate
+// the reloader hands out
+func servedSerial(t *testing.T, cr *certReloader) int64 {
+	cert, err := cr.getCertificate(nil)
+	if err != nil {
+		t.Fatalf("getCertificate(): %v\n", err)
+	}
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	return parsed.SerialNumber.Int64()
+}
+
+// Replaces the certificate on disk and checks
+// the new one is served, while a broken pair
+// leaves the current one in place
+func Test_certReloader(t *testing.T) {
+	log.SetOutput(hush)
+
+	dir, err := ioutil.TempDir("", "tildewiki-tls")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := dir+"/cert.pem", dir+"/key.pem"
+
+	writeTestCert(t, certFile, keyFile, 1)
+	cr, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("newCertReloader(): %v\n", err)
+	}
+	if got := servedSerial(t, cr); got != 1 {
+		t.Errorf("getCertificate(): got serial %v, want 1\n", got)
+	}
+
+	// a renewed certificate, with the files'
+	// times moved forward so the change shows
+	// regardless of the filesystem's resolution
+	writeTestCert(t, certFile, keyFile, 2)
+	later := time.Now().Add(time.Minute)
+	for _, file := range []string{certFile, keyFile} {
+		if err := os.Chtimes(file, later, later); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+	}
+	if got := servedSerial(t, cr); got != 1 {
+		t.Errorf("getCertificate(): checked for a new certificate too soon\n")
+	}
+	cr.mu.Lock()
+	cr.checked = time.Time{}
+	cr.mu.Unlock()
+	if got := servedSerial(t, cr); got != 2 {
+		t.Errorf("getCertificate(): got serial %v after renewal, want 2\n", got)
+	}
+
+	// half-written renewal
+	if err := ioutil.WriteFile(keyFile, []byte("not a key"), 0600); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	evenLater := later.Add(time.Minute)
+	if err := os.Chtimes(keyFile, evenLater, evenLater); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	cr.reload()
+	if got := servedSerial(t, cr); got != 2 {
+		t.Errorf("reload(): broken pair replaced the certificate\n")
+	}
+
+	if _, err := newCertReloader(certFile, keyFile); err == nil {
+		t.Errorf("newCertReloader(): accepted a broken key\n")
+	}
+}
+
+func Test_redirectHandler(t *testing.T) {
+	tests := []struct {
+		port string
+		host string
+		path string
+		want string
+	}{
+		{":443", "wiki.example.com", "/w/example?x=1", "https://wiki.example.com/w/example?x=1"},
+		{":443", "wiki.example.com:80", "/", "https://wiki.example.com/"},
+		{":8443", "wiki.example.com:8080", "/w/example", "https://wiki.example.com:8443/w/example"},
+		{":8443", "[::1]:8080", "/", "https://[::1]:8443/"},
+		{":443", "[::1]", "/", "https://[::1]/"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", tt.path, nil)
+		r.Host = tt.host
+		redirectHandler(tt.port).ServeHTTP(w, r)
+		if w.Code != 301 || w.Header().Get("Location") != tt.want {
+			t.Errorf("redirectHandler(%q) for %v%v: got %v %v, want %v\n", tt.port, tt.host, tt.path, w.Code, w.Header().Get("Location"), tt.want)
+		}
+	}
+}
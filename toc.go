@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"io"
+	"regexp"
+	"strconv"
+
+	bf "github.com/gbmor-forks/blackfriday.v2-patched"
+	"github.com/shurcooL/sanitized_anchor_name"
+)
+
+// The anchor comment replaced with the table of
+// contents, much like <!--pagelist--> on the index
+const tocAnchor = "<!--toc-->"
+
+// Wraps blackfriday's renderer to follow each
+// heading with a permalink to its anchor. The
+// stylesheet shows the link on hover. Fenced
+// code blocks with a language are highlighted
+// when highlight is set. With skipHTML set, raw
+// HTML is dropped apart from the links the wiki
+// writes itself.
+type wikiRenderer struct {
+	*bf.HTMLRenderer
+	highlight bool
+	skipHTML  bool
+}
+
+// Matches the inline HTML written by wikiLinks()
+// and pageLink(): local links only, no attributes
+// beyond the wikilink class
+var wikiLinkTagRegex = regexp.MustCompile(`^(?:<a href="/(?:[^/"<>:][^"<>:]*)?"(?: class="wikilink(?: new)?")?>|</a>)$`)
+
+// RenderNode satisfies bf.Renderer
+func (r *wikiRenderer) RenderNode(w io.Writer, node *bf.Node, entering bool) bf.WalkStatus {
+	if r.skipHTML {
+		switch node.Type {
+		case bf.HTMLBlock:
+			if !bytes.Equal(bytes.TrimSpace(node.Literal), []byte(tocAnchor)) {
+				return bf.GoToNext
+			}
+		case bf.HTMLSpan:
+			if !wikiLinkTagRegex.Match(node.Literal) {
+				return bf.GoToNext
+			}
+		}
+	}
+	if node.Type == bf.Heading && !entering && node.HeadingID != "" {
+		io.WriteString(w, ` <a class="permalink" href="#`+html.EscapeString(node.HeadingID)+`" title="Permalink to this section">&para;</a>`)
+	}
+	if node.Type == bf.CodeBlock && r.highlight && highlightCode(w, node.Info, node.Literal) {
+		return bf.GoToNext
+	}
+	return r.HTMLRenderer.RenderNode(w, node, entering)
+}
+
+// Decides whether a page gets a table of contents
+// from its toc: header field, falling back to the
+// TableOfContents config default
+func tocWanted(field string) bool {
+	if wanted, ok := headerBool(field); ok {
+		return wanted
+	}
+	confVars.mu.RLock()
+	defer confVars.mu.RUnlock()
+	return confVars.tableOfContents
+}
+
+// Gives every heading an anchor ID made from its
+// text, numbering repeats the way GitHub does.
+// IDs only change when the heading text does, so
+// links to them keep working as a page grows.
+// IDs set with {#id} are kept.
+func assignHeadingIDs(ast *bf.Node) {
+	seen := make(map[string]int)
+	ast.Walk(func(node *bf.Node, entering bool) bf.WalkStatus {
+		if node.Type != bf.Heading || !entering || node.IsTitleblock {
+			return bf.GoToNext
+		}
+		id := node.HeadingID
+		if id == "" {
+			id = sanitized_anchor_name.Create(headingText(node))
+		}
+		if id == "" {
+			id = "section"
+		}
+		base := id
+		for seen[id] > 0 {
+			id = base + "-" + strconv.Itoa(seen[base])
+			seen[base]++
+		}
+		seen[id]++
+		node.HeadingID = id
+		return bf.SkipChildren
+	})
+}
+
+// Returns the plain text of a heading
+func headingText(heading *bf.Node) string {
+	buf := bytes.NewBuffer(nil)
+	heading.Walk(func(node *bf.Node, entering bool) bf.WalkStatus {
+		if entering && (node.Type == bf.Text || node.Type == bf.Code) {
+			buf.Write(node.Literal)
+		}
+		return bf.GoToNext
+	})
+	return buf.String()
+}
+
+// Builds the table of contents as nested lists
+// of links to the headings. Returns nil if the
+// document has no headings. With skipHTML set, raw
+// HTML in the headings is dropped, as in the body.
+func tableOfContents(ast *bf.Node, skipHTML bool) []byte {
+	inline := bf.NewHTMLRenderer(bf.HTMLRendererParameters{Flags: bf.Safelink})
+	buf := bytes.NewBuffer(nil)
+	level := 0
+	count := 0
+
+	ast.Walk(func(node *bf.Node, entering bool) bf.WalkStatus {
+		if node.Type != bf.Heading || !entering || node.IsTitleblock {
+			return bf.GoToNext
+		}
+		switch {
+		case level == 0:
+			// the first heading opens as many lists as
+			// its level, so later shallower headings
+			// still have one to close
+			for ; level < node.Level; level++ {
+				buf.WriteString("<ul>\n<li>")
+			}
+		case node.Level > level:
+			for ; level < node.Level; level++ {
+				buf.WriteString("\n<ul>\n<li>")
+			}
+		default:
+			for ; level > node.Level; level-- {
+				buf.WriteString("</li>\n</ul>")
+			}
+			buf.WriteString("</li>\n<li>")
+		}
+		count++
+
+		buf.WriteString(`<a href="#` + html.EscapeString(node.HeadingID) + `">`)
+		for child := node.FirstChild; child != nil; child = child.Next {
+			child.Walk(func(n *bf.Node, entering bool) bf.WalkStatus {
+				// links inside a link aren't allowed
+				if n.Type == bf.Link || (skipHTML && n.Type == bf.HTMLSpan) {
+					return bf.GoToNext
+				}
+				return inline.RenderNode(buf, n, entering)
+			})
+		}
+		buf.WriteString("</a>")
+		return bf.SkipChildren
+	})
+
+	if count == 0 {
+		return nil
+	}
+	for ; level > 0; level-- {
+		buf.WriteString("</li>\n</ul>")
+	}
+	return []byte("<nav class=\"toc\">\n" + buf.String() + "\n</nav>\n")
+}
+
+// Puts the table of contents where the anchor
+// comment is, or at the top without one
+func placeTOC(out, toc []byte) []byte {
+	if toc == nil {
+		return out
+	}
+	if i := bytes.Index(out, []byte(tocAnchor)); i >= 0 {
+		placed := make([]byte, 0, len(out)+len(toc))
+		placed = append(placed, out[:i]...)
+		placed = append(placed, toc...)
+		return append(placed, out[i+len(tocAnchor):]...)
+	}
+	return append(toc, out...)
+}
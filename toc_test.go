@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+var tocDoc = []byte(`# Setup
+
+<!--toc-->
+
+## Install *it*
+
+### From [source](https://example.com)
+
+## Install it
+
+# Usage
+
+Some text.
+`)
+
+func Test_renderMarkdown_toc(t *testing.T) {
+	initConfigParams()
+
+	out := renderMarkdown(tocDoc, true, false)
+	for _, want := range []string{
+		`<h1 id="setup">Setup <a class="permalink" href="#setup"`,
+		`<h2 id="install-it">`,
+		`<h2 id="install-it-1">`,
+		`<h3 id="from-source">`,
+		`<a href="#install-it">Install <em>it</em></a>`,
+		`<a href="#from-source">From source</a>`,
+	} {
+		if !bytes.Contains(out, []byte(want)) {
+			t.Errorf("renderMarkdown(): missing %q in:\n%s\n", want, out)
+		}
+	}
+
+	// the table replaces the anchor, after the first heading
+	nav := bytes.Index(out, []byte(`<nav class="toc">`))
+	if nav < 0 || nav < bytes.Index(out, []byte("<h1")) || bytes.Contains(out, []byte(tocAnchor)) {
+		t.Errorf("renderMarkdown(): table of contents misplaced:\n%s\n", out)
+	}
+	if strings.Count(string(out), "<ul>") != strings.Count(string(out), "</ul>") {
+		t.Errorf("renderMarkdown(): unbalanced lists:\n%s\n", out)
+	}
+
+	if out := renderMarkdown(tocDoc, false, false); bytes.Contains(out, []byte("<nav")) {
+		t.Errorf("renderMarkdown(): table of contents without asking for one\n")
+	}
+	if out := renderMarkdown([]byte("no headings\n"), true, false); bytes.Contains(out, []byte("<nav")) {
+		t.Errorf("renderMarkdown(): empty table of contents\n")
+	}
+}
+
+// Pages starting below the top heading level still
+// get balanced lists
+func Test_tableOfContents_levels(t *testing.T) {
+	out := string(renderMarkdown([]byte("### Deep\n\n# Top\n\n## Middle\n"), true, false))
+	if strings.Count(out, "<ul>") != strings.Count(out, "</ul>") || strings.Count(out, "<li>") != strings.Count(out, "</li>") {
+		t.Errorf("tableOfContents(): unbalanced lists:\n%s\n", out)
+	}
+	if !strings.HasPrefix(out, `<nav class="toc">`) {
+		t.Errorf("tableOfContents(): not placed at the top without an anchor:\n%s\n", out)
+	}
+}
+
+func Test_tocWanted(t *testing.T) {
+	initConfigParams()
+	confVars.mu.Lock()
+	confVars.tableOfContents = true
+	confVars.mu.Unlock()
+	defer initConfigParams()
+
+	for field, want := range map[string]bool{"": true, "no": false, "False": false, "yes": true, "maybe": true} {
+		if got := tocWanted(field); got != want {
+			t.Errorf("tocWanted(%q): got %v, want %v\n", field, got, want)
+		}
+	}
+}
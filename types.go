@@ -1,15 +1,26 @@
 package main
 
 import (
+	"container/list"
+	"crypto/sha256"
+	"html/template"
+	"io"
+	"net"
+	"os"
 	"regexp"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/fsnotify/fsnotify"
 )
 
 // The in-memory page cache
 var pageCache = &pagesCache{
-	mu:   new(sync.RWMutex),
-	pool: make(map[string]*Page),
+	mu:    new(sync.RWMutex),
+	pool:  make(map[string]*Page),
+	lru:   list.New(),
+	elems: make(map[string]*list.Element),
 }
 
 // The in-memory index cache
@@ -18,6 +29,58 @@ var indexCache = &indexCacheBlk{
 	page: new(indexPage),
 }
 
+// The layout template wrapping every document
+var layoutCache = &layoutBlk{
+	mu: new(sync.RWMutex),
+}
+
+// The in-memory feed cache
+var feedCache = &feedCacheBlk{
+	mu: new(sync.RWMutex),
+}
+
+// The in-memory full-text search index
+var searchCache = &searchIndex{
+	mu:    new(sync.RWMutex),
+	terms: make(map[string]map[string]int),
+	docs:  make(map[string]map[string]int),
+}
+
+// The graph of links between pages
+var linkCache = &linkGraph{
+	mu:  new(sync.RWMutex),
+	out: make(map[string]map[string]bool),
+	in:  make(map[string]map[string]bool),
+}
+
+// Listeners for the gopher and gemini servers,
+// closed along with the HTTP server
+var openListeners = &listenerBlk{
+	mu: new(sync.Mutex),
+}
+
+// Where access log lines are written. Standard
+// output unless AccessLog names a file.
+var accessLog = &accessLogBlk{
+	mu:  new(sync.RWMutex),
+	out: os.Stdout,
+}
+
+// The users who can sign in, from the htpasswd file
+var users = &usersBlk{
+	mu:       new(sync.RWMutex),
+	hashes:   make(map[string][]byte),
+	verified: make(map[string][sha256.Size]byte),
+}
+
+// Request, cache and render metrics
+var metrics = &metricsBlk{
+	mu:       new(sync.Mutex),
+	requests: make(map[requestKey]*histogram),
+	checks:   make(map[cacheKey]uint64),
+	render:   newHistogram(),
+}
+
 // indexPage and Page types implement
 // this interface, currently.
 type cacher interface {
@@ -29,9 +92,56 @@ type ipCtxKey int
 
 const ctxKey ipCtxKey = iota
 
+type userCtxKey int
+
+const userKey userCtxKey = iota
+
+type logUserCtxKey int
+
+const logUserKey logUserCtxKey = iota
+
+type usersBlk struct {
+	mu       *sync.RWMutex
+	file     string
+	modtime  time.Time
+	hashes   map[string][]byte
+	verified map[string][sha256.Size]byte
+	key      []byte
+}
+
+type accessLogBlk struct {
+	mu   *sync.RWMutex
+	out  io.Writer
+	file *logFile
+}
+
+type metricsBlk struct {
+	mu       *sync.Mutex
+	requests map[requestKey]*histogram
+	checks   map[cacheKey]uint64
+	render   *histogram
+}
+
+type listenerBlk struct {
+	mu  *sync.Mutex
+	all []net.Listener
+}
+
 type pagesCache struct {
 	mu   *sync.RWMutex
 	pool map[string]*Page
+	// set while the file watcher is keeping
+	// the pool up to date with PageDir
+	watcher *fsnotify.Watcher
+	// rendered pages, most recently used first,
+	// and the bytes they take up
+	lru   *list.List
+	elems map[string]*list.Element
+	used  int64
+	// counters exposed at /api/cache
+	hits      uint64
+	misses    uint64
+	evictions uint64
 }
 
 type indexCacheBlk struct {
@@ -39,6 +149,43 @@ type indexCacheBlk struct {
 	page *indexPage
 }
 
+// Holds the parsed layout template
+type layoutBlk struct {
+	mu   *sync.RWMutex
+	tmpl *template.Template
+}
+
+// Holds the rendered Atom and RSS feeds,
+// and when they were last built
+type feedCacheBlk struct {
+	mu       *sync.RWMutex
+	atom     []byte
+	rss      []byte
+	atomETag string
+	rssETag  string
+	modtime  time.Time
+	built    time.Time
+}
+
+// Inverted index of the words in each page.
+// terms maps a word to the pages containing it
+// and how many times, docs maps a page to its
+// words so it can be removed when re-indexed.
+type searchIndex struct {
+	mu    *sync.RWMutex
+	terms map[string]map[string]int
+	docs  map[string]map[string]int
+}
+
+// Links between pages, keyed by the page's
+// cache name. out holds the pages each page
+// links to, in holds the pages linking to it.
+type linkGraph struct {
+	mu  *sync.RWMutex
+	out map[string]map[string]bool
+	in  map[string]map[string]bool
+}
+
 type confParams struct {
 	mu                   sync.RWMutex
 	port                 string
@@ -52,12 +199,44 @@ type confParams struct {
 	descSep              string
 	titleSep             string
 	iconPath             string
+	layoutFile           string
 	indexFile            string
 	reverseTally         bool
+	groupIndex           bool
+	tableOfContents      bool
+	syntaxHighlight      bool
+	highlightStyle       string
+	userPages            bool
+	userDir              string
+	userWikiDir          string
+	cacheMaxPages        int
+	cacheMaxBytes        int64
+	allowEdit            bool
+	gitHistory           bool
+	baseURL              string
+	feedItems            int
+	gopherPort           string
+	gopherHost           string
+	geminiPort           string
+	geminiCert           string
+	geminiKey            string
+	tlsCert              string
+	tlsKey               string
+	tlsRedirectPort      string
+	metricsPort          string
+	authFile             string
+	sessionSecret        string
+	sessionLifetime      time.Duration
 	validPath            *regexp.Regexp
 	quietLogging         bool
 	fileLogging          bool
+	cacheControl         string
 	logFile              string
+	accessLogFile        string
+	accessLogFormat      string
+	logRotateSize        int64
+	logRotateAge         time.Duration
+	logRotateKeep        int
 }
 
 // Page cache object definition
@@ -68,17 +247,34 @@ type Page struct {
 	Desc      string
 	Author    string
 	Modtime   time.Time
+	ETag      string
+	LastMod   time.Time
 	Body      []byte
+	Content   []byte
+	Gemtext   []byte
 	Raw       pagedata
-	Recache   bool
+	recache   int32
+	Revision  string
+	RevAuthor string
+	RevTime   time.Time
+	Backlinks []string
+	Tags      []string
+	Private   bool
+	Draft     bool
+	TOC       string
 }
 
 // Index cache object definition
 type indexPage struct {
-	Modtime   time.Time
-	LastTally time.Time
-	Body      []byte
-	Raw       pagedata
+	Modtime    time.Time
+	LastTally  time.Time
+	ETag       string
+	LastMod    time.Time
+	Body       []byte
+	Gemtext    []byte
+	Raw        pagedata
+	MemberETag string
+	MemberBody []byte
 }
 
 // Type alias for methods and readability
@@ -87,7 +283,7 @@ type pagedata []byte
 
 // Creates a filled page object
 func newPage(longname, shortname, title, author, desc string, modtime time.Time, body []byte, raw pagedata, recache bool) *Page {
-	return &Page{
+	page := &Page{
 		Longname:  longname,
 		Shortname: shortname,
 		Title:     title,
@@ -96,8 +292,23 @@ func newPage(longname, shortname, title, author, desc string, modtime time.Time,
 		Modtime:   modtime,
 		Body:      body,
 		Raw:       raw,
-		Recache:   recache}
+	}
+	if recache {
+		page.setRecache()
+	}
+	return page
+}
+
+// Flags the page so the next view re-renders it.
+// Cached pages are shared between requests, so the
+// flag is set and read atomically.
+func (page *Page) setRecache() {
+	atomic.StoreInt32(&page.recache, 1)
+}
 
+// Reports whether the page was flagged for re-rendering
+func (page *Page) needsRecache() bool {
+	return atomic.LoadInt32(&page.recache) == 1
 }
 
 // Creates a page object with the minimal number of fields filled
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Matches a user name in /~user/ URLs
+const userNamePattern = `[a-z_][a-z0-9_-]*`
+
+// Matches the name of a page in a user's wiki.
+// Users' wikis are flat, without subdirectories.
+const userPagePattern = `[a-zA-Z0-9_-]+`
+
+var validUserName = regexp.MustCompile("^" + userNamePattern + "$")
+var validUserPage = regexp.MustCompile("^" + userPagePattern + "$")
+
+// Looks up the account a wiki belongs to.
+// Replaced in tests.
+var lookupUser = user.Lookup
+
+// Returns true if pages are read from users' wikis
+func userPagesEnabled() bool {
+	confVars.mu.RLock()
+	defer confVars.mu.RUnlock()
+	return confVars.userPages
+}
+
+// Returns the directory holding a user's wiki pages,
+// such as /home/alice/public_wiki
+func userWikiPath(name string) string {
+	confVars.mu.RLock()
+	defer confVars.mu.RUnlock()
+	return filepath.Join(confVars.userDir, name, confVars.userWikiDir)
+}
+
+// Returns true if the cache key belongs to a
+// page from a user's wiki, such as ~alice/notes.md
+func isUserPage(key string) bool {
+	return strings.HasPrefix(key, "~")
+}
+
+// Splits a file in a user's wiki into the user and
+// the page file name. Returns false for files that
+// aren't in one.
+func userPageOf(longname string) (string, string, bool) {
+	confVars.mu.RLock()
+	enabled := confVars.userPages
+	userDir := confVars.userDir
+	wikiDir := confVars.userWikiDir
+	confVars.mu.RUnlock()
+	if !enabled {
+		return "", "", false
+	}
+
+	rel, err := filepath.Rel(userDir, longname)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", "", false
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	if len(parts) != 3 || parts[1] != wikiDir {
+		return "", "", false
+	}
+	return parts[0], parts[2], true
+}
+
+// Returns the cache key for a page file: its path
+// under PageDir, or ~user/page.md for a page in a
+// user's wiki
+func pageKey(longname string) string {
+	if name, file, ok := userPageOf(longname); ok {
+		return "~" + name + "/" + file
+	}
+	confVars.mu.RLock()
+	defer confVars.mu.RUnlock()
+	return pageName(confVars.pageDir, longname)
+}
+
+// Returns the path of the file behind a cache key
+func keyFile(key string) string {
+	if isUserPage(key) {
+		if i := strings.IndexByte(key, '/'); i > 0 {
+			return filepath.Join(userWikiPath(key[1:i]), key[i+1:])
+		}
+	}
+	confVars.mu.RLock()
+	defer confVars.mu.RUnlock()
+	return confVars.pageDir + "/" + key
+}
+
+// Returns the uid owning a file
+func fileOwner(f os.FileInfo) (uint32, bool) {
+	stat, ok := f.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return stat.Uid, true
+}
+
+// Returns the uid owning a user's wiki directory.
+// The directory can't be a symlink, and must belong
+// to the account it's named for, so nobody can
+// publish another user's files under their name.
+func wikiDirOwner(name string) (uint32, error) {
+	dir := userWikiPath(name)
+	stat, err := os.Lstat(dir)
+	if err != nil {
+		return 0, err
+	}
+	if stat.Mode()&os.ModeSymlink != 0 || !stat.IsDir() {
+		return 0, errors.New(dir + " isn't a directory")
+	}
+	uid, ok := fileOwner(stat)
+	if !ok {
+		return 0, errors.New("can't tell who owns " + dir)
+	}
+	account, err := lookupUser(name)
+	if err != nil {
+		return 0, err
+	}
+	if account.Uid != strconv.FormatUint(uint64(uid), 10) {
+		return 0, errors.New(dir + " isn't owned by " + name)
+	}
+	return uid, nil
+}
+
+// Returns true if a file in a user's wiki may be
+// served. Only regular files owned by the owner of
+// the wiki directory are, so users can't publish
+// other files the wiki can read by linking to them.
+func servableUserFile(f os.FileInfo, owner uint32) bool {
+	if !f.Mode().IsRegular() || strings.HasPrefix(f.Name(), ".") || !strings.HasSuffix(f.Name(), ".md") {
+		return false
+	}
+	uid, ok := fileOwner(f)
+	return ok && uid == owner
+}
+
+// Lists the users with a wiki directory
+func userWikis() []string {
+	confVars.mu.RLock()
+	userDir := confVars.userDir
+	confVars.mu.RUnlock()
+
+	homes, err := ioutil.ReadDir(userDir)
+	if err != nil {
+		log.Printf("Couldn't read user directory: %v\n", err.Error())
+		return nil
+	}
+	names := make([]string, 0)
+	for _, home := range homes {
+		if !validUserName.MatchString(home.Name()) {
+			continue
+		}
+		if _, err := wikiDirOwner(home.Name()); err == nil {
+			names = append(names, home.Name())
+		}
+	}
+	return names
+}
+
+// Lists the page files in a user's wiki,
+// sorted by name
+func userWikiPages(name string) ([]string, error) {
+	owner, err := wikiDirOwner(name)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(userWikiPath(name))
+	if err != nil {
+		return nil, err
+	}
+	pages := make([]string, 0, len(files))
+	for _, f := range files {
+		if servableUserFile(f, owner) && validUserPage.MatchString(strings.TrimSuffix(f.Name(), ".md")) {
+			pages = append(pages, f.Name())
+		}
+	}
+	sort.Strings(pages)
+	return pages, nil
+}
+
+// Returns the path of a page in a user's wiki if it
+// exists and may be served
+func userPageFile(name, page string) (string, error) {
+	owner, err := wikiDirOwner(name)
+	if err != nil {
+		return "", err
+	}
+
+	longname := filepath.Join(userWikiPath(name), page+".md")
+	f, err := os.Lstat(longname)
+	if err != nil {
+		return "", err
+	}
+	if !servableUserFile(f, owner) {
+		return "", errors.New(longname + " isn't a regular file owned by " + name)
+	}
+	return longname, nil
+}
+
+// Opens a page file for reading. Files in users' wikis
+// are opened without following symlinks and checked
+// again once open, so a file swapped in after
+// userPageFile() looked at the path isn't served.
+// O_NONBLOCK keeps a FIFO from stalling the open.
+func openPageFile(filename string) (*os.File, error) {
+	name, _, ok := userPageOf(filename)
+	if !ok {
+		return os.Open(filename)
+	}
+	owner, err := wikiDirOwner(name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filename, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil || !servableUserFile(stat, owner) {
+		file.Close()
+		return nil, errors.New(filename + " isn't a regular file owned by " + name)
+	}
+	return file, nil
+}
+
+// Reads a whole page file, opened with openPageFile()
+func readPageFile(filename string) ([]byte, error) {
+	file, err := openPageFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ioutil.ReadAll(file)
+}
+
+// Caches the pages of every user's wiki.
+// Called by genPageCache().
+func genUserPageCache() []string {
+	keys := make([]string, 0)
+	for _, name := range userWikis() {
+		pages, err := userWikiPages(name)
+		if err != nil {
+			log.Printf("Couldn't list the wiki of %v: %v\n", name, err.Error())
+			continue
+		}
+		for _, file := range pages {
+			key := "~" + name + "/" + file
+			page := newBarePage(filepath.Join(userWikiPath(name), file), key)
+			if err := page.load(); err != nil {
+				log.Printf("While caching user page %v, caught error: %v\n", key, err.Error())
+				continue
+			}
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Pulls a page from a user's wiki from the cache,
+// caching it first if necessary. Pages that are gone
+// from disk are dropped from the cache.
+func freshUserPage(name, page string) (*Page, error) {
+	key := "~" + name + "/" + page + ".md"
+	longname, err := userPageFile(name, page)
+	if err != nil {
+		if _, err := pullFromCache(key); err == nil {
+			evictPages(key)
+		}
+		return nil, err
+	}
+
+	if _, err := pullFromCache(key); err != nil {
+		if err := newBarePage(longname, key).load(); err != nil {
+			return nil, err
+		}
+	}
+	return freshPage(key)
+}
+
+// Serves a page from a user's wiki at /~user/page
+func userPageHandler(w http.ResponseWriter, r *http.Request) {
+	if !userPagesEnabled() {
+		error404(w, r)
+		return
+	}
+	vars := mux.Vars(r)
+	page, err := freshUserPage(vars["user"], vars["page"])
+	if err != nil || (page.Private && requestUser(r) == "") {
+		error404(w, r)
+		return
+	}
+	servePage(w, r, page)
+}
+
+// Returns the cached stub of a page in a user's
+// wiki, loading the page's header if it hasn't
+// been cached yet. Doesn't render the page.
+func userPageStub(name, file string) (*Page, error) {
+	key := "~" + name + "/" + file
+	if page, err := pullFromCache(key); err == nil {
+		return page, nil
+	}
+	if err := newBarePage(filepath.Join(userWikiPath(name), file), key).cacheStub(); err != nil {
+		return nil, err
+	}
+	return pullFromCache(key)
+}
+
+// Lists the pages in a user's wiki at /~user/
+func userIndexHandler(w http.ResponseWriter, r *http.Request) {
+	if !userPagesEnabled() {
+		error404(w, r)
+		return
+	}
+	name := mux.Vars(r)["user"]
+	files, err := userWikiPages(name)
+	if err != nil {
+		error404(w, r)
+		return
+	}
+
+	confVars.mu.RLock()
+	viewPath := confVars.viewPath
+	title := "~" + name + " " + confVars.titleSep + " " + confVars.wikiName
+	confVars.mu.RUnlock()
+
+	members := requestUser(r) != ""
+	links := bytes.NewBuffer(nil)
+	for _, file := range files {
+		page, err := userPageStub(name, file)
+		if err != nil || (page.Private && !members) {
+			continue
+		}
+		links.WriteString(indexLink(page, viewPath))
+	}
+
+	buf := bytes.NewBuffer(nil)
+	buf.WriteString("[Home](/) / ~" + name + "\n\n")
+	buf.WriteString("# ~" + name + "\n\n")
+	if links.Len() == 0 {
+		buf.WriteString("*No pages in this wiki.*\n")
+	}
+	buf.Write(links.Bytes())
+
+	body := render(buf.Bytes(), title)
+	if notModified(w, r, contentETag(body), time.Time{}) {
+		return
+	}
+	w.Header().Set("Content-Type", htmlutf8)
+	if err := writeBody(w, r, body); err != nil {
+		log500(w, r, err)
+		return
+	}
+}
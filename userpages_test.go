@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/user"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// Builds a directory of user homes with wikis and
+// turns on user pages. The returned func restores
+// the config and removes the directory.
+func userWikiDir(t *testing.T) (string, func()) {
+	initConfigParams()
+	log.SetOutput(hush)
+
+	dir, err := ioutil.TempDir("", "tildewiki-homes")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	files := map[string]string{
+		"alice/public_wiki/notes.md":   "<!--\ntitle: Alice's Notes\nauthor: Somebody Else\n-->\n# Notes\n",
+		"alice/public_wiki/.hidden.md": "hidden\n",
+		"alice/public_wiki/readme.txt": "not a page\n",
+		"bob/public_wiki/todo.md":      "<!--\ntitle: Todo\naccess: private\n-->\n# Todo\n",
+		"carol/elsewhere/page.md":      "# Not a wiki\n",
+	}
+	for name, body := range files {
+		if err := os.MkdirAll(dir+"/"+pageDirOf(name), 0755); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		if err := ioutil.WriteFile(dir+"/"+name, []byte(body), 0644); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+	}
+	// links out of the wiki aren't served
+	if err := os.Symlink(dir+"/carol/elsewhere/page.md", dir+"/alice/public_wiki/linked.md"); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	// nor are wikis linking to someone else's directory
+	os.Mkdir(dir+"/dave", 0755)
+	if err := os.Symlink(dir+"/alice/public_wiki", dir+"/dave/public_wiki"); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	// the test's own user stands in for the accounts,
+	// except erin, whose wiki belongs to someone else
+	me, err := user.Current()
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	os.MkdirAll(dir+"/erin/public_wiki", 0755)
+	ioutil.WriteFile(dir+"/erin/public_wiki/page.md", []byte("# Not erin's\n"), 0644)
+	lookupUser = func(name string) (*user.User, error) {
+		switch name {
+		case "alice", "bob", "dave":
+			return &user.User{Uid: me.Uid, Username: name}, nil
+		case "erin":
+			return &user.User{Uid: me.Uid + "1", Username: name}, nil
+		}
+		return nil, user.UnknownUserError(name)
+	}
+
+	confVars.mu.Lock()
+	confVars.userPages = true
+	confVars.userDir = dir
+	confVars.userWikiDir = "public_wiki"
+	confVars.mu.Unlock()
+
+	return dir, func() {
+		confVars.mu.Lock()
+		confVars.userPages = false
+		confVars.mu.Unlock()
+		lookupUser = user.Lookup
+		evictPages("~alice")
+		evictPages("~bob")
+		os.RemoveAll(dir)
+	}
+}
+
+func Test_userWikiPages(t *testing.T) {
+	dir, cleanup := userWikiDir(t)
+	defer cleanup()
+
+	if got := userWikis(); !reflect.DeepEqual(got, []string{"alice", "bob"}) {
+		t.Errorf("userWikis(): got %v\n", got)
+	}
+	if got, err := userWikiPages("alice"); err != nil || !reflect.DeepEqual(got, []string{"notes.md"}) {
+		t.Errorf("userWikiPages(): got %v, %v\n", got, err)
+	}
+	if _, err := userPageFile("alice", "linked"); err == nil {
+		t.Errorf("userPageFile(): served a symlink\n")
+	}
+
+	// nor opened, should one be swapped in after the check
+	if _, err := loadPage(dir + "/alice/public_wiki/linked.md"); err == nil {
+		t.Errorf("loadPage(): followed a symlink\n")
+	}
+	if _, err := readHeader(dir + "/alice/public_wiki/linked.md"); err == nil {
+		t.Errorf("readHeader(): followed a symlink\n")
+	}
+
+	longname := dir + "/alice/public_wiki/notes.md"
+	if got := pageKey(longname); got != "~alice/notes.md" {
+		t.Errorf("pageKey(): got %v\n", got)
+	}
+	if got := keyFile("~alice/notes.md"); got != longname {
+		t.Errorf("keyFile(): got %v\n", got)
+	}
+	if got := pageURL("/w/", "~alice/notes.md"); got != "/~alice/notes" {
+		t.Errorf("pageURL(): got %v\n", got)
+	}
+	if got := pageKey(dir + "/carol/elsewhere/page.md"); got == "~carol/page.md" {
+		t.Errorf("pageKey(): treated a file outside the wiki directory as a user page\n")
+	}
+}
+
+func Test_userPageHandler(t *testing.T) {
+	_, cleanup := userWikiDir(t)
+	defer cleanup()
+	genPageCache()
+
+	page, err := pullFromCache("~alice/notes.md")
+	if err != nil {
+		t.Fatalf("genPageCache(): user page wasn't cached: %v\n", err)
+	}
+	if page.Author != "`by alice`" {
+		t.Errorf("loadPage(): got author %v, want alice\n", page.Author)
+	}
+
+	serv := mux.NewRouter()
+	serv.Path("/~{user:" + userNamePattern + "}/").HandlerFunc(userIndexHandler)
+	serv.Path("/~{user:" + userNamePattern + "}/{page:" + userPagePattern + "}").HandlerFunc(userPageHandler)
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/~alice/notes", "<title>Alice&#39;s Notes"},
+		{"/~alice/", "/~alice/notes"},
+		{"/~bob/todo", "404"},
+		{"/~alice/linked", "404"},
+		{"/~carol/page", "404"},
+		{"/~dave/notes", "404"},
+		{"/~erin/page", "404"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			serv.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+			if !bytes.Contains(w.Body.Bytes(), []byte(tt.want)) {
+				t.Errorf("%v: want %q in:\n%s\n", tt.path, tt.want, w.Body.Bytes())
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	serv.ServeHTTP(w, httptest.NewRequest("GET", "/~bob/", nil))
+	if bytes.Contains(w.Body.Bytes(), []byte("Todo")) {
+		t.Errorf("userIndexHandler(): listed a private page\n")
+	}
+
+	// the listing doesn't render the pages it lists,
+	// and can be revalidated
+	evictPages("~alice")
+	w = httptest.NewRecorder()
+	serv.ServeHTTP(w, httptest.NewRequest("GET", "/~alice/", nil))
+	if page, err := pullFromCache("~alice/notes.md"); err != nil || page.Body != nil {
+		t.Errorf("userIndexHandler(): rendered the listed page\n")
+	}
+	r := httptest.NewRequest("GET", "/~alice/", nil)
+	r.Header.Set("If-None-Match", w.Header().Get("ETag"))
+	w = httptest.NewRecorder()
+	serv.ServeHTTP(w, r)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("userIndexHandler(): got %v for a current ETag\n", w.Code)
+	}
+}
+
+// Header fields of users' pages are escaped in
+// every listing that includes them
+func Test_userPageListingsEscapeDesc(t *testing.T) {
+	dir, cleanup := userWikiDir(t)
+	defer cleanup()
+	evil := "<!--\ntitle: Evil\ndescription: <script>alert(1)</script>\ntags: evil\n-->\n# Evil\n\nxylophone\n"
+	if err := ioutil.WriteFile(dir+"/alice/public_wiki/evil.md", []byte(evil), 0644); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	genPageCache()
+
+	serv := mux.NewRouter()
+	serv.Path("/~{user:" + userNamePattern + "}/").HandlerFunc(userIndexHandler)
+	serv.Path("/tag/{name}").HandlerFunc(tagHandler)
+	serv.Path("/search").HandlerFunc(searchHandler)
+
+	for _, path := range []string{"/~alice/", "/tag/evil", "/search?q=xylophone"} {
+		w := httptest.NewRecorder()
+		serv.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		body := w.Body.Bytes()
+		if !bytes.Contains(body, []byte("/~alice/evil")) {
+			t.Errorf("%v: didn't list the page:\n%s\n", path, body)
+		}
+		if bytes.Contains(body, []byte("<script>")) {
+			t.Errorf("%v: description wasn't escaped:\n%s\n", path, body)
+		}
+	}
+}
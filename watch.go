@@ -0,0 +1,249 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Watches PageDir, its subdirectories and AssetsDir,
+// keeping the caches up to date as files change.
+// While the watcher runs, pages are served without
+// checking them against the disk first.
+func watchFiles() {
+	confVars.mu.RLock()
+	pageDir := confVars.pageDir
+	assetsDir := confVars.assetsDir
+	confVars.mu.RUnlock()
+
+	watcher, err := newFileWatcher(pageDir, assetsDir)
+	if err != nil {
+		log.Printf("Couldn't watch for file changes, checking pages on each request instead: %v\n", err.Error())
+		return
+	}
+
+	pageCache.mu.Lock()
+	pageCache.watcher = watcher
+	pageCache.mu.Unlock()
+}
+
+// Stops the file watcher, if it's running.
+// Pages are checked on each request again.
+func stopWatchingFiles() {
+	pageCache.mu.Lock()
+	watcher := pageCache.watcher
+	pageCache.watcher = nil
+	pageCache.mu.Unlock()
+
+	if watcher != nil {
+		if err := watcher.Close(); err != nil {
+			log.Printf("Couldn't stop file watcher: %v\n", err.Error())
+		}
+	}
+}
+
+// Returns true while the file watcher is
+// keeping the page cache up to date
+func watchingFiles() bool {
+	pageCache.mu.RLock()
+	defer pageCache.mu.RUnlock()
+	return pageCache.watcher != nil
+}
+
+// Creates the watcher and starts handling its events
+func newFileWatcher(pageDir, assetsDir string) (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := watchTree(watcher, pageDir); err != nil {
+		_ = watcher.Close()
+		return nil, err
+	}
+	// watch the directory rather than the files in it,
+	// since editors often replace a file when saving
+	if err := watcher.Add(assetsDir); err != nil {
+		_ = watcher.Close()
+		return nil, err
+	}
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				handleFileEvent(watcher, pageDir, assetsDir, event)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("File watcher error: %v\n", err.Error())
+			}
+		}
+	}()
+
+	return watcher, nil
+}
+
+// Adds a directory and every directory below it to
+// the watcher, skipping hidden ones such as the
+// history repository
+func watchTree(watcher *fsnotify.Watcher, root string) error {
+	return filepath.Walk(root, func(longname string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !f.IsDir() {
+			return nil
+		}
+		if longname != root && !isPageFile(f) {
+			return filepath.SkipDir
+		}
+		return watcher.Add(longname)
+	})
+}
+
+// Updates the caches for a single change on disk
+func handleFileEvent(watcher *fsnotify.Watcher, pageDir, assetsDir string, event fsnotify.Event) {
+	if strings.HasPrefix(filepath.Base(event.Name), ".") {
+		return
+	}
+	if filepath.Dir(event.Name) == filepath.Clean(assetsDir) {
+		assetChanged(event)
+		return
+	}
+
+	// everything else is under PageDir
+	name := pageName(pageDir, event.Name)
+	switch {
+	case event.Op&(fsnotify.Create|fsnotify.Write) != 0:
+		stat, err := os.Stat(event.Name)
+		if err != nil {
+			// already gone again, so a remove
+			// event is on its way
+			return
+		}
+		if !stat.IsDir() {
+			recordChange(pageDir, name, "Update "+name)
+			recachePage(pageDir, name)
+			return
+		}
+
+		// pages may have been written to a new
+		// directory before it was being watched
+		if err := watchTree(watcher, event.Name); err != nil {
+			log.Printf("Couldn't watch new directory %v: %v\n", event.Name, err.Error())
+		}
+		names, err := walkPages(event.Name)
+		if err != nil {
+			log.Printf("Couldn't read new directory %v: %v\n", event.Name, err.Error())
+		}
+		for _, f := range names {
+			recordChange(pageDir, name+"/"+f, "Update "+name+"/"+f)
+			recachePage(pageDir, name+"/"+f)
+		}
+	case event.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+		// some editors move the old file out of
+		// the way and write a new one in its place
+		if _, err := os.Stat(event.Name); err == nil {
+			return
+		}
+		recordChange(pageDir, name, "Delete "+name)
+		evictPages(name)
+	}
+}
+
+// Handles a change to a file in AssetsDir
+func assetChanged(event fsnotify.Event) {
+	if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) == 0 {
+		return
+	}
+
+	confVars.mu.RLock()
+	layoutFile := confVars.layoutFile
+	indexFile := confVars.indexFile
+	confVars.mu.RUnlock()
+
+	switch filepath.Base(event.Name) {
+	case layoutFile:
+		log.Println("**NOTICE** Layout change detected: ", event.Name)
+		reloadLayout()
+	case indexFile:
+		indexCache.mu.Lock()
+		indexCache.page.LastTally = time.Time{}
+		indexCache.mu.Unlock()
+	}
+}
+
+// Re-caches a page after its file changed. Pages
+// linking to a new page are re-rendered, so their
+// links to it are no longer marked as missing.
+func recachePage(pageDir, name string) {
+	_, err := pullFromCache(name)
+	isNew := err != nil
+
+	page := newBarePage(pageDir+"/"+name, name)
+	if err := page.load(); err != nil {
+		log.Printf("Couldn't re-cache %v after it changed: %v\n", name, err.Error())
+		return
+	}
+	if isNew {
+		log.Printf("**NOTICE** New page detected: %v\n", name)
+		markRecache(linkCache.backlinks(name))
+	}
+	staleListings()
+}
+
+// Drops a deleted page, or every page under
+// a deleted directory, from the caches
+func evictPages(name string) {
+	pageCache.mu.Lock()
+	gone := make([]string, 0)
+	for key := range pageCache.pool {
+		if key == name || strings.HasPrefix(key, name+"/") {
+			delete(pageCache.pool, key)
+			pageCache.forgetLocked(key)
+			gone = append(gone, key)
+		}
+	}
+	pageCache.mu.Unlock()
+
+	for _, key := range gone {
+		log.Printf("**NOTICE** Page removed: %v\n", key)
+		searchCache.remove(key)
+		refreshBacklinks(linkCache.update(key, nil))
+		markRecache(linkCache.backlinks(key))
+	}
+	if len(gone) > 0 {
+		staleListings()
+	}
+}
+
+// Flags the given cached pages for re-caching
+func markRecache(names []string) {
+	pageCache.mu.RLock()
+	for _, name := range names {
+		if page, ok := pageCache.pool[name]; ok {
+			page.setRecache()
+		}
+	}
+	pageCache.mu.RUnlock()
+}
+
+// Rebuilds the index and feeds on their next
+// request, so they reflect a changed page
+func staleListings() {
+	indexCache.mu.Lock()
+	indexCache.page.LastTally = time.Time{}
+	indexCache.mu.Unlock()
+	feedCache.mu.Lock()
+	feedCache.built = time.Time{}
+	feedCache.mu.Unlock()
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Polls until cond returns true, failing the
+// test if it doesn't within a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Errorf("timed out waiting for %v\n", what)
+}
+
+// Creates, edits and deletes pages while the
+// watcher runs, checking the cache follows along
+func Test_newFileWatcher(t *testing.T) {
+	initConfigParams()
+	log.SetOutput(hush)
+
+	pageDir, err := ioutil.TempDir("", "tildewiki-watch")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer os.RemoveAll(pageDir)
+	assetsDir, err := ioutil.TempDir("", "tildewiki-watch-assets")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer os.RemoveAll(assetsDir)
+
+	confVars.mu.Lock()
+	oldDir := confVars.pageDir
+	confVars.pageDir = pageDir
+	confVars.mu.Unlock()
+	defer func() {
+		confVars.mu.Lock()
+		confVars.pageDir = oldDir
+		confVars.mu.Unlock()
+	}()
+
+	watcher, err := newFileWatcher(pageDir, assetsDir)
+	if err != nil {
+		t.Fatalf("newFileWatcher(): %v\n", err)
+	}
+	defer watcher.Close()
+
+	cached := func(name string, want []byte) func() bool {
+		return func() bool {
+			page, err := pullFromCache(name)
+			return err == nil && bytes.Contains(page.Raw, want)
+		}
+	}
+
+	if err := ioutil.WriteFile(pageDir+"/watched.md", []byte("# first\n"), 0644); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	waitFor(t, "new page", cached("watched.md", []byte("first")))
+
+	if err := ioutil.WriteFile(pageDir+"/watched.md", []byte("# zanzibarish\n"), 0644); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	waitFor(t, "changed page", cached("watched.md", []byte("zanzibarish")))
+
+	// pages in a directory created after
+	// the watcher started
+	if err := os.MkdirAll(pageDir+"/sub", 0755); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if err := ioutil.WriteFile(pageDir+"/sub/nested.md", []byte("# nested\n"), 0644); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	waitFor(t, "nested page", cached("sub/nested.md", []byte("nested")))
+
+	if err := os.Remove(pageDir + "/watched.md"); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	waitFor(t, "removed page", func() bool {
+		_, err := pullFromCache("watched.md")
+		return err != nil
+	})
+	if len(searchCache.query("zanzibarish")) != 0 {
+		t.Errorf("removed page is still in the search index\n")
+	}
+
+	if err := os.RemoveAll(pageDir + "/sub"); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	waitFor(t, "removed directory", func() bool {
+		_, err := pullFromCache("sub/nested.md")
+		return err != nil
+	})
+}
+
+// Make sure the watcher follows PageDir
+// when the config file moves it
+func Test_reloadConf_watcher(t *testing.T) {
+	initConfigParams()
+	log.SetOutput(hush)
+
+	pageDir, err := ioutil.TempDir("", "tildewiki-watch")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer os.RemoveAll(pageDir)
+
+	watchFiles()
+	defer stopWatchingFiles()
+	pageCache.mu.RLock()
+	before := pageCache.watcher
+	pageCache.mu.RUnlock()
+
+	oldDir := viper.GetString("PageDir")
+	viper.Set("PageDir", pageDir)
+	defer func() {
+		viper.Set("PageDir", oldDir)
+		reloadConf()
+	}()
+	reloadConf()
+
+	pageCache.mu.RLock()
+	after := pageCache.watcher
+	pageCache.mu.RUnlock()
+	if after == nil || after == before {
+		t.Fatalf("reloadConf(): watcher wasn't restarted\n")
+	}
+
+	if err := ioutil.WriteFile(pageDir+"/moved.md", []byte("<!--\ntitle: Moved\n-->\n# Moved\n"), 0644); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer func() {
+		pageCache.mu.Lock()
+		delete(pageCache.pool, "moved.md")
+		pageCache.mu.Unlock()
+	}()
+	waitFor(t, "a page in the new PageDir", func() bool {
+		page, err := pullFromCache("moved.md")
+		return err == nil && page.Title == "Moved"
+	})
+}